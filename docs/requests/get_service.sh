@@ -0,0 +1,3 @@
+#!/bin/sh
+
+curl -ss -H "X-Broker-API-Version: 2.14" "http://localhost:5000/v2/service_instances/3b2e7d2c915242a5befcf03e1c3f47cd" | json_pp
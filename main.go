@@ -1,18 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"code.cloudfoundry.org/lager"
+	"github.com/monostream/helmi/pkg/audit"
 	"github.com/monostream/helmi/pkg/broker"
 	"github.com/monostream/helmi/pkg/catalog"
 	"github.com/monostream/helmi/pkg/config"
 	"github.com/monostream/helmi/pkg/helm"
+	"github.com/monostream/helmi/pkg/release"
 )
 
 func main() {
@@ -23,8 +27,10 @@ func main() {
 	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.DEBUG))
 	logger.RegisterSink(lager.NewWriterSink(os.Stderr, lager.ERROR))
 
+	helmClient := newHelmClient(configuration)
+
 	// expects a JSON map in the form of "name":"http://url" pairs
-	err := parseHelmReposFromJSON(configuration.RepositoryURLs)
+	err := parseHelmReposFromJSON(helmClient, configuration.RepositoryURLs)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -37,13 +43,13 @@ func main() {
 			log.Fatal("invalid env var CATALOG_UPDATE_INTERVAL: " + err.Error())
 		}
 	}
-	c, err := catalog.New(catalogSource, catalogUpdateInterval)
+	c, err := catalog.New(catalogSource, catalogUpdateInterval, helmClient)
 
 	if err != nil {
 		log.Fatal("Failed to parse catalog. Did you set CATALOG_URL correctly? Error:", err)
 	}
 
-	err = verifyChartVersions(c)
+	err = verifyChartVersions(helmClient, c)
 
 	if err != nil {
 		log.Fatal(err)
@@ -53,11 +59,43 @@ func main() {
 		log.Println("Username and/or password not specified, authentication will be disabled!")
 	}
 
-	b := broker.NewBroker(c, configuration, logger)
+	if !broker.IsNamespacePolicy(configuration.NamespacePolicy) {
+		log.Fatal("invalid env var NAMESPACE_POLICY: " + configuration.NamespacePolicy)
+	}
+
+	auditSink, err := audit.NewSink(configuration.AuditSink)
+	if err != nil {
+		log.Fatal("invalid env var AUDIT_SINK: " + err.Error())
+	}
+
+	b := broker.NewBroker(c, configuration, logger, auditSink, helmClient)
 	b.Run()
 }
 
-func parseHelmReposFromJSON(helmReposJSON string) error {
+// Returns the client of the Helm backend, Helm 2 releases are migrated first if Helm 3 takes over from tiller
+func newHelmClient(configuration *config.Config) helm.Client {
+	switch configuration.HelmBackend {
+	case "helm2":
+		return helm.NewCLI(configuration.HelmBinary)
+	case "helm3":
+		client := helm.NewHelm3CLI(configuration.HelmBinary)
+
+		if migrate, _ := strconv.ParseBool(configuration.MigrateHelm2Releases); migrate {
+			migrated, err := release.MigrateHelm2Releases(context.Background(), client, configuration.TillerNamespace, broker.LockNamespace(configuration))
+			if err != nil {
+				log.Fatal("failed to migrate helm 2 releases: " + err.Error())
+			}
+			log.Printf("Migrated %d helm 2 releases", len(migrated))
+		}
+
+		return client
+	}
+
+	log.Fatal("invalid env var HELM_BACKEND: " + configuration.HelmBackend)
+	return nil
+}
+
+func parseHelmReposFromJSON(helmClient helm.Client, helmReposJSON string) error {
 	var helmRepos map[string]string
 
 	err := json.Unmarshal([]byte(helmReposJSON), &helmRepos)
@@ -67,17 +105,17 @@ func parseHelmReposFromJSON(helmReposJSON string) error {
 	}
 
 	for repo, url := range helmRepos {
-		err := helm.RepoAdd(repo, url)
+		err := helmClient.RepoAdd(context.Background(), repo, url)
 		if err != nil {
 			return fmt.Errorf("failed to update repository %s: %s", repo, err)
 		}
 	}
 
-	return helm.RepoUpdate()
+	return helmClient.RepoUpdate(context.Background())
 }
 
-func verifyChartVersions(catalog *catalog.Catalog) error {
-	charts, err := helm.ListCharts()
+func verifyChartVersions(helmClient helm.Client, catalog *catalog.Catalog) error {
+	charts, err := helmClient.ListCharts(context.Background())
 
 	if err != nil {
 		return err
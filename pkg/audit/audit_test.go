@@ -0,0 +1,123 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func red(msg string) string {
+	return "\033[31m" + msg + "\033[39m\n\n"
+}
+
+func Test_ParseIdentity(t *testing.T) {
+	value := base64.StdEncoding.EncodeToString([]byte(`{"user_id": "683ea748-3092-4ff4-b656-39cacc4d5360"}`))
+
+	identity, err := ParseIdentity("cloudfoundry " + value)
+	if err != nil {
+		t.Error(red(err.Error()))
+		return
+	}
+
+	if identity.Platform != "cloudfoundry" || identity.Value["user_id"] != "683ea748-3092-4ff4-b656-39cacc4d5360" {
+		t.Error(red("identity was not decoded"))
+	}
+
+	invalid := []string{
+		"",
+		"cloudfoundry",
+		"cloudfoundry not-base64!",
+		"cloudfoundry " + base64.StdEncoding.EncodeToString([]byte(`"not an object"`)),
+	}
+
+	for _, header := range invalid {
+		if _, err := ParseIdentity(header); err == nil {
+			t.Error(red("header " + header + " should be rejected"))
+		}
+	}
+}
+
+func Test_IdentityFromContext(t *testing.T) {
+	if IdentityFromContext(context.Background()) != nil {
+		t.Error(red("context without identity should not return one"))
+	}
+
+	identity := &Identity{Platform: "kubernetes"}
+	if IdentityFromContext(WithIdentity(context.Background(), identity)) != identity {
+		t.Error(red("identity was not kept in the context"))
+	}
+}
+
+func Test_FileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.jsonl")
+
+	sink, err := NewSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink.Write(Event{Operation: "provision", InstanceID: "instance", Outcome: Succeeded})
+	sink.Write(Event{Operation: "deprovision", InstanceID: "instance", Outcome: Accepted})
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var operations []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Error(red(err.Error()))
+		}
+		operations = append(operations, event.Operation)
+	}
+
+	if len(operations) != 2 || operations[0] != "provision" || operations[1] != "deprovision" {
+		t.Error(red("events should be appended as JSON lines"))
+	}
+}
+
+func Test_WebhookSink(t *testing.T) {
+	var received Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	sink, _ := NewSink(server.URL)
+
+	err := sink.Write(Event{Operation: "bind", InstanceID: "instance", BindingID: "binding", Outcome: Succeeded})
+	if err != nil {
+		t.Error(red(err.Error()))
+	}
+
+	if received.BindingID != "binding" {
+		t.Error(red("event was not posted to the webhook"))
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	sink, _ = NewSink(failing.URL)
+	if sink.Write(Event{}) == nil {
+		t.Error(red("webhook errors should be returned"))
+	}
+}
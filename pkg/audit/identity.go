@@ -0,0 +1,67 @@
+package audit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Header in which platforms pass the user on whose behalf a request is sent
+const OriginatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+// User on whose behalf the platform sent a request, e.g. `user_id` for cloudfoundry
+// or `username`, `uid` and `groups` for kubernetes
+type Identity struct {
+	Platform string                 `json:"platform"`
+	Value    map[string]interface{} `json:"value"`
+}
+
+type identityKey struct{}
+
+// Decodes the value of the originating identity header, `<platform> <base64 encoded JSON>`
+func ParseIdentity(header string) (*Identity, error) {
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return nil, errors.New("originating identity must consist of the platform and a base64 encoded value")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, errors.New("originating identity value is not base64 encoded: " + err.Error())
+	}
+
+	identity := &Identity{
+		Platform: fields[0],
+	}
+
+	err = json.Unmarshal(data, &identity.Value)
+	if err != nil {
+		return nil, errors.New("originating identity value is not a JSON object: " + err.Error())
+	}
+
+	return identity, nil
+}
+
+// Returns the identity as it is kept in the metadata of a release
+func (i *Identity) Metadata() map[string]interface{} {
+	if i == nil {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"platform": i.Platform,
+		"value":    i.Value,
+	}
+}
+
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// Returns the originating identity of the request, or nil if the platform did not send one
+func IdentityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
@@ -0,0 +1,126 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Succeeded = "succeeded"
+	Accepted  = "accepted"
+	Failed    = "failed"
+)
+
+// maximum duration of a webhook request, operations wait for their audit event to be delivered
+const webhookTimeout = time.Second * 10
+
+// Record of an OSB or admin operation on a service instance or binding
+type Event struct {
+	Time       time.Time       `json:"time"`
+	Operation  string          `json:"operation"`
+	InstanceID string          `json:"instance_id"`
+	BindingID  string          `json:"binding_id,omitempty"`
+	ServiceID  string          `json:"service_id,omitempty"`
+	PlanID     string          `json:"plan_id,omitempty"`
+	Identity   *Identity       `json:"identity,omitempty"`
+	Context    json.RawMessage `json:"context,omitempty"`
+	Outcome    string          `json:"outcome"`
+	Error      string          `json:"error,omitempty"`
+	// release revision an instance has been rolled back to
+	Revision int `json:"revision,omitempty"`
+	// plan an instance was on before a rollback to a revision of another plan
+	PreviousPlanID string `json:"previous_plan_id,omitempty"`
+}
+
+// Destination of audit events
+type Sink interface {
+	Write(event Event) error
+}
+
+// Returns the sink for the target of AUDIT_SINK, an http(s) URL receives every event as a POST request,
+// anything else is the path of a file to which events are appended as JSON lines.
+// Events are logged if no target is configured.
+func NewSink(target string) (Sink, error) {
+	switch {
+	case len(target) == 0:
+		return LogSink{}, nil
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		return &webhookSink{
+			url:    target,
+			client: &http.Client{Timeout: webhookTimeout},
+		}, nil
+	default:
+		return newFileSink(strings.TrimPrefix(target, "file://"))
+	}
+}
+
+// Writes events to the standard logger
+type LogSink struct{}
+
+func (LogSink) Write(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("audit: %s", data)
+	return nil
+}
+
+type fileSink struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{file: file}, nil
+}
+
+func (s *fileSink) Write(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err = s.file.Write(append(data, '\n'))
+	return err
+}
+
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Write(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	response, err := s.client.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("audit webhook answered with status %d", response.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/monostream/helmi/pkg/audit"
+	"github.com/monostream/helmi/pkg/release"
+)
+
+const rollbackOperation = "rollback"
+
+// Platform of the audit identity of admin requests which do not send an originating identity
+const adminPlatform = "helmi-admin"
+
+// Routes for operators, not part of the OSB API, they require the credentials of the broker
+func (b *Broker) attachAdminRoutes() []*mux.Route {
+	return []*mux.Route{
+		b.router.HandleFunc("/admin/service_instances/{instance_id}/revisions", b.revisionsHandler).Methods(http.MethodGet),
+		b.router.HandleFunc("/admin/service_instances/{instance_id}/rollback", b.rollbackHandler).Methods(http.MethodPost),
+	}
+}
+
+type revisionsResponse struct {
+	Revisions []release.InstanceRevision `json:"revisions"`
+}
+
+// Answers GET /admin/service_instances/:instance_id/revisions with the latest revisions of the release of an instance,
+// the query parameter max raises or lowers their number
+func (b *Broker) revisionsHandler(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["instance_id"]
+
+	max := release.DefaultHistory
+	if value := r.URL.Query().Get("max"); len(value) > 0 {
+		var err error
+		max, err = strconv.Atoi(value)
+		if err != nil || max < 1 {
+			b.writeJSONResponse(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+				Description: "max must be a positive number of revisions",
+			})
+			return
+		}
+	}
+
+	revisions, err := release.History(r.Context(), instanceID, max)
+	if err != nil {
+		if err == release.ErrReleaseNotFound {
+			b.writeJSONResponse(w, http.StatusNotFound, brokerapi.ErrorResponse{
+				Description: brokerapi.ErrInstanceDoesNotExist.Error(),
+			})
+			return
+		}
+
+		b.writeJSONError(w, err)
+		return
+	}
+
+	b.writeJSONResponse(w, http.StatusOK, revisionsResponse{Revisions: revisions})
+}
+
+type rollbackRequest struct {
+	Revision int `json:"revision"`
+	// a revision of another plan than the current one is only rolled back to if set
+	AllowPlanChange bool `json:"allow_plan_change"`
+}
+
+type rollbackResponse struct {
+	// revision created by the rollback
+	Revision   int `json:"revision"`
+	RolledBack int `json:"rolled_back_to"`
+}
+
+// Answers POST /admin/service_instances/:instance_id/rollback, rolls the instance back to the revision of the body
+func (b *Broker) rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["instance_id"]
+
+	var request rollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Revision < 1 {
+		b.writeJSONResponse(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+			Description: "body must name the revision to roll back to, e.g. {\"revision\": 2}",
+		})
+		return
+	}
+
+	ctx := r.Context()
+	if audit.IdentityFromContext(ctx) == nil {
+		username, _, _ := r.BasicAuth()
+		ctx = audit.WithIdentity(ctx, &audit.Identity{
+			Platform: adminPlatform,
+			Value:    map[string]interface{}{"username": username},
+		})
+	}
+
+	result, err := b.rollback(ctx, instanceID, request.Revision, request.AllowPlanChange)
+
+	event := audit.Event{
+		Operation:  rollbackOperation,
+		InstanceID: instanceID,
+		ServiceID:  result.Target.ServiceId,
+		PlanID:     result.Target.PlanId,
+		Revision:   request.Revision,
+		Context:    b.instanceContext(ctx, instanceID),
+	}
+	if result.PreviousPlanId != result.Target.PlanId {
+		event.PreviousPlanID = result.PreviousPlanId
+	}
+	b.recordEvent(ctx, event, false, err)
+
+	switch {
+	case err == release.ErrReleaseNotFound:
+		b.writeJSONResponse(w, http.StatusNotFound, brokerapi.ErrorResponse{
+			Description: brokerapi.ErrInstanceDoesNotExist.Error(),
+		})
+	case err == release.ErrRevisionNotFound, err == release.ErrRollbackPlanChange:
+		b.writeJSONResponse(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+	case err != nil:
+		b.writeFailure(w, err)
+	default:
+		b.writeJSONResponse(w, http.StatusOK, rollbackResponse{
+			Revision:   result.Revision,
+			RolledBack: request.Revision,
+		})
+	}
+}
+
+func (b *Broker) rollback(ctx context.Context, instanceID string, revision int, allowPlanChange bool) (release.RollbackResult, error) {
+	// helm does not wait for the rolled back release, TIMEOUT bounds the lock and the helm calls
+	ctx, cancel := context.WithTimeout(ctx, release.Timeout())
+	defer cancel()
+
+	unlock, err := b.locks.acquire(ctx, instanceID)
+	if err != nil {
+		return release.RollbackResult{}, err
+	}
+	defer unlock()
+
+	return release.Rollback(ctx, b.catalog, instanceID, revision, allowPlanChange)
+}
@@ -0,0 +1,261 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/monostream/helmi/pkg/audit"
+	"github.com/monostream/helmi/pkg/catalog"
+	"github.com/monostream/helmi/pkg/release"
+)
+
+// interval in which asynchronous bindings check if the service instance became available
+const bindingRetryInterval = time.Second * 10
+
+type bindingResponse struct {
+	Credentials interface{} `json:"credentials"`
+}
+
+type asyncBindingResponse struct {
+	OperationData string `json:"operation,omitempty"`
+}
+
+func bindingOperationKey(instanceID string, bindingID string) string {
+	return instanceID + "/" + bindingID
+}
+
+// Answers GET /v2/service_instances/:instance_id/service_bindings/:binding_id with freshly rendered credentials
+func (b *Broker) getBindingHandler(w http.ResponseWriter, r *http.Request) {
+	if !b.requireAPIVersion(w, r, apiVersion214) {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	credentials, err := release.GetBinding(r.Context(), b.catalog, vars["instance_id"], vars["binding_id"])
+	if err != nil {
+		if err == release.ErrReleaseNotFound || err == release.ErrBindingNotFound {
+			b.writeJSONResponse(w, http.StatusNotFound, brokerapi.ErrorResponse{
+				Description: brokerapi.ErrBindingDoesNotExist.Error(),
+			})
+			return
+		}
+
+		b.writeJSONError(w, err)
+		return
+	}
+
+	b.writeJSONResponse(w, http.StatusOK, bindingResponse{
+		Credentials: credentials,
+	})
+}
+
+// Answers PUT /v2/service_instances/:instance_id/service_bindings/:binding_id?accepts_incomplete=true.
+// The binding is created in the background as soon as the service instance is available.
+func (b *Broker) bindAsyncHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	instanceID := vars["instance_id"]
+	bindingID := vars["binding_id"]
+
+	var details brokerapi.BindDetails
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		b.writeJSONResponse(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+
+	if details.ServiceID == "" || details.PlanID == "" {
+		b.writeJSONResponse(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+			Description: "service_id and plan_id are required",
+		})
+		return
+	}
+
+	event := audit.Event{
+		Operation:  bindOperation,
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		Context:    details.RawContext,
+	}
+
+	credentials, operationData, err := b.bindAsync(r.Context(), instanceID, bindingID, details, event)
+	b.recordEvent(r.Context(), event, credentials == nil, err)
+
+	if err == brokerapi.ErrInstanceDoesNotExist {
+		b.writeJSONResponse(w, http.StatusNotFound, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+
+	if err != nil {
+		b.writeFailure(w, err)
+		return
+	}
+
+	if credentials != nil {
+		// the binding has been created by an identical request before
+		b.writeJSONResponse(w, http.StatusOK, bindingResponse{
+			Credentials: credentials,
+		})
+		return
+	}
+
+	b.writeJSONResponse(w, http.StatusAccepted, asyncBindingResponse{
+		OperationData: operationData,
+	})
+}
+
+// Starts creating the binding in the background and returns the operation data, the outcome is recorded as event.
+// Returns the credentials instead if an identical request has created the binding before.
+func (b *Broker) bindAsync(ctx context.Context, instanceID string, bindingID string, details brokerapi.BindDetails, event audit.Event) (map[string]interface{}, string, error) {
+	binding, err := bindingFromDetails(bindingID, details)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// invalid parameters are refused right away instead of failing the operation later
+	binding.Parameters, err = release.BindParameters(b.catalog, details.ServiceID, details.PlanID, binding.Parameters)
+	if err != nil {
+		if isInvalidParameters(err) {
+			return nil, "", invalidParameters(err)
+		}
+		if err == release.ErrNotBindable {
+			return nil, "", notBindable(err)
+		}
+		return nil, "", err
+	}
+
+	credentials, err := release.ReplayBinding(ctx, b.catalog, instanceID, binding)
+	switch err {
+	case nil:
+		return credentials, "", nil
+	case release.ErrBindingConflict:
+		return nil, "", brokerapi.ErrBindingAlreadyExists
+	case release.ErrReleaseNotFound:
+		return nil, "", brokerapi.ErrInstanceDoesNotExist
+	case release.ErrBindingNotFound:
+	default:
+		return nil, "", err
+	}
+
+	timeout := b.operationTimeout(details.ServiceID, details.PlanID, bindOperation)
+	identity := audit.IdentityFromContext(ctx)
+	operationData := newOperationToken(bindOperation, 0).withTimeout(timeout).encode()
+
+	// a replayed request of a binding which is still being created is answered with the running operation
+	request := binding.AppGuid + "/" + catalog.ParametersHash(binding.Parameters)
+
+	err = b.operations.start(bindingOperationKey(instanceID, bindingID), request, func() error {
+		err := b.bindWhenAvailable(instanceID, details.ServiceID, details.PlanID, binding, timeout)
+		b.recordEvent(audit.WithIdentity(context.Background(), identity), event, false, err)
+		return err
+	})
+	if err != nil && err != errOperationRunning {
+		return nil, "", err
+	}
+
+	return nil, operationData, nil
+}
+
+// Runs in the background after the request has been answered, only the deadline of the binding cancels it
+func (b *Broker) bindWhenAvailable(instanceID string, serviceID string, planID string, binding catalog.Binding, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for {
+		err := b.bindLocked(ctx, instanceID, serviceID, planID, binding)
+		if err != release.ErrNotAvailable && err != errConcurrency {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.New("service instance did not become available in time")
+		case <-time.After(bindingRetryInterval):
+		}
+	}
+}
+
+// Creates the binding unless another operation holds the lock of the instance
+func (b *Broker) bindLocked(ctx context.Context, instanceID string, serviceID string, planID string, binding catalog.Binding) error {
+	unlock, err := b.locks.acquire(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = release.Bind(ctx, b.catalog, serviceID, planID, instanceID, binding)
+	return err
+}
+
+// Answers GET /v2/service_instances/:instance_id/service_bindings/:binding_id/last_operation
+func (b *Broker) lastBindingOperationHandler(w http.ResponseWriter, r *http.Request) {
+	if !b.requireAPIVersion(w, r, apiVersion214) {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	token, err := decodeOperationToken(r.FormValue("operation"))
+	if err != nil {
+		// without operation data the binding is judged by its existence only
+		token = newOperationToken(bindOperation, 0)
+	}
+
+	op, err := b.lastBindingOperation(r.Context(), vars["instance_id"], vars["binding_id"], token)
+	if err != nil {
+		b.writeFailure(w, err)
+		return
+	}
+
+	b.writeJSONResponse(w, http.StatusOK, brokerapi.LastOperationResponse{
+		State:       op.State,
+		Description: op.Description,
+	})
+}
+
+func (b *Broker) lastBindingOperation(ctx context.Context, instanceID string, bindingID string, token operationToken) (brokerapi.LastOperation, error) {
+	op := brokerapi.LastOperation{}
+	key := bindingOperationKey(instanceID, bindingID)
+
+	// failures are only known to the broker instance which created the binding
+	if tracked, ok := b.operations.get(key); ok && tracked.done && tracked.err != nil {
+		op.State = "failed"
+		op.Description = "Binding failed: " + tracked.err.Error()
+		return op, nil
+	}
+
+	err := release.CheckBinding(ctx, b.catalog, instanceID, bindingID)
+
+	switch err {
+	case nil:
+		op.State = "succeeded"
+		op.Description = "Binding created"
+		b.operations.remove(key)
+	case release.ErrReleaseNotFound:
+		op.State = "failed"
+		op.Description = "Service instance does not exist"
+	case release.ErrBindingNotFound:
+		if time.Now().After(token.deadline()) {
+			op.State = "failed"
+			op.Description = "Binding was not created in time"
+		} else {
+			op.State = "in progress"
+			op.Description = "Waiting for the service instance to become available"
+		}
+	default:
+		return op, err
+	}
+
+	return op, nil
+}
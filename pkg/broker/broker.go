@@ -4,19 +4,22 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/pivotal-cf/brokerapi"
 
+	"github.com/monostream/helmi/pkg/audit"
 	"github.com/monostream/helmi/pkg/catalog"
 	"github.com/monostream/helmi/pkg/config"
 	"github.com/monostream/helmi/pkg/helm"
-	"github.com/monostream/helmi/pkg/kubectl"
 	"github.com/monostream/helmi/pkg/release"
 )
 
@@ -27,30 +30,79 @@ type Broker struct {
 	addr          string
 	helmNamespace string
 	ingressDomain string
+	operations    *operations
+	locks         *instanceLocks
+	namespaces    *namespaceResolver
+	auditSink     audit.Sink
+	helmClient    helm.Client
 }
 
-func NewBroker(catalog *catalog.Catalog, config *config.Config, logger lager.Logger) *Broker {
+func NewBroker(catalog *catalog.Catalog, config *config.Config, logger lager.Logger, auditSink audit.Sink, helmClient helm.Client) *Broker {
+	if auditSink == nil {
+		auditSink = audit.LogSink{}
+	}
+
+	if helmClient == nil {
+		helmClient = helm.NewCLI("")
+	}
+
+	// releases are managed with the same client
+	release.SetHelmClient(helmClient)
+
+	maxInstances, _ := strconv.Atoi(config.MaxInstances)
+	release.SetMaxInstances(maxInstances)
+
 	router := mux.NewRouter()
 	b := &Broker{
-		catalog: catalog,
-		logger:  logger,
-		router:  router,
-		addr:    ":" + config.Port,
+		catalog:       catalog,
+		logger:        logger,
+		router:        router,
+		addr:          ":" + config.Port,
 		helmNamespace: config.HelmNamespace,
 		ingressDomain: config.IngressDomain,
+		operations:    newOperations(),
+		locks:         newInstanceLocks(LockNamespace(config)),
+		auditSink:     auditSink,
+		helmClient:    helmClient,
 	}
 
+	b.namespaces = newNamespaceResolver(config, b.locks, helmClient)
+
+	// routes of newer OSB versions, the catalog route replaces the one of brokerapi
+	b.router.HandleFunc("/v2/catalog", b.catalogHandler).Methods(http.MethodGet)
+	b.router.HandleFunc("/v2/service_instances/{instance_id}", b.getInstanceHandler).Methods(http.MethodGet)
+	b.router.HandleFunc("/v2/service_instances/{instance_id}", b.provisionHandler).Methods(http.MethodPut)
+	b.router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.getBindingHandler).Methods(http.MethodGet)
+	b.router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}/last_operation", b.lastBindingOperationHandler).Methods(http.MethodGet)
+	// asynchronous bindings are known since OSB 2.14, older platforms get the synchronous binding of brokerapi
+	b.router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.bindAsyncHandler).Methods(http.MethodPut).Queries("accepts_incomplete", "true").MatcherFunc(minimumAPIVersion(apiVersion214))
+
 	brokerapi.AttachRoutes(b.router, b, logger)
 	liveness := b.router.HandleFunc("/liveness", b.livenessHandler).Methods(http.MethodGet)
 	readiness := b.router.HandleFunc("/readiness", b.readinessHandler).Methods(http.MethodGet)
 
 	// list of routes which do not require authentication
-	noAuthRequired := skipAuth{
+	noAuthRequired := skipRoutes{
 		liveness:  true,
 		readiness: true,
 	}
 
+	// probes are not sent by a platform
+	noVersionRequired := skipRoutes{
+		liveness:  true,
+		readiness: true,
+	}
+
+	// admin routes are served only if they can be authenticated
+	if config.Username != "" && config.Password != "" {
+		for _, route := range b.attachAdminRoutes() {
+			noVersionRequired[route] = true
+		}
+	}
+
 	b.router.Use(authHandler(config, noAuthRequired))
+	b.router.Use(apiVersionHandler(noVersionRequired))
+	b.router.Use(originatingIdentityHandler)
 	b.router.Use(handlers.ProxyHeaders)
 	b.router.Use(handlers.CompressHandler)
 	b.router.Use(handlers.CORS(
@@ -62,6 +114,14 @@ func NewBroker(catalog *catalog.Catalog, config *config.Config, logger lager.Log
 	return b
 }
 
+// Leases are kept next to the broker, or in the namespace of the releases if it is not known
+func LockNamespace(config *config.Config) string {
+	if len(config.LockNamespace) > 0 {
+		return config.LockNamespace
+	}
+	return config.HelmNamespace
+}
+
 func (b *Broker) Run() {
 	log.Println("Helmi is ready and available on port " + strings.TrimPrefix(b.addr, ":"))
 	log.Fatal(http.ListenAndServe(b.addr, b.router))
@@ -73,7 +133,7 @@ func (b *Broker) livenessHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (b *Broker) readinessHandler(w http.ResponseWriter, r *http.Request) {
-	err := helm.IsReady()
+	err := b.helmClient.IsReady(r.Context())
 	if err != nil {
 		b.writeJSONError(w, err)
 		return
@@ -88,9 +148,6 @@ func (b *Broker) Services(ctx context.Context) ([]brokerapi.Service, error) {
 	for _, service := range catalogServices {
 		servicePlans := make([]brokerapi.ServicePlan, 0, len(service.Plans))
 
-		isFree := true
-		isBindable := true
-
 		for _, plan := range service.Plans {
 			metadata, err := planMetadataFromCatalog(plan.Metadata)
 
@@ -98,6 +155,9 @@ func (b *Broker) Services(ctx context.Context) ([]brokerapi.Service, error) {
 				return nil, err
 			}
 
+			isFree := plan.IsFree()
+			isBindable := service.IsPlanBindable(&plan)
+
 			p := brokerapi.ServicePlan{
 				ID:          plan.Id,
 				Name:        plan.Name,
@@ -122,8 +182,8 @@ func (b *Broker) Services(ctx context.Context) ([]brokerapi.Service, error) {
 			Description:   service.Description,
 			Tags:          service.Tags,
 			Metadata:      metadata,
-			Bindable:      true,
-			PlanUpdatable: false,
+			Bindable:      service.IsBindable(),
+			PlanUpdatable: service.PlanUpdatable(),
 			Plans:         servicePlans,
 		}
 		services = append(services, s)
@@ -172,62 +232,130 @@ func serviceMetadataFromCatalog(metadata map[string]interface{}) (*brokerapi.Ser
 	return &sm, nil
 }
 
-func namespaceFromContext(raw json.RawMessage) kubectl.Namespace {
-	var ctx struct {
-		Platform string `json:"platform"`
-		// set if platform=cloudfoundry
-		CFSpaceGUID string `json:"space_guid"`
-		CFOrgGUID   string `json:"organization_guid"`
-		// set if platform=kubernetes
-		K8SNamespace string `json:"namespace"`
-		K8SClusterId string `json:"clusterid"`
+func parametersFromDetails(raw json.RawMessage) (map[string]interface{}, error) {
+	parameters := make(map[string]interface{})
+	if raw != nil {
+		err := json.Unmarshal(raw, &parameters)
+		if err != nil {
+			return nil, brokerapi.ErrRawParamsInvalid
+		}
 	}
 
-	var namespace kubectl.Namespace
+	return parameters, nil
+}
 
-	err := json.Unmarshal(raw, &ctx)
-	if err == nil {
-		switch ctx.Platform {
-		case "cloudfoundry":
-			selector := map[string]string{
-				"cf-org":   ctx.CFOrgGUID,
-				"cf-space": ctx.CFSpaceGUID,
-			}
+func isInvalidParameters(err error) bool {
+	_, invalid := err.(*catalog.ValidationError)
+	return invalid
+}
 
-			ns, err := kubectl.GetNamespaces(selector)
-			if err == nil && len(ns) > 0 {
-				namespace = ns[0]
-			}
-		case "kubernetes":
-			namespace, _ = kubectl.GetNamespaceByName(ctx.K8SNamespace)
+// Answers requests with parameters which do not match the schema of the plan with 400 and the violations
+func invalidParameters(err error) error {
+	return brokerapi.NewFailureResponse(err, http.StatusBadRequest, "invalid-parameters")
+}
+
+func isQuotaExceeded(err error) bool {
+	_, exceeded := err.(*release.QuotaError)
+	return exceeded
+}
+
+// Answers provisions over a quota with 422 and the quota which has been reached
+func quotaExceeded(err error) error {
+	return brokerapi.NewFailureResponseBuilder(err, http.StatusUnprocessableEntity, "quota-exceeded").WithErrorKey("QuotaExceeded").Build()
+}
+
+// Answers bind requests for plans which are declared as not bindable with 400
+func notBindable(err error) error {
+	return brokerapi.NewFailureResponse(err, http.StatusBadRequest, "not-bindable")
+}
+
+func contextFromDetails(raw json.RawMessage) (map[string]interface{}, error) {
+	contextValues := make(map[string]interface{})
+	if raw != nil {
+		err := json.Unmarshal(raw, &contextValues)
+		if err != nil {
+			return nil, brokerapi.NewFailureResponse(errors.New("The format of the context is not valid JSON"), http.StatusUnprocessableEntity, "invalid-raw-context")
 		}
 	}
 
-	return namespace
+	return contextValues, nil
+}
+
+// Returns the deadline of an operation on instances of the plan, TIMEOUT applies unless the catalog declares one
+func (b *Broker) operationTimeout(serviceID string, planID string, operation string) time.Duration {
+	service := b.catalog.Service(serviceID)
+	if service == nil {
+		return release.Timeout()
+	}
+
+	plan, err := service.Plan(planID)
+	if err != nil {
+		return release.Timeout()
+	}
+
+	if timeout, ok := service.OperationTimeout(plan, operation); ok {
+		return timeout
+	}
+	return release.Timeout()
 }
 
 func (b *Broker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	spec, _, err := b.provision(ctx, instanceID, details, asyncAllowed)
+	return spec, err
+}
+
+// Provisions an instance, returns true if the instance had been provisioned by an identical request before
+func (b *Broker) provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, bool, error) {
+	event := audit.Event{
+		Operation:  provisionOperation,
+		InstanceID: instanceID,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		Context:    details.RawContext,
+	}
+
+	spec, existed, err := b.installRelease(ctx, instanceID, details, asyncAllowed, event)
+	b.recordEvent(ctx, event, spec.IsAsync, err)
+
+	return spec, existed, err
+}
+
+// Installs the release of an instance, asynchronous provisions record the event of their outcome
+func (b *Broker) installRelease(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool, event audit.Event) (brokerapi.ProvisionedServiceSpec, bool, error) {
 	spec := brokerapi.ProvisionedServiceSpec{}
 
-	parameters := make(map[string]interface{})
-	if details.RawParameters != nil {
-		err := json.Unmarshal(details.RawParameters, &parameters)
-		if err != nil {
-			return spec, brokerapi.ErrRawParamsInvalid
-		}
+	parameters, err := parametersFromDetails(details.RawParameters)
+	if err != nil {
+		return spec, false, err
 	}
 
-	contextValues := make(map[string]interface{})
-	if details.RawContext != nil {
-		err := json.Unmarshal(details.RawContext, &contextValues)
-		if err != nil {
-			return spec, brokerapi.NewFailureResponse(errors.New("The format of the context is not valid JSON"), http.StatusUnprocessableEntity, "invalid-raw-context")
-		}
+	contextValues, err := contextFromDetails(details.RawContext)
+	if err != nil {
+		return spec, false, err
 	}
 
-	log.Printf("%s", string(details.RawContext))
+	timeout := b.operationTimeout(details.ServiceID, details.PlanID, provisionOperation)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	unlock, err := b.locks.acquire(ctx, instanceID)
+	if err != nil {
+		return spec, false, err
+	}
 
-	namespace := namespaceFromContext(details.RawContext)
+	// an asynchronous provision holds the lock until it is done, which outlives the request
+	keepLock := false
+	defer func() {
+		if !keepLock {
+			unlock()
+		}
+	}()
+
+	namespace, err := b.namespaces.resolve(ctx, details.RawContext)
+	if err != nil {
+		return spec, false, err
+	}
 
 	// fill any missing values from configuration
 	if len(namespace.Name) == 0 {
@@ -238,40 +366,318 @@ func (b *Broker) Provision(ctx context.Context, instanceID string, details broke
 		namespace.IngressDomain = b.ingressDomain
 	}
 
-	dashboardUrl, err := release.Install(b.catalog, details.ServiceID, details.PlanID, instanceID, namespace, asyncAllowed, parameters, contextValues)
-
-	if err != nil {
-		exists, existsErr := release.Exists(instanceID)
+	creator := audit.IdentityFromContext(ctx).Metadata()
 
-		if existsErr == nil && exists {
-			return spec, brokerapi.ErrInstanceAlreadyExists
+	// provisions counted against the same quotas are serialized until their release has been created
+	unlockQuota := func() {}
+	if name := release.QuotaLock(b.catalog, details.ServiceID, details.PlanID); len(name) > 0 {
+		unlockQuota, err = b.locks.acquireWaiting(ctx, name)
+		if err != nil {
+			return spec, false, err
 		}
 	}
 
+	dashboardUrl, err := release.Install(ctx, b.catalog, details.ServiceID, details.PlanID, instanceID, namespace, asyncAllowed, parameters, contextValues, creator)
+	unlockQuota()
+
+	switch {
+	case err == release.ErrReleaseExists:
+		// the release was created by an earlier, identical request
+		spec, err = b.existingProvision(ctx, instanceID, dashboardUrl, asyncAllowed, timeout)
+		return spec, true, err
+	case err == release.ErrReleaseConflict:
+		return spec, false, brokerapi.ErrInstanceAlreadyExists
+	case isInvalidParameters(err):
+		return spec, false, invalidParameters(err)
+	case isQuotaExceeded(err):
+		return spec, false, quotaExceeded(err)
+	case err != nil:
+		return spec, false, err
+	}
+
 	spec.IsAsync = asyncAllowed
 	spec.DashboardURL = dashboardUrl
 
-	return spec, err
+	if !asyncAllowed {
+		b.operations.remove(provisionOperationKey(instanceID))
+		return spec, false, nil
+	}
+
+	// a new release starts with its first revision
+	token := newOperationToken(provisionOperation, 1).withTimeout(timeout)
+	spec.OperationData = token.encode()
+
+	identity := audit.IdentityFromContext(ctx)
+
+	err = b.operations.start(provisionOperationKey(instanceID), spec.OperationData, func() error {
+		defer unlock()
+		return b.awaitProvision(audit.WithIdentity(context.Background(), identity), instanceID, token, event)
+	})
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, false, err
+	}
+
+	keepLock = true
+	return spec, false, nil
+}
+
+// Waits in the background until the release of an asynchronous provision is ready or failed, the release of a failed
+// provision is purged. The lock of the instance is held by the caller, the outcome is recorded as event.
+// Returns the failure, nil if the provision succeeded or its state could not be judged.
+func (b *Broker) awaitProvision(ctx context.Context, instanceID string, token operationToken, event audit.Event) error {
+	op, createdRelease, err := awaitOperation(ctx, token, func(ctx context.Context) (brokerapi.LastOperation, bool, error) {
+		return b.provisionOperationState(ctx, instanceID, token)
+	})
+
+	if err != nil {
+		// provisions which could not be judged are left to last operation requests
+		log.Printf("failed to await provision of %s: %s", instanceID, err)
+		return nil
+	}
+
+	if op.State != "failed" {
+		b.recordEvent(ctx, event, false, nil)
+		return nil
+	}
+
+	if createdRelease {
+		ctx, cancel := context.WithTimeout(ctx, release.Timeout())
+		defer cancel()
+
+		op = b.purgeOrphanLocked(ctx, instanceID, op)
+	}
+
+	err = errors.New(op.Description)
+	b.recordEvent(ctx, event, false, err)
+	return err
+}
+
+// Answers a replayed provision request from the state of the existing release
+func (b *Broker) existingProvision(ctx context.Context, instanceID string, dashboardUrl string, asyncAllowed bool, timeout time.Duration) (brokerapi.ProvisionedServiceSpec, error) {
+	spec := brokerapi.ProvisionedServiceSpec{
+		DashboardURL: dashboardUrl,
+	}
+
+	health, err := release.GetHealth(ctx, b.catalog, instanceID)
+	if err != nil {
+		return spec, err
+	}
+
+	switch {
+	case health.IsReady:
+		return spec, nil
+	case health.IsFailed:
+		// a failed release kept for debugging has to be deprovisioned first
+		return spec, brokerapi.ErrInstanceAlreadyExists
+	case !asyncAllowed:
+		// the installation can not be awaited synchronously
+		return spec, errConcurrency
+	}
+
+	revision, err := release.GetLastRevision(ctx, instanceID)
+	if err != nil {
+		return spec, err
+	}
+
+	// the operation is judged from the start of the original provision
+	token := newOperationToken(provisionOperation, revision.Revision).withTimeout(timeout)
+	if updated, err := revision.UpdatedTime(); err == nil {
+		token.Started = updated.Unix()
+	}
+
+	spec.IsAsync = true
+	spec.OperationData = token.encode()
+
+	return spec, nil
+}
+
+// Key of the failed provisions whose release has been purged by this broker instance
+func provisionOperationKey(instanceID string) string {
+	return instanceID + "/provision"
 }
 
 func (b *Broker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
+	event := audit.Event{
+		Operation:  deprovisionOperation,
+		InstanceID: instanceID,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		Context:    b.instanceContext(ctx, instanceID),
+	}
+
+	spec, err := b.deleteRelease(ctx, instanceID, details, asyncAllowed, event)
+	b.recordEvent(ctx, event, spec.IsAsync, err)
+
+	return spec, err
+}
+
+// Deletes the release of an instance, asynchronous deletions record the event of their outcome
+func (b *Broker) deleteRelease(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool, event audit.Event) (brokerapi.DeprovisionServiceSpec, error) {
 	spec := brokerapi.DeprovisionServiceSpec{}
-	err := release.Delete(instanceID)
+
+	timeout := b.operationTimeout(details.ServiceID, details.PlanID, deprovisionOperation)
+
+	unlock, err := b.locks.acquire(ctx, instanceID)
+	if err != nil {
+		return spec, err
+	}
+
+	// the namespace is cleaned up once the release is gone, it is kept if the status of the release is unknown
+	namespace, _ := release.GetNamespace(ctx, instanceID)
+
+	if asyncAllowed {
+		exists, err := release.Exists(ctx, instanceID)
+		if err != nil {
+			unlock()
+			return spec, err
+		}
+
+		if !exists {
+			unlock()
+			return spec, brokerapi.ErrInstanceDoesNotExist
+		}
+
+		// the lock is held until the deletion is done, which outlives the request
+		identity := audit.IdentityFromContext(ctx)
+
+		operationData := newOperationToken(deprovisionOperation, 0).withTimeout(timeout).encode()
+
+		err = b.operations.start(instanceID, operationData, func() error {
+			defer unlock()
+
+			ctx, cancel := context.WithTimeout(audit.WithIdentity(context.Background(), identity), timeout)
+			defer cancel()
+
+			err := release.Delete(ctx, instanceID)
+			if err == release.ErrReleaseNotFound {
+				err = nil
+			}
+
+			if err == nil {
+				b.cleanupNamespace(namespace)
+			}
+
+			b.recordEvent(ctx, event, false, err)
+			return err
+		})
+		if err != nil {
+			unlock()
+			return spec, err
+		}
+
+		spec.IsAsync = true
+		spec.OperationData = operationData
+
+		return spec, nil
+	}
+
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err = release.Delete(ctx, instanceID)
 	if err == release.ErrReleaseNotFound {
 		return spec, brokerapi.ErrInstanceDoesNotExist
 	}
+
+	if err == nil {
+		b.cleanupNamespace(namespace)
+	}
 	return spec, err
 }
 
+// Deletes a namespace created by Helmi in the background once its last release is gone
+func (b *Broker) cleanupNamespace(name string) {
+	if len(name) == 0 {
+		return
+	}
+
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), release.Timeout())
+			retry, err := b.namespaces.cleanup(ctx, name)
+			cancel()
+
+			if err != nil {
+				log.Printf("failed to clean up namespace %s: %s", name, err)
+				return
+			}
+
+			if retry == 0 {
+				return
+			}
+
+			time.Sleep(retry)
+		}
+	}()
+}
+
+func bindingFromDetails(bindingID string, details brokerapi.BindDetails) (catalog.Binding, error) {
+	parameters, err := parametersFromDetails(details.RawParameters)
+	if err != nil {
+		return catalog.Binding{}, err
+	}
+
+	appGuid := details.AppGUID
+	if len(appGuid) == 0 && details.BindResource != nil {
+		appGuid = details.BindResource.AppGuid
+	}
+
+	return catalog.Binding{
+		Id:         bindingID,
+		AppGuid:    appGuid,
+		Parameters: parameters,
+	}, nil
+}
+
 func (b *Broker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	binding, err := b.createBinding(ctx, instanceID, bindingID, details)
+
+	b.recordEvent(ctx, audit.Event{
+		Operation:  bindOperation,
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		Context:    details.RawContext,
+	}, false, err)
+
+	return binding, err
+}
+
+func (b *Broker) createBinding(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
 	binding := brokerapi.Binding{}
-	credentials, err := release.GetCredentials(b.catalog, details.ServiceID, details.PlanID, instanceID)
+
+	bindingDetails, err := bindingFromDetails(bindingID, details)
+	if err != nil {
+		return binding, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.operationTimeout(details.ServiceID, details.PlanID, bindOperation))
+	defer cancel()
+
+	unlock, err := b.locks.acquire(ctx, instanceID)
+	if err != nil {
+		return binding, err
+	}
+	defer unlock()
+
+	credentials, err := release.Bind(ctx, b.catalog, details.ServiceID, details.PlanID, instanceID, bindingDetails)
 
 	if err != nil {
 		if err == release.ErrReleaseNotFound {
 			return binding, brokerapi.ErrInstanceDoesNotExist
 		}
 
+		if isInvalidParameters(err) {
+			return binding, invalidParameters(err)
+		}
+
+		if err == release.ErrNotBindable {
+			return binding, notBindable(err)
+		}
+
 		return binding, err
 	}
 
@@ -280,47 +686,631 @@ func (b *Broker) Bind(ctx context.Context, instanceID, bindingID string, details
 }
 
 func (b *Broker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
-	exists, err := release.Exists(instanceID)
+	err := b.deleteBinding(ctx, instanceID, bindingID, details)
+
+	b.recordEvent(ctx, audit.Event{
+		Operation:  unbindOperation,
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		Context:    b.instanceContext(ctx, instanceID),
+	}, false, err)
+
+	return err
+}
+
+func (b *Broker) deleteBinding(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
+	ctx, cancel := context.WithTimeout(ctx, b.operationTimeout(details.ServiceID, details.PlanID, unbindOperation))
+	defer cancel()
 
+	unlock, err := b.locks.acquire(ctx, instanceID)
 	if err != nil {
 		return err
-	} else if !exists {
+	}
+	defer unlock()
+
+	err = release.Unbind(ctx, b.catalog, instanceID, bindingID)
+
+	switch err {
+	case release.ErrReleaseNotFound, release.ErrBindingNotFound:
 		return brokerapi.ErrBindingDoesNotExist
-	} else {
-		return nil
+	default:
+		return err
 	}
 }
 
 func (b *Broker) LastOperation(ctx context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
+	token, err := decodeOperationToken(operationData)
+	if err != nil {
+		// platforms are not required to send the operation data, judge the release health only
+		token = operationToken{}
+	}
+
+	switch token.Type {
+	case deprovisionOperation:
+		return b.lastDeprovisionOperation(ctx, instanceID, token)
+	case updateOperation:
+		return b.lastUpdateOperation(ctx, instanceID, token)
+	default:
+		return b.lastProvisionOperation(ctx, instanceID, token)
+	}
+}
+
+func (b *Broker) lastProvisionOperation(ctx context.Context, instanceID string, token operationToken) (brokerapi.LastOperation, error) {
 	op := brokerapi.LastOperation{}
-	health, err := release.GetHealth(b.catalog, instanceID)
+
+	// the release of a failed provision is gone after it has been purged
+	tracked, isTracked := b.operations.get(provisionOperationKey(instanceID))
+	if isTracked && tracked.done && tracked.err != nil {
+		op.State = "failed"
+		op.Description = tracked.err.Error()
+		return op, nil
+	}
+
+	op, createdRelease, err := b.provisionOperationState(ctx, instanceID, token)
+	if err != nil {
+		return op, err
+	}
+
+	if op.State == "failed" && createdRelease {
+		if isTracked && !tracked.done {
+			// the provision purges its release in the background and records the failure
+			op.State = "in progress"
+			return op, nil
+		}
+
+		// the provision has been started by another broker instance, or before a restart
+		return b.mitigateOrphan(instanceID, op), nil
+	}
+
+	return op, nil
+}
+
+// Judges a provision from its release without acting on it, returns true if the release has been created by it
+func (b *Broker) provisionOperationState(ctx context.Context, instanceID string, token operationToken) (brokerapi.LastOperation, bool, error) {
+	op := brokerapi.LastOperation{}
+
+	// without operation data the provision can only be judged by the health of the release
+	createdRelease := false
+	if token.Type == provisionOperation {
+		revision, err := release.GetLastRevision(ctx, instanceID)
+		if err != nil && err != release.ErrReleaseNotFound {
+			return op, false, err
+		}
+
+		createdRelease = createdByProvision(revision, token)
+
+		if state, decided := provisionState(revision, token, time.Now()); decided {
+			return state, createdRelease, nil
+		}
+	}
+
+	health, err := release.GetHealth(ctx, b.catalog, instanceID)
 
 	if err != nil {
 		if err == release.ErrReleaseNotFound {
-			return op, brokerapi.ErrInstanceDoesNotExist
+			return op, false, brokerapi.ErrInstanceDoesNotExist
 		}
 
-		return op, err
+		return op, false, err
 	}
 
-	if health.IsFailed || health.IsTimedOut() {
+	isTimedOut := health.IsTimedOut()
+	if token.Type == provisionOperation {
+		isTimedOut = !health.IsReady && time.Now().After(token.deadline())
+	}
+
+	if health.IsFailed {
+		op.State = "failed"
+		op.Description = "Deployment of the service instance failed"
+	} else if isTimedOut {
 		op.State = "failed"
+		op.Description = withPendingResources("Service instance did not become ready in time", health)
 	} else if health.IsReady {
 		op.State = "succeeded"
+		op.Description = "Service instance is ready"
 	} else {
 		op.State = "in progress"
+		op.Description = withPendingResources("Waiting for the service instance to become ready", health)
+	}
+
+	return op, createdRelease, nil
+}
+
+// Purges the release of a failed provision, the platform considers the instance not to exist.
+// The purge is not bound to the last operation request, a purge cancelled halfway leaves a deleted release behind.
+func (b *Broker) mitigateOrphan(instanceID string, op brokerapi.LastOperation) brokerapi.LastOperation {
+	ctx, cancel := context.WithTimeout(context.Background(), release.Timeout())
+	defer cancel()
+
+	unlock, err := b.locks.acquire(ctx, instanceID)
+	if err != nil {
+		// the release is purged by a later request
+		return op
+	}
+	defer unlock()
+
+	return b.purgeOrphanLocked(ctx, instanceID, op)
+}
+
+// Purges the release of a failed provision while the lock of its instance is held, see mitigateOrphan
+func (b *Broker) purgeOrphanLocked(ctx context.Context, instanceID string, op brokerapi.LastOperation) brokerapi.LastOperation {
+	purged, err := release.PurgeFailed(ctx, b.catalog, instanceID)
+	if err != nil {
+		op.Description += ", purging the release failed: " + err.Error()
+		return op
+	}
+
+	if purged {
+		op.Description += ", the release has been purged"
+
+		// later requests can not judge the provision without the release
+		b.operations.fail(provisionOperationKey(instanceID), errors.New(op.Description))
+	}
+
+	return op
+}
+
+// Returns true if the revision is the one created by the provision of the token
+func createdByProvision(revision helm.Revision, token operationToken) bool {
+	if revision.Revision == 0 || revision.Revision != token.Revision {
+		return false
+	}
+
+	updated, err := revision.UpdatedTime()
+	return err != nil || !updated.Before(token.startTime().Add(-time.Minute))
+}
+
+// Judges a provision from the last revision of the release, the health of the release
+// decides if the revision is the one created by the provision and it did not fail
+func provisionState(revision helm.Revision, token operationToken, now time.Time) (brokerapi.LastOperation, bool) {
+	op := brokerapi.LastOperation{}
+
+	if revision.Revision == 0 {
+		// the release has not been created (yet)
+		if now.After(token.deadline()) {
+			op.State = "failed"
+			op.Description = fmt.Sprintf("Release revision %d was not created in time", token.Revision)
+		} else {
+			op.State = "in progress"
+			op.Description = fmt.Sprintf("Waiting for release revision %d", token.Revision)
+		}
+		return op, true
+	}
+
+	if revision.Revision != token.Revision {
+		op.State = "failed"
+		op.Description = fmt.Sprintf("Release of the service instance was replaced by revision %d", revision.Revision)
+		return op, true
+	}
+
+	if updated, err := revision.UpdatedTime(); err == nil && updated.Before(token.startTime().Add(-time.Minute)) {
+		// a release with the same name existed before the provision started
+		op.State = "failed"
+		op.Description = "Release of the service instance was not created by this operation"
+		return op, true
+	}
+
+	if strings.EqualFold(revision.Status, "FAILED") {
+		op.State = "failed"
+		op.Description = fmt.Sprintf("Installation of release revision %d failed: %s", revision.Revision, revision.Description)
+		return op, true
+	}
+
+	return op, false
+}
+
+func (b *Broker) lastUpdateOperation(ctx context.Context, instanceID string, token operationToken) (brokerapi.LastOperation, error) {
+	op := brokerapi.LastOperation{}
+
+	// the release of an update which has been rolled back by this broker instance is at the revision of the rollback
+	tracked, isTracked := b.operations.get(updateOperationKey(instanceID, token.Revision))
+	if isTracked && tracked.done && tracked.err != nil {
+		op.State = "failed"
+		op.Description = tracked.err.Error()
+		return op, nil
+	}
+
+	op, failedRevision, err := b.updateOperationState(ctx, instanceID, token)
+	if err != nil {
+		return op, err
+	}
+
+	if failedRevision {
+		if isTracked && !tracked.done {
+			// the update rolls its release back in the background and records the failure
+			op.State = "in progress"
+			return op, nil
+		}
+
+		// the update has been started by another broker instance, or before a restart
+		return b.rollbackFailedUpdate(instanceID, token, op), nil
 	}
 
 	return op, nil
 }
 
+// Judges an update from its release without acting on it, returns true if the update failed and the release
+// is still at the revision it created
+func (b *Broker) updateOperationState(ctx context.Context, instanceID string, token operationToken) (brokerapi.LastOperation, bool, error) {
+	op := brokerapi.LastOperation{}
+
+	revision, err := release.GetLastRevision(ctx, instanceID)
+
+	if err != nil {
+		if err == release.ErrReleaseNotFound {
+			return op, false, brokerapi.ErrInstanceDoesNotExist
+		}
+
+		return op, false, err
+	}
+
+	if revision.Revision < token.Revision {
+		if time.Now().After(token.deadline()) {
+			op.State = "failed"
+			op.Description = fmt.Sprintf("Release did not reach revision %d in time", token.Revision)
+		} else {
+			op.State = "in progress"
+			op.Description = fmt.Sprintf("Waiting for release revision %d", token.Revision)
+		}
+		return op, false, nil
+	}
+
+	if state, decided := rolledBackState(revision, token); decided {
+		return state, false, nil
+	}
+
+	if strings.EqualFold(revision.Status, "FAILED") {
+		op.State = "failed"
+		op.Description = fmt.Sprintf("Upgrade to release revision %d failed: %s", revision.Revision, revision.Description)
+		return op, true, nil
+	}
+
+	health, err := release.GetHealth(ctx, b.catalog, instanceID)
+	if err != nil {
+		if err == release.ErrReleaseNotFound {
+			return op, false, brokerapi.ErrInstanceDoesNotExist
+		}
+
+		return op, false, err
+	}
+
+	// the update has to pass the health checks within its deadline
+	isTimedOut := !health.IsReady && time.Now().After(token.deadline())
+
+	if health.IsFailed {
+		op.State = "failed"
+		op.Description = fmt.Sprintf("Release revision %d failed", revision.Revision)
+	} else if isTimedOut {
+		op.State = "failed"
+		op.Description = withPendingResources(fmt.Sprintf("Release revision %d did not become ready in time", revision.Revision), health)
+	} else if health.IsReady {
+		op.State = "succeeded"
+		op.Description = fmt.Sprintf("Service instance updated to release revision %d", revision.Revision)
+	} else {
+		op.State = "in progress"
+		op.Description = withPendingResources(fmt.Sprintf("Waiting for release revision %d to become ready", revision.Revision), health)
+	}
+
+	return op, op.State == "failed" && revision.Revision == token.Revision, nil
+}
+
+// Key of the failed updates whose release has been rolled back by this broker instance
+func updateOperationKey(instanceID string, revision int) string {
+	return fmt.Sprintf("%s/update/%d", instanceID, revision)
+}
+
+// Judges an update whose release has moved on to a later revision, which is a rollback of the update
+// if it is the next revision and rolls back to the revision before the update
+func rolledBackState(revision helm.Revision, token operationToken) (brokerapi.LastOperation, bool) {
+	op := brokerapi.LastOperation{}
+
+	if revision.Revision != token.Revision+1 || release.RolledBackTo(revision) != token.Revision-1 {
+		return op, false
+	}
+
+	op.State = "failed"
+	op.Description = fmt.Sprintf("Update to release revision %d failed, the release has been rolled back to revision %d", token.Revision, token.Revision-1)
+	return op, true
+}
+
+// Rolls the release of a failed update back to the revision before if its plan declares auto-rollback,
+// the platform keeps the instance on the plan it had before the update.
+// The rollback is not bound to the last operation request, like the purge of failed provisions.
+func (b *Broker) rollbackFailedUpdate(instanceID string, token operationToken, op brokerapi.LastOperation) brokerapi.LastOperation {
+	ctx, cancel := context.WithTimeout(context.Background(), release.Timeout())
+	defer cancel()
+
+	unlock, err := b.locks.acquire(ctx, instanceID)
+	if err != nil {
+		// the release is rolled back by a later request
+		return op
+	}
+	defer unlock()
+
+	return b.rollbackUpdateLocked(ctx, instanceID, token, op)
+}
+
+// Rolls a failed update back while the lock of its instance is held, see rollbackFailedUpdate
+func (b *Broker) rollbackUpdateLocked(ctx context.Context, instanceID string, token operationToken, op brokerapi.LastOperation) brokerapi.LastOperation {
+	rolledBackTo, err := release.RollbackUpdate(ctx, b.catalog, instanceID, token.Revision)
+	if err == nil && rolledBackTo == 0 {
+		// the plan keeps failed updates
+		return op
+	}
+
+	b.recordEvent(ctx, audit.Event{
+		Operation:  rollbackOperation,
+		InstanceID: instanceID,
+		Revision:   token.Revision - 1,
+		Context:    b.instanceContext(ctx, instanceID),
+	}, false, err)
+
+	if err != nil {
+		op.Description += ", rolling back the release failed: " + err.Error()
+		return op
+	}
+
+	op.Description += fmt.Sprintf(", the release has been rolled back to revision %d", rolledBackTo)
+
+	// later requests see the revision of the rollback only
+	b.operations.fail(updateOperationKey(instanceID, token.Revision), errors.New(op.Description))
+
+	return op
+}
+
+// Appends the objects of the release which are not ready yet to the description of an operation
+func withPendingResources(description string, health release.Health) string {
+	if len(health.PendingResources) == 0 {
+		return description
+	}
+
+	return description + ", not ready: " + strings.Join(health.PendingResources, ", ")
+}
+
+// Failures are known for sure only to the broker instance which ran the deletion. Every other
+// instance (e.g. with `replicaCount: 2`, or after a restart) judges the deletion from the status
+// of the release, which is reported as in progress until TIMEOUT expires if helm failed before
+// it could record the deletion.
+func (b *Broker) lastDeprovisionOperation(ctx context.Context, instanceID string, token operationToken) (brokerapi.LastOperation, error) {
+	op := brokerapi.LastOperation{}
+
+	if tracked, ok := b.operations.get(instanceID); ok && tracked.done && tracked.err != nil {
+		op.State = "failed"
+		op.Description = "Deletion of the service instance failed: " + tracked.err.Error()
+		return op, nil
+	}
+
+	exists, err := release.Exists(ctx, instanceID)
+	if err != nil {
+		return op, err
+	}
+
+	if !exists {
+		op.State = "succeeded"
+		op.Description = "Service instance deleted"
+		b.operations.remove(instanceID)
+		return op, nil
+	}
+
+	revision, err := release.GetLastRevision(ctx, instanceID)
+	if err != nil {
+		if err == release.ErrReleaseNotFound {
+			op.State = "succeeded"
+			op.Description = "Service instance deleted"
+			b.operations.remove(instanceID)
+			return op, nil
+		}
+
+		return op, err
+	}
+
+	return deprovisionState(revision, token, time.Now()), nil
+}
+
+// Judges a running deletion from the last revision of the release
+func deprovisionState(revision helm.Revision, token operationToken, now time.Time) brokerapi.LastOperation {
+	op := brokerapi.LastOperation{}
+
+	switch strings.ToUpper(revision.Status) {
+	case "DELETED":
+		// helm deleted the resources, but failed to purge the release
+		op.State = "failed"
+		op.Description = "Release of the service instance was deleted but not purged"
+		return op
+	case "FAILED":
+		// releases which failed before the deletion started are still being deleted
+		if updated, err := revision.UpdatedTime(); err == nil && !updated.Before(token.startTime()) {
+			op.State = "failed"
+			op.Description = "Deletion of the service instance failed: " + revision.Description
+			return op
+		}
+	}
+
+	if now.After(token.deadline()) {
+		op.State = "failed"
+		op.Description = "Service instance was not deleted in time"
+	} else {
+		op.State = "in progress"
+		op.Description = "Deleting service instance"
+	}
+
+	return op
+}
+
 func (b *Broker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
-	return brokerapi.UpdateServiceSpec{}, brokerapi.ErrPlanChangeNotSupported
+	event := audit.Event{
+		Operation:  updateOperation,
+		InstanceID: instanceID,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		Context:    details.RawContext,
+	}
+
+	spec, err := b.updateRelease(ctx, instanceID, details, asyncAllowed, event)
+	b.recordEvent(ctx, event, spec.IsAsync, err)
+
+	return spec, err
 }
 
-type skipAuth map[*mux.Route]bool
+// Upgrades the release of an instance, asynchronous updates record the event of their outcome
+func (b *Broker) updateRelease(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool, event audit.Event) (brokerapi.UpdateServiceSpec, error) {
+	spec := brokerapi.UpdateServiceSpec{}
+
+	planID := details.PlanID
+	if len(planID) == 0 {
+		planID = details.PreviousValues.PlanID
+	}
+
+	// a plan change without parameters keeps the parameters of the instance as they are
+	var parameters map[string]interface{}
+	if len(details.RawParameters) > 0 {
+		var err error
+		parameters, err = parametersFromDetails(details.RawParameters)
+		if err != nil {
+			return spec, err
+		}
+	}
+
+	contextValues, err := contextFromDetails(details.RawContext)
+	if err != nil {
+		return spec, err
+	}
+
+	timeout := b.operationTimeout(details.ServiceID, planID, updateOperation)
+
+	// the revision of the update is known once helm created it
+	token := newOperationToken(updateOperation, 0).withTimeout(timeout)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	unlock, err := b.locks.acquire(ctx, instanceID)
+	if err != nil {
+		return spec, err
+	}
+
+	// an asynchronous update holds the lock until it is done, which outlives the request
+	keepLock := false
+	defer func() {
+		if !keepLock {
+			unlock()
+		}
+	}()
+
+	revision, err := release.Update(ctx, b.catalog, details.ServiceID, planID, instanceID, asyncAllowed, parameters, contextValues)
+	if err != nil {
+		if isInvalidParameters(err) {
+			return spec, invalidParameters(err)
+		}
+
+		switch err {
+		case release.ErrReleaseNotFound:
+			return spec, brokerapi.ErrInstanceDoesNotExist
+		case release.ErrPlanChangeNotAllowed:
+			return spec, brokerapi.ErrPlanChangeNotSupported
+		}
 
-func authHandler(config *config.Config, noAuthRequired skipAuth) mux.MiddlewareFunc {
+		return spec, err
+	}
+
+	token.Revision = revision
+	spec.IsAsync = asyncAllowed
+
+	if !asyncAllowed {
+		return spec, b.verifyUpdate(ctx, instanceID, details.ServiceID, planID, token)
+	}
+
+	spec.OperationData = token.encode()
+
+	identity := audit.IdentityFromContext(ctx)
+
+	err = b.operations.start(updateOperationKey(instanceID, revision), spec.OperationData, func() error {
+		defer unlock()
+		return b.awaitUpdate(audit.WithIdentity(context.Background(), identity), instanceID, token, event)
+	})
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	keepLock = true
+	return spec, nil
+}
+
+// Waits in the background until the revision of an asynchronous update is ready or failed, a failed update is
+// rolled back if its plan declares auto-rollback. The lock of the instance is held by the caller, the outcome is
+// recorded as event.
+// Returns the failure, nil if the update succeeded or its state could not be judged.
+func (b *Broker) awaitUpdate(ctx context.Context, instanceID string, token operationToken, event audit.Event) error {
+	op, failedRevision, err := awaitOperation(ctx, token, func(ctx context.Context) (brokerapi.LastOperation, bool, error) {
+		return b.updateOperationState(ctx, instanceID, token)
+	})
+
+	if err != nil {
+		// updates which could not be judged are left to last operation requests
+		log.Printf("failed to await update of %s: %s", instanceID, err)
+		return nil
+	}
+
+	if op.State != "failed" {
+		b.recordEvent(ctx, event, false, nil)
+		return nil
+	}
+
+	if failedRevision {
+		ctx, cancel := context.WithTimeout(ctx, release.Timeout())
+		defer cancel()
+
+		op = b.rollbackUpdateLocked(ctx, instanceID, token, op)
+	}
+
+	err = errors.New(op.Description)
+	b.recordEvent(ctx, event, false, err)
+	return err
+}
+
+// Helm waited for the resources of a synchronous update, the health checks of plans with auto-rollback have to pass
+// as well before the update is done. Failed updates of these plans are rolled back, the lock of the instance is held.
+func (b *Broker) verifyUpdate(ctx context.Context, instanceID string, serviceID string, planID string, token operationToken) error {
+	service := b.catalog.Service(serviceID)
+	if service == nil {
+		return nil
+	}
+
+	plan, err := service.Plan(planID)
+	if err != nil || !service.HasAutoRollback(plan) {
+		return nil
+	}
+
+	// the deadline of the request is the one of the update, which has to be judged and rolled back after it
+	identity := audit.IdentityFromContext(ctx)
+
+	op, failedRevision, err := awaitOperation(context.Background(), token, func(ctx context.Context) (brokerapi.LastOperation, bool, error) {
+		return b.updateOperationState(ctx, instanceID, token)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if op.State != "failed" {
+		return nil
+	}
+
+	if failedRevision {
+		ctx, cancel := context.WithTimeout(audit.WithIdentity(context.Background(), identity), release.Timeout())
+		defer cancel()
+
+		op = b.rollbackUpdateLocked(ctx, instanceID, token, op)
+	}
+
+	return errors.New(op.Description)
+}
+
+type skipRoutes map[*mux.Route]bool
+
+func authHandler(config *config.Config, noAuthRequired skipRoutes) mux.MiddlewareFunc {
 	validCredentials := func(r *http.Request) bool {
 		// disable authentication if configuration variables not set
 		if config.Username == "" || config.Password == "" {
@@ -350,6 +1340,58 @@ func authHandler(config *config.Config, noAuthRequired skipAuth) mux.MiddlewareF
 	}
 }
 
+// Makes the originating identity of a request available to the operations through its context
+func originatingIdentityHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get(audit.OriginatingIdentityHeader)
+		if len(header) > 0 {
+			identity, err := audit.ParseIdentity(header)
+			if err != nil {
+				// the operation is recorded without identity
+				log.Printf("ignoring originating identity: %s", err)
+			} else {
+				r = r.WithContext(audit.WithIdentity(r.Context(), identity))
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Records an operation with the originating identity of its request in the audit sink
+// Returns the context an instance was provisioned or last updated with for events of requests without one
+func (b *Broker) instanceContext(ctx context.Context, instanceID string) json.RawMessage {
+	contextValues, err := release.GetContext(ctx, instanceID)
+	if err != nil || contextValues == nil {
+		return nil
+	}
+
+	raw, err := json.Marshal(contextValues)
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+func (b *Broker) recordEvent(ctx context.Context, event audit.Event, async bool, err error) {
+	event.Time = time.Now()
+	event.Identity = audit.IdentityFromContext(ctx)
+
+	switch {
+	case err != nil:
+		event.Outcome = audit.Failed
+		event.Error = err.Error()
+	case async:
+		event.Outcome = audit.Accepted
+	default:
+		event.Outcome = audit.Succeeded
+	}
+
+	writeErr := b.auditSink.Write(event)
+	if writeErr != nil {
+		log.Printf("failed to write audit event of %s on %s: %s", event.Operation, event.InstanceID, writeErr)
+	}
+}
+
 func (b *Broker) writeJSONResponse(w http.ResponseWriter, status int, response interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -360,6 +1402,16 @@ func (b *Broker) writeJSONResponse(w http.ResponseWriter, status int, response i
 	}
 }
 
+// Writes errors the same way brokerapi does, failure responses keep their status code
+func (b *Broker) writeFailure(w http.ResponseWriter, err error) {
+	if failure, ok := err.(*brokerapi.FailureResponse); ok {
+		b.writeJSONResponse(w, failure.ValidatedStatusCode(b.logger), failure.ErrorResponse())
+		return
+	}
+
+	b.writeJSONError(w, err)
+}
+
 func (b *Broker) writeJSONError(w http.ResponseWriter, err error) {
 	b.writeJSONResponse(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
 		Description: err.Error(),
@@ -1,8 +1,17 @@
 package broker
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/monostream/helmi/pkg/audit"
 	"github.com/monostream/helmi/pkg/catalog"
 	"github.com/monostream/helmi/pkg/config"
+	"github.com/monostream/helmi/pkg/helm"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -39,9 +48,9 @@ service:
             $schema: http://json-schema.org/draft-04/schema#
             type: object
             properties:
-            billing-account:
-              description: Billing account number used to charge use of shared fake server.
-              type: string
+              billing-account:
+                description: Billing account number used to charge use of shared fake server.
+                type: string
       service-binding:
         create:
           parameters:
@@ -138,7 +147,7 @@ func Test_Services_Metadata(t *testing.T) {
 		t.Error(red(err.Error()))
 	}
 
-	broker := NewBroker(catalog, &config.Config{}, nil)
+	broker := NewBroker(catalog, &config.Config{}, nil, nil, helm.NewFake())
 
 	services, err := broker.Services(nil)
 
@@ -170,7 +179,7 @@ func Test_Services_NoMetadata(t *testing.T) {
 		t.Error(red(err.Error()))
 	}
 
-	broker := NewBroker(catalog, &config.Config{}, nil)
+	broker := NewBroker(catalog, &config.Config{}, nil, nil, helm.NewFake())
 
 	services, err := broker.Services(nil)
 
@@ -186,3 +195,342 @@ func Test_Services_NoMetadata(t *testing.T) {
 		t.Error(red("metadata should not contain 'someplankey'"))
 	}
 }
+
+func Test_Catalog_Retrievable(t *testing.T) {
+	catalog, err := catalog.NewFromSerialized(def)
+
+	if err != nil {
+		t.Error(red(err.Error()))
+	}
+
+	broker := NewBroker(catalog, &config.Config{}, nil, nil, helm.NewFake())
+
+	request := httptest.NewRequest(http.MethodGet, "/v2/catalog", nil)
+	request.Header.Set("X-Broker-API-Version", "2.14")
+	recorder := httptest.NewRecorder()
+
+	broker.router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Error(red(fmt.Sprintf("expected status 200, got %d", recorder.Code)))
+	}
+
+	var response struct {
+		Services []map[string]interface{} `json:"services"`
+	}
+
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
+	if err != nil {
+		t.Error(red(err.Error()))
+		return
+	}
+
+	if response.Services[0]["instances_retrievable"] != true {
+		t.Error(red("catalog should advertise instances_retrievable"))
+	}
+
+	if response.Services[0]["bindings_retrievable"] != true {
+		t.Error(red("catalog should advertise bindings_retrievable"))
+	}
+
+	if response.Services[0]["id"] != "12345" {
+		t.Error(red("catalog should contain the service of the brokerapi response"))
+	}
+}
+
+func Test_GetInstance_RequiresAPIVersion(t *testing.T) {
+	catalog, err := catalog.NewFromSerialized(def)
+
+	if err != nil {
+		t.Error(red(err.Error()))
+	}
+
+	broker := NewBroker(catalog, &config.Config{}, nil, nil, helm.NewFake())
+
+	request := httptest.NewRequest(http.MethodGet, "/v2/service_instances/instance-id", nil)
+	recorder := httptest.NewRecorder()
+
+	broker.router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusPreconditionFailed {
+		t.Error(red(fmt.Sprintf("expected status 412, got %d", recorder.Code)))
+	}
+}
+
+func Test_BindAsync_RequiresPlan(t *testing.T) {
+	catalog, err := catalog.NewFromSerialized(def)
+
+	if err != nil {
+		t.Error(red(err.Error()))
+	}
+
+	broker := NewBroker(catalog, &config.Config{}, nil, nil, helm.NewFake())
+
+	body := strings.NewReader(`{"service_id": "12345"}`)
+	request := httptest.NewRequest(http.MethodPut, "/v2/service_instances/instance-id/service_bindings/binding-id?accepts_incomplete=true", body)
+	request.Header.Set("X-Broker-API-Version", "2.14")
+	recorder := httptest.NewRecorder()
+
+	broker.router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Error(red(fmt.Sprintf("expected status 400, got %d", recorder.Code)))
+	}
+
+	if !strings.Contains(recorder.Body.String(), "service_id and plan_id are required") {
+		t.Error(red("asynchronous bind requests should be handled by helmi: " + recorder.Body.String()))
+	}
+}
+
+func Test_BindAsync_InvalidParameters(t *testing.T) {
+	catalog, err := catalog.NewFromSerialized(def)
+
+	if err != nil {
+		t.Error(red(err.Error()))
+	}
+
+	broker := NewBroker(catalog, &config.Config{}, nil, nil, helm.NewFake())
+
+	body := strings.NewReader(`{"service_id": "12345", "plan_id": "67890", "parameters": {"billing-account": 42}}`)
+	request := httptest.NewRequest(http.MethodPut, "/v2/service_instances/instance-id/service_bindings/binding-id?accepts_incomplete=true", body)
+	request.Header.Set("X-Broker-API-Version", "2.14")
+	recorder := httptest.NewRecorder()
+
+	broker.router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Error(red(fmt.Sprintf("expected status 400, got %d", recorder.Code)))
+	}
+
+	if !strings.Contains(recorder.Body.String(), "billing-account") {
+		t.Error(red("the response should name the invalid parameter: " + recorder.Body.String()))
+	}
+}
+
+var defPlanFlags = []byte(`---
+service:
+  _id: 12345
+  _name: "test_service"
+  description: "service_description"
+  chart: service_chart
+  bindable: false
+  plans:
+  -
+    _id: 67890
+    _name: worker
+    description: "background worker"
+  -
+    _id: 67891
+    _name: paid
+    description: "paid plan"
+    free: false
+    bindable: true
+    plan-updateable: true
+    maximum-polling-duration: 3600
+    maintenance-info:
+      version: 1.2.0
+      description: "new chart version"
+---
+chart-values: {}
+---
+user-credentials: {}
+`)
+
+func Test_Catalog_PlanFlags(t *testing.T) {
+	catalog, err := catalog.NewFromSerialized(defPlanFlags)
+
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	broker := NewBroker(catalog, &config.Config{}, nil, nil, helm.NewFake())
+
+	request := httptest.NewRequest(http.MethodGet, "/v2/catalog", nil)
+	request.Header.Set("X-Broker-API-Version", "2.15")
+	recorder := httptest.NewRecorder()
+
+	broker.router.ServeHTTP(recorder, request)
+
+	var response struct {
+		Services []map[string]interface{} `json:"services"`
+	}
+
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	service := response.Services[0]
+	if service["bindable"] != false {
+		t.Error(red("service should not be bindable"))
+	}
+
+	plans := service["plans"].([]interface{})
+	worker := plans[0].(map[string]interface{})
+	paid := plans[1].(map[string]interface{})
+
+	if worker["bindable"] != false || worker["free"] != true {
+		t.Error(red(fmt.Sprintf("worker plan should inherit bindable and be free: %v", worker)))
+	}
+
+	if paid["bindable"] != true || paid["free"] != false || paid["plan_updateable"] != true {
+		t.Error(red(fmt.Sprintf("paid plan should render its flags: %v", paid)))
+	}
+
+	if paid["maximum_polling_duration"] != float64(3600) {
+		t.Error(red("paid plan should render maximum_polling_duration"))
+	}
+
+	maintenance, _ := paid["maintenance_info"].(map[string]interface{})
+	if maintenance["version"] != "1.2.0" {
+		t.Error(red("paid plan should render maintenance_info"))
+	}
+
+	if service["bindings_retrievable"] != true {
+		t.Error(red("bindings are retrievable if any plan is bindable"))
+	}
+}
+
+func Test_BindAsync_NotBindable(t *testing.T) {
+	catalog, err := catalog.NewFromSerialized(defPlanFlags)
+
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	broker := NewBroker(catalog, &config.Config{}, nil, nil, helm.NewFake())
+
+	body := strings.NewReader(`{"service_id": "12345", "plan_id": "67890"}`)
+	request := httptest.NewRequest(http.MethodPut, "/v2/service_instances/instance-id/service_bindings/binding-id?accepts_incomplete=true", body)
+	request.Header.Set("X-Broker-API-Version", "2.14")
+	recorder := httptest.NewRecorder()
+
+	broker.router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Error(red(fmt.Sprintf("expected status 400, got %d", recorder.Code)))
+	}
+}
+
+func Test_Provision_Validation(t *testing.T) {
+	catalog, err := catalog.NewFromSerialized(def)
+
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	broker := NewBroker(catalog, &config.Config{}, nil, nil, helm.NewFake())
+
+	requests := map[string]string{
+		"service_id missing":            `{"plan_id": "67890", "organization_guid": "org", "space_guid": "space"}`,
+		"plan_id missing":               `{"service_id": "12345", "organization_guid": "org", "space_guid": "space"}`,
+		"space_guid missing":            `{"service_id": "12345", "plan_id": "67890", "organization_guid": "org"}`,
+		"service-id not in the catalog": `{"service_id": "unknown", "plan_id": "67890", "organization_guid": "org", "space_guid": "space"}`,
+		"plan-id not in the catalog":    `{"service_id": "12345", "plan_id": "unknown", "organization_guid": "org", "space_guid": "space"}`,
+	}
+
+	for expected, body := range requests {
+		request := httptest.NewRequest(http.MethodPut, "/v2/service_instances/instance-id?accepts_incomplete=true", strings.NewReader(body))
+		request.Header.Set("X-Broker-API-Version", "2.14")
+		recorder := httptest.NewRecorder()
+
+		broker.router.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), expected) {
+			t.Error(red(fmt.Sprintf("expected 400 with %s, got %d: %s", expected, recorder.Code, recorder.Body.String())))
+		}
+	}
+}
+
+type recordingSink struct {
+	events []audit.Event
+}
+
+func (s *recordingSink) Write(event audit.Event) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+func Test_Audit_OriginatingIdentity(t *testing.T) {
+	catalog, err := catalog.NewFromSerialized(def)
+
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	sink := &recordingSink{}
+	broker := NewBroker(catalog, &config.Config{}, nil, sink, helm.NewFake())
+
+	identity := base64.StdEncoding.EncodeToString([]byte(`{"user_id": "user-guid"}`))
+
+	body := strings.NewReader(`{"service_id": "12345", "plan_id": "67890", "parameters": {"billing-account": 42}}`)
+	request := httptest.NewRequest(http.MethodPut, "/v2/service_instances/instance-id/service_bindings/binding-id?accepts_incomplete=true", body)
+	request.Header.Set("X-Broker-API-Version", "2.14")
+	request.Header.Set("X-Broker-API-Originating-Identity", "cloudfoundry "+identity)
+
+	broker.router.ServeHTTP(httptest.NewRecorder(), request)
+
+	if len(sink.events) != 1 {
+		t.Fatal(red(fmt.Sprintf("expected one audit event, got %d", len(sink.events))))
+	}
+
+	event := sink.events[0]
+	if event.Operation != "bind" || event.BindingID != "binding-id" || event.Outcome != audit.Failed {
+		t.Error(red(fmt.Sprintf("unexpected audit event %#v", event)))
+	}
+
+	if event.Identity == nil || event.Identity.Value["user_id"] != "user-guid" {
+		t.Error(red("audit event should contain the originating identity"))
+	}
+}
+
+func Test_Admin_Revisions(t *testing.T) {
+	catalog, err := catalog.NewFromSerialized(def)
+
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	fake := helm.NewFake()
+	fake.Install(context.Background(), "helmiinstanceid", "plan_chart", "4.5.6", map[string]interface{}{
+		"__metadata": map[string]interface{}{
+			"helmiServiceId":    "12345",
+			"helmiPlanId":       "67890",
+			"helmiChartVersion": "4.5.6",
+		},
+	}, "default", true)
+
+	serve := func(broker *Broker, instanceID string, authenticated bool) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/admin/service_instances/"+instanceID+"/revisions", nil)
+		if authenticated {
+			request.SetBasicAuth("admin", "secret")
+		}
+
+		recorder := httptest.NewRecorder()
+		broker.router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	unauthenticated := NewBroker(catalog, &config.Config{}, nil, nil, fake)
+	if code := serve(unauthenticated, "instance-id", false).Code; code != http.StatusNotFound {
+		t.Error(red(fmt.Sprintf("admin routes should not be served without credentials, got %d", code)))
+	}
+
+	broker := NewBroker(catalog, &config.Config{Username: "admin", Password: "secret"}, nil, nil, fake)
+	if code := serve(broker, "instance-id", false).Code; code != http.StatusUnauthorized {
+		t.Error(red(fmt.Sprintf("admin routes should require authentication, got %d", code)))
+	}
+
+	if code := serve(broker, "missing", true).Code; code != http.StatusNotFound {
+		t.Error(red(fmt.Sprintf("revisions of a missing instance should not be found, got %d", code)))
+	}
+
+	recorder := serve(broker, "instance-id", true)
+
+	var response revisionsResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+
+	if recorder.Code != http.StatusOK || len(response.Revisions) != 1 || response.Revisions[0].PlanId != "67890" || response.Revisions[0].ChartVersion != "4.5.6" {
+		t.Error(red(fmt.Sprintf("unexpected revisions %d %v", recorder.Code, response.Revisions)))
+	}
+}
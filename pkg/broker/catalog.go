@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"net/http"
+
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/monostream/helmi/pkg/catalog"
+)
+
+// Service in the catalog response with the fields of newer OSB versions which brokerapi does not know
+type catalogService struct {
+	brokerapi.Service
+	InstancesRetrievable bool          `json:"instances_retrievable,omitempty"`
+	BindingsRetrievable  bool          `json:"bindings_retrievable,omitempty"`
+	Plans                []catalogPlan `json:"plans"`
+}
+
+// Plan in the catalog response with the fields of newer OSB versions which brokerapi does not know
+type catalogPlan struct {
+	brokerapi.ServicePlan
+	PlanUpdateable         *bool            `json:"plan_updateable,omitempty"`
+	MaximumPollingDuration int              `json:"maximum_polling_duration,omitempty"`
+	MaintenanceInfo        *maintenanceInfo `json:"maintenance_info,omitempty"`
+}
+
+type maintenanceInfo struct {
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type catalogResponse struct {
+	Services []catalogService `json:"services"`
+}
+
+func (b *Broker) catalogHandler(w http.ResponseWriter, r *http.Request) {
+	services, err := b.Services(r.Context())
+	if err != nil {
+		b.writeJSONError(w, err)
+		return
+	}
+
+	response := catalogResponse{
+		Services: make([]catalogService, 0, len(services)),
+	}
+
+	version := apiVersionFromContext(r.Context())
+
+	for _, service := range services {
+		plans := catalogPlans(b.catalog.Service(service.ID), service.Plans, version)
+
+		bindingsRetrievable := false
+		for _, plan := range plans {
+			if plan.Bindable != nil && *plan.Bindable {
+				bindingsRetrievable = true
+			}
+		}
+
+		s := catalogService{
+			Service: service,
+			Plans:   plans,
+		}
+
+		// platforms before OSB 2.14 do not know how to retrieve instances and bindings
+		if version.atLeast(apiVersion214) {
+			s.InstancesRetrievable = true
+			s.BindingsRetrievable = bindingsRetrievable
+		}
+
+		response.Services = append(response.Services, s)
+	}
+
+	b.writeJSONResponse(w, http.StatusOK, response)
+}
+
+func catalogPlans(service *catalog.Service, servicePlans []brokerapi.ServicePlan, version apiVersion) []catalogPlan {
+	plans := make([]catalogPlan, 0, len(servicePlans))
+
+	for _, servicePlan := range servicePlans {
+		p := catalogPlan{ServicePlan: servicePlan}
+
+		plan, err := service.Plan(servicePlan.ID)
+		if err == nil {
+			p.PlanUpdateable = plan.PlanUpdateable
+
+			// fields of OSB 2.15
+			if version.atLeast(apiVersion215) {
+				p.MaximumPollingDuration = plan.MaximumPollingDuration
+			}
+
+			if plan.MaintenanceInfo != nil && version.atLeast(apiVersion215) {
+				p.MaintenanceInfo = &maintenanceInfo{
+					Version:     plan.MaintenanceInfo.Version,
+					Description: plan.MaintenanceInfo.Description,
+				}
+			}
+		}
+
+		plans = append(plans, p)
+	}
+
+	return plans
+}
@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/monostream/helmi/pkg/release"
+)
+
+type instanceResponse struct {
+	ServiceID    string `json:"service_id"`
+	PlanID       string `json:"plan_id"`
+	DashboardURL string `json:"dashboard_url,omitempty"`
+}
+
+// Answers GET /v2/service_instances/:instance_id from the values stored in the release, parameters are not returned
+// since they may contain secrets
+func (b *Broker) getInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	if !b.requireAPIVersion(w, r, apiVersion214) {
+		return
+	}
+
+	instanceID := mux.Vars(r)["instance_id"]
+
+	instance, err := release.GetInstance(r.Context(), b.catalog, instanceID)
+	if err != nil {
+		if err == release.ErrReleaseNotFound {
+			b.writeJSONResponse(w, http.StatusNotFound, brokerapi.ErrorResponse{
+				Description: brokerapi.ErrInstanceDoesNotExist.Error(),
+			})
+			return
+		}
+
+		b.writeJSONError(w, err)
+		return
+	}
+
+	b.writeJSONResponse(w, http.StatusOK, instanceResponse{
+		ServiceID:    instance.ServiceId,
+		PlanID:       instance.PlanId,
+		DashboardURL: instance.DashboardURL,
+	})
+}
+
+type provisionResponse struct {
+	DashboardURL  string `json:"dashboard_url,omitempty"`
+	OperationData string `json:"operation,omitempty"`
+}
+
+// Answers PUT /v2/service_instances/:instance_id in place of brokerapi, which can not answer
+// replayed provision requests with 200
+func (b *Broker) provisionHandler(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["instance_id"]
+
+	var details brokerapi.ProvisionDetails
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		b.writeJSONResponse(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+
+	var missing string
+	switch {
+	case details.ServiceID == "":
+		missing = "service_id missing"
+	case details.PlanID == "":
+		missing = "plan_id missing"
+	case details.SpaceGUID == "":
+		missing = "space_guid missing"
+	case details.OrganizationGUID == "":
+		missing = "organization_guid missing"
+	}
+
+	if len(missing) > 0 {
+		b.writeJSONResponse(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+			Description: missing,
+		})
+		return
+	}
+
+	service := b.catalog.Service(details.ServiceID)
+	if service == nil {
+		b.writeJSONResponse(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+			Description: "service-id not in the catalog",
+		})
+		return
+	}
+
+	if _, err := service.Plan(details.PlanID); err != nil {
+		b.writeJSONResponse(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+			Description: "plan-id not in the catalog",
+		})
+		return
+	}
+
+	asyncAllowed := r.FormValue("accepts_incomplete") == "true"
+
+	spec, existed, err := b.provision(r.Context(), instanceID, details, asyncAllowed)
+	if err != nil {
+		b.writeFailure(w, err)
+		return
+	}
+
+	response := provisionResponse{
+		DashboardURL:  spec.DashboardURL,
+		OperationData: spec.OperationData,
+	}
+
+	switch {
+	case spec.IsAsync:
+		b.writeJSONResponse(w, http.StatusAccepted, response)
+	case existed:
+		b.writeJSONResponse(w, http.StatusOK, response)
+	default:
+		b.writeJSONResponse(w, http.StatusCreated, response)
+	}
+}
@@ -0,0 +1,124 @@
+package broker
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/monostream/helmi/pkg/kubectl"
+)
+
+const (
+	// a lock of a broker instance which stopped renewing it is taken over after this duration
+	lockDuration      = time.Second * 30
+	lockRenewInterval = time.Second * 10
+	// a lock shared by many operations is tried again after this duration while another operation holds it
+	lockRetryInterval = time.Second
+	// renewing and releasing a lock must not be cancelled with the operation holding it
+	lockRequestTimeout = time.Second * 10
+)
+
+// Returned if another operation holds the lock of the instance
+var errConcurrency = brokerapi.NewFailureResponseBuilder(
+	errors.New("another operation for this service instance is in progress"), http.StatusUnprocessableEntity, "concurrency-error",
+).WithErrorKey("ConcurrencyError").Build()
+
+// Serializes operations on service instances across all broker instances with Kubernetes leases
+type instanceLocks struct {
+	namespace string
+	identity  string
+}
+
+func newInstanceLocks(namespace string) *instanceLocks {
+	if len(namespace) == 0 {
+		namespace = "default"
+	}
+
+	identity, _ := os.Hostname()
+
+	return &instanceLocks{
+		namespace: namespace,
+		identity:  identity,
+	}
+}
+
+// Lease names must be valid DNS names, instance ids are not restricted
+func lockName(instanceID string) string {
+	return fmt.Sprintf("helmi-lock-%x", sha1.Sum([]byte(instanceID)))
+}
+
+// Acquires the lock of an instance and keeps renewing it until the returned function is called.
+// Returns errConcurrency if another operation holds the lock.
+func (l *instanceLocks) acquire(ctx context.Context, instanceID string) (func(), error) {
+	name := lockName(instanceID)
+
+	// every acquisition is a holder of its own, even within the same broker instance
+	holder := l.identity + "/" + uuid.Must(uuid.NewV4()).String()
+
+	err := kubectl.AcquireLease(ctx, name, l.namespace, holder, lockDuration)
+	if err == kubectl.ErrLeaseHeld {
+		return nil, errConcurrency
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(lockRenewInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if l.renew(name, holder) == kubectl.ErrLeaseHeld {
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+
+		ctx, cancel := context.WithTimeout(context.Background(), lockRequestTimeout)
+		defer cancel()
+
+		kubectl.ReleaseLease(ctx, name, l.namespace, holder)
+	}, nil
+}
+
+// Acquires a lock shared by many operations, waits while other operations hold it.
+// Returns errConcurrency if the lock could not be acquired before the context is done.
+func (l *instanceLocks) acquireWaiting(ctx context.Context, name string) (func(), error) {
+	for {
+		unlock, err := l.acquire(ctx, name)
+		if err != errConcurrency {
+			return unlock, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errConcurrency
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+func (l *instanceLocks) renew(name string, holder string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), lockRequestTimeout)
+	defer cancel()
+
+	return kubectl.RenewLease(ctx, name, l.namespace, holder)
+}
@@ -0,0 +1,297 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+
+	"github.com/monostream/helmi/pkg/kubectl"
+)
+
+// Lease API of Kubernetes kept in memory, it checks resource versions and delete preconditions like the API server
+type fakeLeaseAPI struct {
+	mutex   sync.Mutex
+	leases  map[string]coordinationv1beta1.Lease
+	version int
+}
+
+// Serves the lease API to the kubectl package until the returned function is called
+func useFakeLeaseAPI(t *testing.T) (*fakeLeaseAPI, func()) {
+	api := &fakeLeaseAPI{leases: make(map[string]coordinationv1beta1.Lease)}
+	server := httptest.NewServer(api)
+
+	err := kubectl.Configure(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	return api, server.Close
+}
+
+func (f *fakeLeaseAPI) get(name string) (coordinationv1beta1.Lease, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	lease, ok := f.leases[name]
+	return lease, ok
+}
+
+func (f *fakeLeaseAPI) put(lease coordinationv1beta1.Lease) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.store(lease)
+}
+
+func (f *fakeLeaseAPI) store(lease coordinationv1beta1.Lease) coordinationv1beta1.Lease {
+	f.version++
+
+	lease.TypeMeta = metav1.TypeMeta{Kind: "Lease", APIVersion: "coordination.k8s.io/v1beta1"}
+	lease.ResourceVersion = fmt.Sprint(f.version)
+	if len(lease.UID) == 0 {
+		lease.UID = types.UID(fmt.Sprintf("uid-%d", f.version))
+	}
+
+	f.leases[lease.Name] = lease
+	return lease
+}
+
+func (f *fakeLeaseAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// /apis/coordination.k8s.io/v1beta1/namespaces/:namespace/leases/:name
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/apis/coordination.k8s.io/v1beta1/namespaces/"), "/")
+	if len(parts) < 2 || parts[1] != "leases" {
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+		return
+	}
+
+	name := ""
+	if len(parts) > 2 {
+		name = parts[2]
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	existing, exists := f.leases[name]
+
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+			return
+		}
+		writeObject(w, http.StatusOK, existing)
+	case http.MethodPost:
+		var lease coordinationv1beta1.Lease
+		json.NewDecoder(r.Body).Decode(&lease)
+
+		if _, taken := f.leases[lease.Name]; taken {
+			writeStatus(w, http.StatusConflict, metav1.StatusReasonAlreadyExists)
+			return
+		}
+		writeObject(w, http.StatusCreated, f.store(lease))
+	case http.MethodPut:
+		var lease coordinationv1beta1.Lease
+		json.NewDecoder(r.Body).Decode(&lease)
+
+		if !exists {
+			writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+			return
+		}
+		if lease.ResourceVersion != existing.ResourceVersion {
+			writeStatus(w, http.StatusConflict, metav1.StatusReasonConflict)
+			return
+		}
+		writeObject(w, http.StatusOK, f.store(lease))
+	case http.MethodDelete:
+		var options metav1.DeleteOptions
+		json.NewDecoder(r.Body).Decode(&options)
+
+		if !exists {
+			writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+			return
+		}
+		if options.Preconditions != nil && options.Preconditions.UID != nil && *options.Preconditions.UID != existing.UID {
+			writeStatus(w, http.StatusConflict, metav1.StatusReasonConflict)
+			return
+		}
+		delete(f.leases, name)
+		writeObject(w, http.StatusOK, metav1.Status{TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}, Status: metav1.StatusSuccess})
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed)
+	}
+}
+
+func writeObject(w http.ResponseWriter, code int, object interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(object)
+}
+
+func writeStatus(w http.ResponseWriter, code int, reason metav1.StatusReason) {
+	writeObject(w, code, metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Reason:   reason,
+		Code:     int32(code),
+	})
+}
+
+func Test_LockName(t *testing.T) {
+	name := lockName("6E3B5F2C-Instance_ID")
+
+	if name != lockName("6E3B5F2C-Instance_ID") {
+		t.Error(red("lock name is not stable"))
+	}
+
+	if name == lockName("other-instance") {
+		t.Error(red("lock names of different instances should differ"))
+	}
+
+	if !regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`).MatchString(name) || len(name) > 63 {
+		t.Error(red("lock name " + name + " is not a valid kubernetes name"))
+	}
+}
+
+func Test_Locks_AcquireAndRelease(t *testing.T) {
+	api, stop := useFakeLeaseAPI(t)
+	defer stop()
+
+	ctx := context.Background()
+	locks := newInstanceLocks("helmi")
+
+	unlock, err := locks.acquire(ctx, "instance")
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	lease, ok := api.get(lockName("instance"))
+	if !ok || lease.Spec.HolderIdentity == nil || !strings.HasPrefix(*lease.Spec.HolderIdentity, locks.identity+"/") {
+		t.Fatal(red(fmt.Sprintf("lease of the lock should be held by the broker instance, got %v", lease)))
+	}
+
+	if _, err := locks.acquire(ctx, "instance"); err != errConcurrency {
+		t.Error(red(fmt.Sprintf("second acquisition should conflict, got %v", err)))
+	}
+
+	otherUnlock, err := locks.acquire(ctx, "other-instance")
+	if err != nil {
+		t.Error(red("locks of other instances should not conflict: " + err.Error()))
+	} else {
+		otherUnlock()
+	}
+
+	unlock()
+
+	if _, ok := api.get(lockName("instance")); ok {
+		t.Error(red("released lock should delete its lease"))
+	}
+
+	unlock, err = locks.acquire(ctx, "instance")
+	if err != nil {
+		t.Fatal(red("released lock should be acquired again: " + err.Error()))
+	}
+	unlock()
+}
+
+func Test_Locks_Renew(t *testing.T) {
+	api, stop := useFakeLeaseAPI(t)
+	defer stop()
+
+	locks := newInstanceLocks("helmi")
+
+	unlock, err := locks.acquire(context.Background(), "instance")
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+	defer unlock()
+
+	name := lockName("instance")
+	acquired, _ := api.get(name)
+
+	time.Sleep(time.Millisecond * 10)
+
+	if err := locks.renew(name, *acquired.Spec.HolderIdentity); err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	renewed, _ := api.get(name)
+	if !renewed.Spec.RenewTime.After(acquired.Spec.RenewTime.Time) {
+		t.Error(red("renewal should extend the lease"))
+	}
+
+	if err := locks.renew(name, "other-holder"); err != kubectl.ErrLeaseHeld {
+		t.Error(red(fmt.Sprintf("other holders should not renew the lease, got %v", err)))
+	}
+}
+
+func Test_Locks_TakeOverExpired(t *testing.T) {
+	api, stop := useFakeLeaseAPI(t)
+	defer stop()
+
+	holder := "crashed-broker/lock"
+	seconds := int32(lockDuration.Seconds())
+	renewed := metav1.NewMicroTime(time.Now().Add(-lockDuration * 2))
+
+	api.put(coordinationv1beta1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: lockName("instance"), Namespace: "helmi"},
+		Spec: coordinationv1beta1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &seconds,
+			RenewTime:            &renewed,
+		},
+	})
+
+	locks := newInstanceLocks("helmi")
+
+	unlock, err := locks.acquire(context.Background(), "instance")
+	if err != nil {
+		t.Fatal(red("lease which has not been renewed in time should be taken over: " + err.Error()))
+	}
+	unlock()
+}
+
+func Test_Locks_AcquireWaiting(t *testing.T) {
+	_, stop := useFakeLeaseAPI(t)
+	defer stop()
+
+	locks := newInstanceLocks("helmi")
+
+	unlock, err := locks.acquire(context.Background(), "quota")
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	if _, err := locks.acquireWaiting(ctx, "quota"); err != errConcurrency {
+		t.Error(red(fmt.Sprintf("lock which is not released in time should conflict, got %v", err)))
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		unlock()
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), lockRetryInterval*5)
+	defer cancel()
+
+	waitingUnlock, err := locks.acquireWaiting(ctx, "quota")
+	if err != nil {
+		t.Fatal(red("lock should be acquired once it is released: " + err.Error()))
+	}
+	waitingUnlock()
+}
@@ -0,0 +1,354 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+	"gopkg.in/yaml.v2"
+
+	"github.com/monostream/helmi/pkg/config"
+	"github.com/monostream/helmi/pkg/helm"
+	"github.com/monostream/helmi/pkg/kubectl"
+)
+
+const (
+	// label of namespaces created by Helmi, only those are deleted once their last release is gone
+	managedNamespaceLabel = "monostream.com/helmi-managed"
+	// time of the last provision into a created namespace
+	lastProvisionAnnotation = "monostream.com/helmi-last-provision"
+	// a namespace is not cleaned up for this duration after a provision, its release may not exist yet
+	namespaceCleanupGrace = time.Minute * 5
+)
+
+type platformContext struct {
+	Platform string `json:"platform"`
+	// set if platform=cloudfoundry
+	CFSpaceGUID string `json:"space_guid"`
+	CFSpaceName string `json:"space_name"`
+	CFOrgGUID   string `json:"organization_guid"`
+	CFOrgName   string `json:"organization_name"`
+	// set if platform=kubernetes
+	K8SNamespace string `json:"namespace"`
+	K8SClusterId string `json:"clusterid"`
+}
+
+// Template of the namespaces created for Cloud Foundry spaces, rendered with the guids and names of the space and its org
+type namespaceTemplate struct {
+	Name          string            `yaml:"name"`
+	SvcDomain     string            `yaml:"svc-domain"`
+	Labels        map[string]string `yaml:"labels"`
+	Annotations   map[string]string `yaml:"annotations"`
+	ResourceQuota map[string]string `yaml:"resource-quota"`
+	LimitRanges   []struct {
+		Type           string            `yaml:"type"`
+		Default        map[string]string `yaml:"default"`
+		DefaultRequest map[string]string `yaml:"default-request"`
+		Max            map[string]string `yaml:"max"`
+		Min            map[string]string `yaml:"min"`
+	} `yaml:"limit-ranges"`
+}
+
+type spaceVars struct {
+	OrgGUID   string
+	OrgName   string
+	SpaceGUID string
+	SpaceName string
+}
+
+// What happens if the namespace named by the platform context does not exist
+const (
+	// instances are deployed to HELM_NAMESPACE
+	fallbackNamespacePolicy = "fallback"
+	// provisions are refused
+	strictNamespacePolicy = "strict"
+	// the namespace of a Cloud Foundry space is created, Kubernetes namespaces must exist
+	createNamespacePolicy = "create"
+)
+
+func IsNamespacePolicy(policy string) bool {
+	switch policy {
+	case fallbackNamespacePolicy, strictNamespacePolicy, createNamespacePolicy:
+		return true
+	}
+	return false
+}
+
+// Returned by the strict and create policies if the namespace of the platform context does not exist
+func namespaceNotFound(description string) error {
+	return brokerapi.NewFailureResponseBuilder(
+		errors.New(description), http.StatusUnprocessableEntity, "namespace-not-found",
+	).WithErrorKey("NamespaceNotFound").Build()
+}
+
+// Finds the namespace of new instances from the context of the platform
+type namespaceResolver struct {
+	policy       string
+	templatePath string
+	orgLabel     string
+	spaceLabel   string
+	locks        *instanceLocks
+	helmClient   helm.Client
+}
+
+func newNamespaceResolver(config *config.Config, locks *instanceLocks, helmClient helm.Client) *namespaceResolver {
+	return &namespaceResolver{
+		policy:       config.NamespacePolicy,
+		templatePath: config.NamespaceTemplate,
+		orgLabel:     config.CFOrgLabel,
+		spaceLabel:   config.CFSpaceLabel,
+		locks:        locks,
+		helmClient:   helmClient,
+	}
+}
+
+// Returns the namespace for the platform context, or an empty namespace if the default namespace applies
+func (r *namespaceResolver) resolve(ctx context.Context, raw json.RawMessage) (kubectl.Namespace, error) {
+	var platform platformContext
+
+	err := json.Unmarshal(raw, &platform)
+	if err != nil {
+		return kubectl.Namespace{}, nil
+	}
+
+	switch platform.Platform {
+	case "cloudfoundry":
+		return r.spaceNamespace(ctx, platform)
+	case "kubernetes":
+		return r.kubernetesNamespace(ctx, platform)
+	}
+
+	return kubectl.Namespace{}, nil
+}
+
+func (r *namespaceResolver) kubernetesNamespace(ctx context.Context, platform platformContext) (kubectl.Namespace, error) {
+	namespace, err := kubectl.GetNamespaceByName(ctx, platform.K8SNamespace)
+	if err == kubectl.ErrNotFound {
+		if r.policy == fallbackNamespacePolicy {
+			log.Printf("namespace %s does not exist, falling back to the default namespace", platform.K8SNamespace)
+			return kubectl.Namespace{}, nil
+		}
+		return kubectl.Namespace{}, namespaceNotFound(fmt.Sprintf("namespace %s does not exist", platform.K8SNamespace))
+	}
+
+	return namespace, err
+}
+
+func (r *namespaceResolver) spaceSelector(platform platformContext) map[string]string {
+	return map[string]string{
+		r.orgLabel:   platform.CFOrgGUID,
+		r.spaceLabel: platform.CFSpaceGUID,
+	}
+}
+
+func (r *namespaceResolver) spaceNamespace(ctx context.Context, platform platformContext) (kubectl.Namespace, error) {
+	// spaces must not end up in the shared namespace because their own one could not be looked up
+	namespaces, err := kubectl.GetNamespaces(ctx, r.spaceSelector(platform))
+	if err != nil {
+		return kubectl.Namespace{}, err
+	}
+
+	if len(namespaces) > 0 {
+		r.touch(ctx, namespaces[0])
+		return namespaces[0], nil
+	}
+
+	switch r.policy {
+	case createNamespacePolicy:
+		return r.createSpaceNamespace(ctx, platform)
+	case strictNamespacePolicy:
+		return kubectl.Namespace{}, namespaceNotFound(fmt.Sprintf("no namespace is labelled with %s=%s and %s=%s", r.orgLabel, platform.CFOrgGUID, r.spaceLabel, platform.CFSpaceGUID))
+	}
+
+	return kubectl.Namespace{}, nil
+}
+
+// Records a provision into a created namespace, which keeps it from being cleaned up in the meantime
+func (r *namespaceResolver) touch(ctx context.Context, namespace kubectl.Namespace) {
+	if namespace.Labels[managedNamespaceLabel] != "true" {
+		return
+	}
+
+	err := kubectl.AnnotateNamespace(ctx, namespace.Name, map[string]string{
+		lastProvisionAnnotation: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Printf("failed to annotate namespace %s: %s", namespace.Name, err)
+	}
+}
+
+func (r *namespaceResolver) createSpaceNamespace(ctx context.Context, platform platformContext) (kubectl.Namespace, error) {
+	t, err := loadNamespaceTemplate(r.templatePath, spaceVars{
+		OrgGUID:   platform.CFOrgGUID,
+		OrgName:   platform.CFOrgName,
+		SpaceGUID: platform.CFSpaceGUID,
+		SpaceName: platform.CFSpaceName,
+	})
+	if err != nil {
+		return kubectl.Namespace{}, err
+	}
+
+	unlock, err := r.locks.acquire(ctx, namespaceLockID(t.Name))
+	if err != nil {
+		return kubectl.Namespace{}, err
+	}
+	defer unlock()
+
+	// another broker instance may have created it in the meantime
+	namespaces, err := kubectl.GetNamespaces(ctx, r.spaceSelector(platform))
+	if err != nil {
+		return kubectl.Namespace{}, err
+	}
+
+	if len(namespaces) > 0 {
+		r.touch(ctx, namespaces[0])
+		return namespaces[0], nil
+	}
+
+	labels := map[string]string{}
+	for key, value := range t.Labels {
+		labels[key] = value
+	}
+	for key, value := range r.spaceSelector(platform) {
+		labels[key] = value
+	}
+	labels[managedNamespaceLabel] = "true"
+
+	annotations := map[string]string{}
+	for key, value := range t.Annotations {
+		annotations[key] = value
+	}
+	if len(t.SvcDomain) > 0 {
+		annotations[kubectl.HelmiSvcDomain] = t.SvcDomain
+	}
+	annotations[lastProvisionAnnotation] = time.Now().UTC().Format(time.RFC3339)
+
+	spec := kubectl.NamespaceSpec{
+		Name:          t.Name,
+		Labels:        labels,
+		Annotations:   annotations,
+		ResourceQuota: t.ResourceQuota,
+	}
+
+	for _, limitRange := range t.LimitRanges {
+		spec.LimitRanges = append(spec.LimitRanges, kubectl.LimitRange{
+			Type:           limitRange.Type,
+			Default:        limitRange.Default,
+			DefaultRequest: limitRange.DefaultRequest,
+			Max:            limitRange.Max,
+			Min:            limitRange.Min,
+		})
+	}
+
+	err = kubectl.CreateNamespace(ctx, spec)
+	if err == kubectl.ErrAlreadyExists {
+		return kubectl.Namespace{}, fmt.Errorf("namespace %s exists but does not belong to space %s", t.Name, platform.CFSpaceGUID)
+	}
+	if err != nil {
+		return kubectl.Namespace{}, err
+	}
+
+	log.Printf("created namespace %s for space %s", t.Name, platform.CFSpaceGUID)
+
+	return kubectl.Namespace{
+		Name:          t.Name,
+		IngressDomain: t.SvcDomain,
+		Labels:        labels,
+		Annotations:   annotations,
+	}, nil
+}
+
+// Deletes a namespace created by Helmi once its last release is gone.
+// Returns the duration after which to try again if a recent provision may still create a release.
+func (r *namespaceResolver) cleanup(ctx context.Context, name string) (time.Duration, error) {
+	namespace, err := kubectl.GetNamespaceByName(ctx, name)
+	if err != nil || namespace.Labels[managedNamespaceLabel] != "true" {
+		return 0, err
+	}
+
+	unlock, err := r.locks.acquire(ctx, namespaceLockID(name))
+	if err == errConcurrency {
+		return lockRenewInterval, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	namespace, err = kubectl.GetNamespaceByName(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	lastProvision, err := time.Parse(time.RFC3339, namespace.Annotations[lastProvisionAnnotation])
+	if err == nil && time.Since(lastProvision) < namespaceCleanupGrace {
+		return namespaceCleanupGrace - time.Since(lastProvision), nil
+	}
+
+	releases, err := r.helmClient.ListReleases(ctx, name)
+	if err != nil || len(releases) > 0 {
+		return 0, err
+	}
+
+	log.Printf("deleting namespace %s without releases", name)
+
+	err = kubectl.DeleteNamespace(ctx, name)
+	if err == kubectl.ErrNotFound {
+		return 0, nil
+	}
+	return 0, err
+}
+
+// Creating and deleting a namespace is serialized with the same leases as operations on instances
+func namespaceLockID(name string) string {
+	return "namespace/" + name
+}
+
+// The template is read for every namespace, changes of a mounted config map apply without a restart
+func loadNamespaceTemplate(path string, vars spaceVars) (namespaceTemplate, error) {
+	t := namespaceTemplate{}
+
+	if len(path) > 0 {
+		source, err := ioutil.ReadFile(path)
+		if err != nil {
+			return t, err
+		}
+
+		t, err = renderNamespaceTemplate(source, vars)
+		if err != nil {
+			return t, fmt.Errorf("invalid namespace template: %s", err)
+		}
+	}
+
+	if len(t.Name) == 0 {
+		t.Name = "cf-" + vars.SpaceGUID
+	}
+
+	return t, nil
+}
+
+func renderNamespaceTemplate(source []byte, vars spaceVars) (namespaceTemplate, error) {
+	t := namespaceTemplate{}
+
+	tmpl, err := template.New("namespace").Parse(string(source))
+	if err != nil {
+		return t, err
+	}
+
+	b := new(bytes.Buffer)
+	err = tmpl.Execute(b, vars)
+	if err != nil {
+		return t, err
+	}
+
+	err = yaml.UnmarshalStrict(b.Bytes(), &t)
+	return t, err
+}
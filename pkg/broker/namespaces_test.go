@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/monostream/helmi/pkg/config"
+)
+
+func writeTemplate(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "namespace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	file.WriteString(content)
+	return file.Name()
+}
+
+func Test_LoadNamespaceTemplate(t *testing.T) {
+	vars := spaceVars{
+		OrgGUID:   "org-guid",
+		OrgName:   "org",
+		SpaceGUID: "space-guid",
+		SpaceName: "space",
+	}
+
+	defaults, err := loadNamespaceTemplate("", vars)
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	if defaults.Name != "cf-space-guid" || len(defaults.ResourceQuota) > 0 {
+		t.Error(red("namespaces should be named after the space guid without a template"))
+	}
+
+	path := writeTemplate(t, `
+svc-domain: "{{ .SpaceName }}.{{ .OrgName }}.example.com"
+resource-quota:
+  requests.cpu: "4"
+limit-ranges:
+- type: Container
+  default:
+    memory: 512Mi
+`)
+	defer os.Remove(path)
+
+	rendered, err := loadNamespaceTemplate(path, vars)
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	if rendered.Name != "cf-space-guid" {
+		t.Error(red("templates without name should use the default name"))
+	}
+
+	if rendered.SvcDomain != "space.org.example.com" {
+		t.Error(red("svc-domain should be rendered with the space and org: " + rendered.SvcDomain))
+	}
+
+	if rendered.ResourceQuota["requests.cpu"] != "4" || rendered.LimitRanges[0].Default["memory"] != "512Mi" {
+		t.Error(red("resource quota and limit ranges should be read from the template"))
+	}
+
+	invalid := writeTemplate(t, `unknown-field: true`)
+	defer os.Remove(invalid)
+
+	if _, err := loadNamespaceTemplate(invalid, vars); err == nil {
+		t.Error(red("templates with unknown fields should be rejected"))
+	}
+}
+
+func Test_NamespacePolicy(t *testing.T) {
+	for _, policy := range []string{"fallback", "strict", "create"} {
+		if !IsNamespacePolicy(policy) {
+			t.Error(red("policy " + policy + " should be valid"))
+		}
+	}
+
+	if IsNamespacePolicy("") || IsNamespacePolicy("Strict") {
+		t.Error(red("unknown policies should be invalid"))
+	}
+
+	err := namespaceNotFound("namespace missing does not exist")
+
+	failure, ok := err.(*brokerapi.FailureResponse)
+	if !ok || failure.ValidatedStatusCode(nil) != http.StatusUnprocessableEntity {
+		t.Error(red("missing namespaces should be reported with status 422"))
+	}
+}
+
+func Test_SpaceSelector(t *testing.T) {
+	resolver := newNamespaceResolver(&config.Config{
+		CFOrgLabel:   "cloudfoundry.org/org-guid",
+		CFSpaceLabel: "cloudfoundry.org/space-guid",
+	}, nil, nil)
+
+	selector := resolver.spaceSelector(platformContext{CFOrgGUID: "org-guid", CFSpaceGUID: "space-guid"})
+
+	if len(selector) != 2 || selector["cloudfoundry.org/org-guid"] != "org-guid" || selector["cloudfoundry.org/space-guid"] != "space-guid" {
+		t.Error(red("namespaces should be selected by the configured labels"))
+	}
+}
@@ -0,0 +1,182 @@
+package broker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/monostream/helmi/pkg/release"
+)
+
+const (
+	provisionOperation   = "provision"
+	updateOperation      = "update"
+	deprovisionOperation = "deprovision"
+	bindOperation        = "bind"
+	unbindOperation      = "unbind"
+)
+
+// Operations awaited by the broker poll the state of their release in this interval
+const operationPollInterval = time.Second * 10
+
+// Passed to the platform as operation data and sent back on last operation requests
+type operationToken struct {
+	Type     string `json:"type"`
+	Revision int    `json:"revision,omitempty"`
+	Started  int64  `json:"started"`
+	// deadline of the operation in seconds, TIMEOUT applies if not set
+	Timeout int64 `json:"timeout,omitempty"`
+}
+
+func newOperationToken(operationType string, revision int) operationToken {
+	return operationToken{
+		Type:     operationType,
+		Revision: revision,
+		Started:  time.Now().Unix(),
+	}
+}
+
+func (t operationToken) encode() string {
+	data, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (t operationToken) startTime() time.Time {
+	return time.Unix(t.Started, 0)
+}
+
+// Returns the token with the deadline of the operation
+func (t operationToken) withTimeout(timeout time.Duration) operationToken {
+	t.Timeout = int64(timeout / time.Second)
+	return t
+}
+
+// Returns the time after which the operation is considered failed
+func (t operationToken) deadline() time.Time {
+	timeout := release.Timeout()
+	if t.Timeout > 0 {
+		timeout = time.Duration(t.Timeout) * time.Second
+	}
+	return t.startTime().Add(timeout)
+}
+
+// Polls the state of an operation until it is no longer in progress, which it is at the latest after the deadline
+// of the token. Returns the last state, its flag and the error of the last poll if the context is done before.
+func awaitOperation(ctx context.Context, token operationToken, state func(ctx context.Context) (brokerapi.LastOperation, bool, error)) (brokerapi.LastOperation, bool, error) {
+	ctx, cancel := context.WithDeadline(ctx, token.deadline().Add(operationPollInterval))
+	defer cancel()
+
+	for {
+		op, flag, err := state(ctx)
+		if err == nil && op.State != brokerapi.InProgress {
+			return op, flag, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+			return op, flag, err
+		case <-time.After(operationPollInterval):
+		}
+	}
+}
+
+func decodeOperationToken(operationData string) (operationToken, error) {
+	token := operationToken{}
+
+	data, err := base64.RawURLEncoding.DecodeString(operationData)
+	if err != nil {
+		return token, err
+	}
+
+	err = json.Unmarshal(data, &token)
+
+	return token, err
+}
+
+// Returned by start if the same request started the operation which is still running
+var errOperationRunning = errors.New("the operation is still running")
+
+type operation struct {
+	// identifies the request which started the operation
+	request string
+	done    bool
+	err     error
+}
+
+// Keeps track of asynchronous operations started by this broker instance
+type operations struct {
+	mutex   sync.Mutex
+	running map[string]*operation
+}
+
+func newOperations() *operations {
+	return &operations{
+		running: make(map[string]*operation),
+	}
+}
+
+// Runs the function in the background and records its result for the key. An operation of the key which is still
+// running is not replaced: errOperationRunning is returned if it has been started by the same request, errConcurrency
+// if not.
+func (o *operations) start(key string, request string, run func() error) error {
+	op := &operation{request: request}
+
+	o.mutex.Lock()
+	if running, ok := o.running[key]; ok && !running.done {
+		o.mutex.Unlock()
+
+		if running.request == request {
+			return errOperationRunning
+		}
+		return errConcurrency
+	}
+	o.running[key] = op
+	o.mutex.Unlock()
+
+	go func() {
+		err := run()
+
+		o.mutex.Lock()
+		op.done = true
+		op.err = err
+		o.mutex.Unlock()
+	}()
+
+	return nil
+}
+
+// Records an operation which failed without running in the background
+func (o *operations) fail(instanceID string, err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.running[instanceID] = &operation{done: true, err: err}
+}
+
+// Returns the state of the last operation started for the instance
+func (o *operations) get(instanceID string) (operation, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	op, ok := o.running[instanceID]
+	if !ok {
+		return operation{}, false
+	}
+
+	return *op, true
+}
+
+func (o *operations) remove(instanceID string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	delete(o.running, instanceID)
+}
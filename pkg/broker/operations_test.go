@@ -0,0 +1,237 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/monostream/helmi/pkg/helm"
+	"github.com/monostream/helmi/pkg/release"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func waitDone(t *testing.T, o *operations, instanceID string) operation {
+	for i := 0; i < 100; i++ {
+		if op, ok := o.get(instanceID); ok && op.done {
+			return op
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	t.Fatal(red("operation did not finish"))
+	return operation{}
+}
+
+func Test_Operations(t *testing.T) {
+	o := newOperations()
+
+	if _, ok := o.get("instance"); ok {
+		t.Error(red("unknown instance should not have an operation"))
+	}
+
+	o.start("instance", "request", func() error {
+		return errors.New("failed")
+	})
+
+	op := waitDone(t, o, "instance")
+	if op.err == nil || op.err.Error() != "failed" {
+		t.Error(red("operation error was not recorded"))
+	}
+
+	o.start("instance", "request", func() error {
+		return nil
+	})
+
+	op = waitDone(t, o, "instance")
+	if op.err != nil {
+		t.Error(red("restarted operation should not keep the previous error"))
+	}
+
+	finish := make(chan struct{})
+	defer close(finish)
+
+	o.start("instance", "request", func() error {
+		<-finish
+		return nil
+	})
+
+	if err := o.start("instance", "request", func() error { return nil }); err != errOperationRunning {
+		t.Error(red(fmt.Sprintf("replayed request of a running operation should be reported, got %v", err)))
+	}
+
+	if err := o.start("instance", "other request", func() error { return nil }); err != errConcurrency {
+		t.Error(red(fmt.Sprintf("running operation should not be replaced by another request, got %v", err)))
+	}
+
+	o.remove("instance")
+	if _, ok := o.get("instance"); ok {
+		t.Error(red("removed operation should not be returned"))
+	}
+}
+
+func Test_OperationToken(t *testing.T) {
+	token := newOperationToken(updateOperation, 3)
+
+	decoded, err := decodeOperationToken(token.encode())
+	if err != nil {
+		t.Error(red(err.Error()))
+		return
+	}
+
+	if decoded != token {
+		t.Error(red(fmt.Sprintf("expected %#v, got %#v", token, decoded)))
+	}
+
+	if !decoded.deadline().Equal(token.startTime().Add(release.Timeout())) {
+		t.Error(red("operations without timeout should use TIMEOUT"))
+	}
+
+	decoded, _ = decodeOperationToken(token.withTimeout(time.Minute * 5).encode())
+	if !decoded.deadline().Equal(token.startTime().Add(time.Minute * 5)) {
+		t.Error(red("operations should keep their timeout"))
+	}
+
+	if _, err := decodeOperationToken(""); err == nil {
+		t.Error(red("decoding empty operation data should fail"))
+	}
+
+	if _, err := decodeOperationToken("not a token"); err == nil {
+		t.Error(red("decoding invalid operation data should fail"))
+	}
+}
+
+func Test_DeprovisionState(t *testing.T) {
+	token := newOperationToken(deprovisionOperation, 0)
+	started := token.startTime()
+	updated := func(at time.Time) string {
+		return at.Local().Format(time.ANSIC)
+	}
+
+	states := []struct {
+		revision helm.Revision
+		now      time.Time
+		expected brokerapi.LastOperationState
+	}{
+		{helm.Revision{Status: "DELETING", Updated: updated(started)}, started, brokerapi.InProgress},
+		{helm.Revision{Status: "DELETING", Updated: updated(started)}, started.Add(release.Timeout() + time.Minute), brokerapi.Failed},
+		{helm.Revision{Status: "DELETED", Updated: updated(started)}, started, brokerapi.Failed},
+		{helm.Revision{Status: "FAILED", Updated: updated(started.Add(time.Second))}, started, brokerapi.Failed},
+		{helm.Revision{Status: "FAILED", Updated: updated(started.Add(-time.Hour))}, started, brokerapi.InProgress},
+		{helm.Revision{Status: "DEPLOYED", Updated: updated(started.Add(-time.Hour))}, started, brokerapi.InProgress},
+	}
+
+	for _, s := range states {
+		op := deprovisionState(s.revision, token, s.now)
+		if op.State != s.expected {
+			t.Error(red(fmt.Sprintf("expected %s for %#v, got %s", s.expected, s.revision, op.State)))
+		}
+	}
+}
+
+func Test_ProvisionState(t *testing.T) {
+	token := newOperationToken(provisionOperation, 1)
+	started := token.startTime()
+	updated := func(at time.Time) string {
+		return at.Local().Format(time.ANSIC)
+	}
+
+	states := []struct {
+		revision helm.Revision
+		now      time.Time
+		decided  bool
+		expected brokerapi.LastOperationState
+	}{
+		{helm.Revision{}, started, true, brokerapi.InProgress},
+		{helm.Revision{}, started.Add(release.Timeout() + time.Minute), true, brokerapi.Failed},
+		{helm.Revision{Revision: 2, Status: "DEPLOYED", Updated: updated(started)}, started, true, brokerapi.Failed},
+		{helm.Revision{Revision: 1, Status: "DEPLOYED", Updated: updated(started.Add(-time.Hour))}, started, true, brokerapi.Failed},
+		{helm.Revision{Revision: 1, Status: "FAILED", Updated: updated(started)}, started, true, brokerapi.Failed},
+		{helm.Revision{Revision: 1, Status: "DEPLOYED", Updated: updated(started)}, started, false, ""},
+	}
+
+	for _, s := range states {
+		op, decided := provisionState(s.revision, token, s.now)
+		if decided != s.decided || op.State != s.expected {
+			t.Error(red(fmt.Sprintf("expected %s (%v) for %#v, got %s (%v)", s.expected, s.decided, s.revision, op.State, decided)))
+		}
+	}
+}
+
+func Test_CreatedByProvision(t *testing.T) {
+	token := newOperationToken(provisionOperation, 1)
+	started := token.startTime()
+	updated := func(at time.Time) string {
+		return at.Local().Format(time.ANSIC)
+	}
+
+	revisions := []struct {
+		revision helm.Revision
+		expected bool
+	}{
+		{helm.Revision{}, false},
+		{helm.Revision{Revision: 2, Status: "FAILED", Updated: updated(started)}, false},
+		{helm.Revision{Revision: 1, Status: "FAILED", Updated: updated(started.Add(-time.Hour))}, false},
+		{helm.Revision{Revision: 1, Status: "FAILED", Updated: updated(started)}, true},
+	}
+
+	for _, r := range revisions {
+		if createdByProvision(r.revision, token) != r.expected {
+			t.Error(red(fmt.Sprintf("expected %v for %#v", r.expected, r.revision)))
+		}
+	}
+}
+
+func Test_FailedOperation(t *testing.T) {
+	o := newOperations()
+	o.fail("instance", errors.New("purged"))
+
+	op, ok := o.get("instance")
+	if !ok || !op.done || op.err == nil {
+		t.Error(red("failed operation should be recorded as done"))
+	}
+}
+
+func Test_RolledBackState(t *testing.T) {
+	token := newOperationToken(updateOperation, 3)
+
+	states := []struct {
+		revision helm.Revision
+		decided  bool
+	}{
+		{helm.Revision{Revision: 3, Status: "FAILED"}, false},
+		{helm.Revision{Revision: 4, Status: "DEPLOYED", Description: "Rollback to 2"}, true},
+		{helm.Revision{Revision: 4, Status: "DEPLOYED", Description: "Rollback to 1"}, false},
+		{helm.Revision{Revision: 4, Status: "DEPLOYED", Description: "Upgrade complete"}, false},
+		{helm.Revision{Revision: 5, Status: "DEPLOYED", Description: "Rollback to 2"}, false},
+	}
+
+	for _, s := range states {
+		op, decided := rolledBackState(s.revision, token)
+		if decided != s.decided || (decided && op.State != brokerapi.Failed) {
+			t.Error(red(fmt.Sprintf("expected %v for %#v, got %s (%v)", s.decided, s.revision, op.State, decided)))
+		}
+	}
+}
+
+func Test_AwaitOperation(t *testing.T) {
+	token := newOperationToken(updateOperation, 3)
+
+	op, failedRevision, err := awaitOperation(context.Background(), token, func(ctx context.Context) (brokerapi.LastOperation, bool, error) {
+		return brokerapi.LastOperation{State: brokerapi.Failed}, true, nil
+	})
+	if err != nil || op.State != brokerapi.Failed || !failedRevision {
+		t.Error(red("settled operation should be returned with its flag"))
+	}
+
+	// the deadline of an operation started long ago has passed
+	token.Started = time.Now().Add(-time.Hour).Unix()
+
+	_, _, err = awaitOperation(context.Background(), token, func(ctx context.Context) (brokerapi.LastOperation, bool, error) {
+		return brokerapi.LastOperation{State: brokerapi.InProgress}, false, nil
+	})
+	if err == nil {
+		t.Error(red("operation still in progress after its deadline should not be awaited any longer"))
+	}
+}
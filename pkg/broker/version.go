@@ -0,0 +1,128 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const apiVersionHeader = "X-Broker-API-Version"
+
+// OSB version sent by the platform in the X-Broker-API-Version header
+type apiVersion struct {
+	major int
+	minor int
+}
+
+var (
+	// oldest version whose requests are accepted
+	minAPIVersion = apiVersion{2, 13}
+	// instance and binding retrieval, asynchronous bindings
+	apiVersion214 = apiVersion{2, 14}
+	// maintenance info and maximum polling duration of plans
+	apiVersion215 = apiVersion{2, 15}
+)
+
+type apiVersionKey struct{}
+
+func parseAPIVersion(header string) (apiVersion, error) {
+	parts := strings.Split(header, ".")
+	if len(parts) != 2 {
+		return apiVersion{}, fmt.Errorf("%s Header %s is not a version", apiVersionHeader, header)
+	}
+
+	major, majorErr := strconv.Atoi(parts[0])
+	minor, minorErr := strconv.Atoi(parts[1])
+	if majorErr != nil || minorErr != nil {
+		return apiVersion{}, fmt.Errorf("%s Header %s is not a version", apiVersionHeader, header)
+	}
+
+	return apiVersion{major, minor}, nil
+}
+
+func (v apiVersion) atLeast(other apiVersion) bool {
+	return v.major > other.major || (v.major == other.major && v.minor >= other.minor)
+}
+
+func (v apiVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// Returns the version of the request, requests which did not pass apiVersionHandler get the oldest supported one
+func apiVersionFromContext(ctx context.Context) apiVersion {
+	if ctx == nil {
+		return minAPIVersion
+	}
+
+	if version, ok := ctx.Value(apiVersionKey{}).(apiVersion); ok {
+		return version
+	}
+	return minAPIVersion
+}
+
+// Rejects requests of unsupported OSB versions with 412 and makes the version available through the request context.
+// Newer minor versions are compatible and served with the features of the latest version Helmi knows.
+func apiVersionHandler(noVersionRequired skipRoutes) mux.MiddlewareFunc {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if noVersionRequired[mux.CurrentRoute(r)] {
+				handler.ServeHTTP(w, r)
+				return
+			}
+
+			header := r.Header.Get(apiVersionHeader)
+			if len(header) == 0 {
+				writePreconditionFailed(w, apiVersionHeader+" Header not set")
+				return
+			}
+
+			version, err := parseAPIVersion(header)
+			if err != nil {
+				writePreconditionFailed(w, err.Error())
+				return
+			}
+
+			if version.major != minAPIVersion.major || !version.atLeast(minAPIVersion) {
+				writePreconditionFailed(w, fmt.Sprintf("%s Header %s is not supported, Helmi supports %s and later 2.x versions", apiVersionHeader, version, minAPIVersion))
+				return
+			}
+
+			handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version)))
+		})
+	}
+}
+
+// Matches requests of the version or later, requests of older versions fall through to the next route
+func minimumAPIVersion(minimum apiVersion) mux.MatcherFunc {
+	return func(r *http.Request, match *mux.RouteMatch) bool {
+		version, err := parseAPIVersion(r.Header.Get(apiVersionHeader))
+		return err == nil && version.atLeast(minimum)
+	}
+}
+
+// Rejects requests for features of a newer version than the request declares
+func (b *Broker) requireAPIVersion(w http.ResponseWriter, r *http.Request, minimum apiVersion) bool {
+	version := apiVersionFromContext(r.Context())
+	if version.atLeast(minimum) {
+		return true
+	}
+
+	b.writeJSONResponse(w, http.StatusPreconditionFailed, brokerapi.ErrorResponse{
+		Description: fmt.Sprintf("this endpoint requires %s Header %s or later", apiVersionHeader, minimum),
+	})
+	return false
+}
+
+func writePreconditionFailed(w http.ResponseWriter, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPreconditionFailed)
+	json.NewEncoder(w).Encode(brokerapi.ErrorResponse{
+		Description: description,
+	})
+}
@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/monostream/helmi/pkg/catalog"
+	"github.com/monostream/helmi/pkg/config"
+	"github.com/monostream/helmi/pkg/helm"
+)
+
+func Test_ParseAPIVersion(t *testing.T) {
+	version, err := parseAPIVersion("2.14")
+	if err != nil || version != apiVersion214 {
+		t.Error(red(fmt.Sprintf("expected 2.14, got %s: %v", version, err)))
+	}
+
+	if !version.atLeast(minAPIVersion) || version.atLeast(apiVersion215) {
+		t.Error(red("versions should be compared by major and minor version"))
+	}
+
+	for _, header := range []string{"", "2", "2.x", "two.fourteen", "2.14.1"} {
+		if _, err := parseAPIVersion(header); err == nil {
+			t.Error(red("version " + header + " should be rejected"))
+		}
+	}
+}
+
+func Test_APIVersionHandler(t *testing.T) {
+	catalog, err := catalog.NewFromSerialized(def)
+
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	broker := NewBroker(catalog, &config.Config{}, nil, nil, helm.NewFake())
+
+	statuses := map[string]int{
+		"":     http.StatusPreconditionFailed,
+		"1.0":  http.StatusPreconditionFailed,
+		"2.12": http.StatusPreconditionFailed,
+		"3.0":  http.StatusPreconditionFailed,
+		"2.x":  http.StatusPreconditionFailed,
+		"2.13": http.StatusOK,
+		"2.16": http.StatusOK,
+	}
+
+	for header, expected := range statuses {
+		request := httptest.NewRequest(http.MethodGet, "/v2/catalog", nil)
+		if len(header) > 0 {
+			request.Header.Set("X-Broker-API-Version", header)
+		}
+		recorder := httptest.NewRecorder()
+
+		broker.router.ServeHTTP(recorder, request)
+
+		if recorder.Code != expected {
+			t.Error(red(fmt.Sprintf("expected status %d for version %q, got %d", expected, header, recorder.Code)))
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/liveness", nil)
+	recorder := httptest.NewRecorder()
+
+	broker.router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Error(red("probes should not require a version"))
+	}
+}
+
+func Test_APIVersion_Features(t *testing.T) {
+	catalog, err := catalog.NewFromSerialized(def)
+
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	broker := NewBroker(catalog, &config.Config{}, nil, nil, helm.NewFake())
+
+	request := httptest.NewRequest(http.MethodGet, "/v2/catalog", nil)
+	request.Header.Set("X-Broker-API-Version", "2.13")
+	recorder := httptest.NewRecorder()
+
+	broker.router.ServeHTTP(recorder, request)
+
+	var response struct {
+		Services []map[string]interface{} `json:"services"`
+	}
+
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	if _, ok := response.Services[0]["instances_retrievable"]; ok {
+		t.Error(red("catalog of OSB 2.13 should not advertise instances_retrievable"))
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/v2/service_instances/instance-id", nil)
+	request.Header.Set("X-Broker-API-Version", "2.13")
+	recorder = httptest.NewRecorder()
+
+	broker.router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusPreconditionFailed {
+		t.Error(red(fmt.Sprintf("instance retrieval should require OSB 2.14, got %d", recorder.Code)))
+	}
+}
@@ -3,9 +3,12 @@ package catalog
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -19,6 +22,7 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/Masterminds/semver"
 	"github.com/Masterminds/sprig"
 	"github.com/aokoli/goutils"
 	"github.com/gofrs/uuid"
@@ -26,6 +30,7 @@ import (
 	"github.com/monostream/helmi/pkg/kubectl"
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 const (
@@ -33,6 +38,14 @@ const (
 	metadataServiceIdKey  = "helmiServiceId"
 	metadataPlanIdKey     = "helmiPlanId"
 	metadataIngressDomain = "helmiSvcDomain"
+	metadataParametersKey = "helmiParameters"
+	metadataParamsHashKey = "helmiParametersHash"
+	metadataCreatorKey    = "helmiCreator"
+	metadataOrgKey        = "helmiOrg"
+	metadataChartVersion  = "helmiChartVersion"
+	metadataContextKey    = "helmiContext"
+	metadataNamespaceKey  = "helmiNamespace"
+	metadataDashboardKey  = "helmiDashboardUrl"
 )
 
 type ServiceMap map[string]Service
@@ -51,6 +64,23 @@ type Service struct {
 	Chart        string `yaml:"chart"`
 	ChartVersion string `yaml:"chart-version"`
 
+	// optional, services are bindable unless declared otherwise
+	Bindable *bool `yaml:"bindable"`
+	// optional, derived from the plan-updates of the plans if not declared
+	PlanUpdateable *bool `yaml:"plan-updateable"`
+	// optional, releases of failed asynchronous provisions are purged unless declared otherwise
+	KeepFailedReleases *bool `yaml:"keep-failed-releases"`
+	// optional, instances are installed into a namespace of their own which is deleted with them
+	DedicatedNamespace *bool `yaml:"dedicated-namespace"`
+	// optional quota, default limits and network policy of dedicated namespaces
+	Namespace *NamespaceConfig `yaml:"namespace"`
+	// optional, updates which fail or do not become healthy in time are rolled back
+	AutoRollback *bool `yaml:"auto-rollback"`
+	// optional limits on the number of instances of all plans of the service
+	Quotas *Quotas `yaml:"quotas"`
+	// optional deadlines of operations by operation name, e.g. `provision: 10m`
+	Timeouts map[string]string `yaml:"timeouts"`
+
 	Plans []Plan `yaml:"plans"`
 
 	valuesTemplate      *template.Template
@@ -59,6 +89,9 @@ type Service struct {
 
 type InputParameterSchema struct {
 	Parameters map[string]interface{} `yaml:"parameters"`
+
+	// set if the parameters are not valid JSON schema
+	invalid bool
 }
 
 type ServiceInstanceSchema struct {
@@ -87,12 +120,86 @@ type Plan struct {
 
 	UserCredentials map[string]interface{} `yaml:"user-credentials"`
 	Schemas         *Schemas               `yaml:"schemas"`
+
+	// ids or names of the plans an instance of this plan can be updated to
+	PlanUpdates []string `yaml:"plan-updates"`
+
+	// optional, plans are free and inherit bindable and plan-updateable from the service unless declared otherwise
+	Free                   *bool             `yaml:"free"`
+	Bindable               *bool             `yaml:"bindable"`
+	PlanUpdateable         *bool             `yaml:"plan-updateable"`
+	MaximumPollingDuration int               `yaml:"maximum-polling-duration"`
+	MaintenanceInfo        *MaintenanceInfo  `yaml:"maintenance-info"`
+	KeepFailedReleases     *bool             `yaml:"keep-failed-releases"`
+	DedicatedNamespace     *bool             `yaml:"dedicated-namespace"`
+	AutoRollback           *bool             `yaml:"auto-rollback"`
+	Timeouts               map[string]string `yaml:"timeouts"`
+	// optional limits on the number of instances of the plan
+	Quotas *Quotas `yaml:"quotas"`
+	// optional quota, default limits and network policy of the dedicated namespaces of the plan
+	Namespace *NamespaceConfig `yaml:"namespace"`
+}
+
+// Resources of the dedicated namespace of an instance
+type NamespaceConfig struct {
+	// hard limits of the resource quota, e.g. `requests.cpu: 4`
+	ResourceQuota map[string]string `yaml:"resource-quota"`
+	LimitRanges   []LimitRange      `yaml:"limit-ranges"`
+	// denies ingress from other namespaces, charts bring their own NetworkPolicies for what they expose
+	DefaultDenyNetworkPolicy bool `yaml:"default-deny-network-policy"`
+}
+
+type LimitRange struct {
+	// Container, Pod or PersistentVolumeClaim
+	Type           string            `yaml:"type"`
+	Default        map[string]string `yaml:"default"`
+	DefaultRequest map[string]string `yaml:"default-request"`
+	Max            map[string]string `yaml:"max"`
+	Min            map[string]string `yaml:"min"`
+}
+
+// Maximum numbers of instances, zero means unlimited
+type Quotas struct {
+	Instances             int `yaml:"instances"`
+	InstancesPerNamespace int `yaml:"instances-per-namespace"`
+	InstancesPerOrg       int `yaml:"instances-per-org"`
+}
+
+type MaintenanceInfo struct {
+	// semantic version of the maintenance applied to instances of the plan
+	Version     string `yaml:"version"`
+	Description string `yaml:"description"`
 }
 
 type Release struct {
 	UserCredentials map[string]interface{}
 	HealthCheckURLs []string
 	DashboardURL    *string
+	Binding         *BindingSection
+}
+
+// Optional section of the credentials template to create credentials per binding
+type BindingSection struct {
+	// rendered once per binding and kept until the binding is deleted
+	Credentials map[string]interface{} `yaml:"credentials"`
+
+	// jobs run when the binding is created or deleted
+	Create *BindingJob `yaml:"create"`
+	Delete *BindingJob `yaml:"delete"`
+}
+
+type BindingJob struct {
+	Image   string   `yaml:"image"`
+	Command []string `yaml:"command"`
+	Args    []string `yaml:"args"`
+}
+
+// Binding available as `.Binding` in the credentials template
+type Binding struct {
+	Id          string
+	AppGuid     string
+	Parameters  map[string]interface{}
+	Credentials map[string]interface{}
 }
 
 // Parses serialized byte array
@@ -108,8 +215,9 @@ func NewFromSerialized(serializedCatalog []byte) (*Catalog, error) {
 	return &c, nil
 }
 
-// Parses any catalog format: local directories, local zip archives or zip archive urls
-func New(dirOrZipOrZipUrl string, updateInterval time.Duration) (*Catalog, error) {
+// Parses any catalog format: local directories, local zip archives or zip archive urls.
+// The helm repositories are updated together with the catalog.
+func New(dirOrZipOrZipUrl string, updateInterval time.Duration, helmClient helm.Client) (*Catalog, error) {
 	serviceMap, err := parseAny(dirOrZipOrZipUrl)
 	if err != nil {
 		return nil, err
@@ -123,7 +231,7 @@ func New(dirOrZipOrZipUrl string, updateInterval time.Duration) (*Catalog, error
 		for {
 			time.Sleep(updateInterval)
 
-			err := helm.RepoUpdate()
+			err := helmClient.RepoUpdate(context.Background())
 			if err != nil {
 				log.Printf("helm repo update failed: %s", err)
 			}
@@ -276,6 +384,18 @@ func addServiceYaml(services ServiceMap, input []byte, file string) error {
 		return fmt.Errorf("failed to parse service definition: %s: %s", file, err)
 	}
 
+	err = validatePlanUpdates(&s.Service)
+	if err != nil {
+		return fmt.Errorf("invalid service definition: %s: %s", file, err)
+	}
+
+	ignoreInvalidSchemas(&s.Service)
+
+	err = validatePlanFlags(&s.Service)
+	if err != nil {
+		return fmt.Errorf("invalid service definition: %s: %s", file, err)
+	}
+
 	fMap := templateFuncMap()
 	valuesTemplate, valuesErr := template.New("values").Funcs(fMap).Parse(string(documents[1]))
 	if valuesErr != nil {
@@ -309,6 +429,139 @@ func fixSchemaMaps(s *struct{ Service }) {
 	s.Plans = updatedPlans
 }
 
+func validatePlanUpdates(s *Service) error {
+	for _, p := range s.Plans {
+		for _, target := range p.PlanUpdates {
+			targetPlan := s.findPlan(target)
+			if targetPlan == nil {
+				return fmt.Errorf("plan %s can not be updated to unknown plan %s", p.Name, target)
+			}
+
+			// releases can not be moved to another namespace
+			if s.HasDedicatedNamespace(&p) != s.HasDedicatedNamespace(targetPlan) {
+				return fmt.Errorf("plan %s can not be updated to plan %s with a different dedicated-namespace", p.Name, target)
+			}
+		}
+	}
+	return nil
+}
+
+// Operations which may declare a deadline in the timeouts section of a service or plan
+var timeoutOperations = map[string]bool{
+	"provision":   true,
+	"update":      true,
+	"deprovision": true,
+	"bind":        true,
+	"unbind":      true,
+}
+
+func validateTimeouts(name string, timeouts map[string]string) error {
+	for operation, value := range timeouts {
+		if !timeoutOperations[operation] {
+			return fmt.Errorf("%s declares a timeout for unknown operation %s", name, operation)
+		}
+
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("%s has an invalid %s timeout %s", name, operation, value)
+		}
+	}
+	return nil
+}
+
+func validateQuotas(name string, quotas *Quotas) error {
+	if quotas != nil && (quotas.Instances < 0 || quotas.InstancesPerNamespace < 0 || quotas.InstancesPerOrg < 0) {
+		return fmt.Errorf("%s has a negative quota", name)
+	}
+	return nil
+}
+
+var limitRangeTypes = map[string]bool{
+	"Container":             true,
+	"Pod":                   true,
+	"PersistentVolumeClaim": true,
+}
+
+func validateNamespace(name string, namespace *NamespaceConfig) error {
+	if namespace == nil {
+		return nil
+	}
+
+	resources := []map[string]string{namespace.ResourceQuota}
+	for _, limitRange := range namespace.LimitRanges {
+		if !limitRangeTypes[limitRange.Type] {
+			return fmt.Errorf("%s declares a limit range of unknown type %s", name, limitRange.Type)
+		}
+		resources = append(resources, limitRange.Default, limitRange.DefaultRequest, limitRange.Max, limitRange.Min)
+	}
+
+	for _, values := range resources {
+		for resourceName, value := range values {
+			if _, err := resource.ParseQuantity(value); err != nil {
+				return fmt.Errorf("%s has an invalid quantity %s of %s", name, value, resourceName)
+			}
+		}
+	}
+	return nil
+}
+
+func validatePlanFlags(s *Service) error {
+	err := validateTimeouts("service "+s.Name, s.Timeouts)
+	if err != nil {
+		return err
+	}
+
+	err = validateQuotas("service "+s.Name, s.Quotas)
+	if err != nil {
+		return err
+	}
+
+	err = validateNamespace("service "+s.Name, s.Namespace)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range s.Plans {
+		if p.MaximumPollingDuration < 0 {
+			return fmt.Errorf("plan %s has a negative maximum-polling-duration", p.Name)
+		}
+
+		if p.MaintenanceInfo != nil {
+			if len(p.MaintenanceInfo.Version) == 0 {
+				return fmt.Errorf("plan %s declares maintenance-info without a version", p.Name)
+			}
+
+			if _, err := semver.NewVersion(p.MaintenanceInfo.Version); err != nil {
+				return fmt.Errorf("plan %s has an invalid maintenance-info version %s: %s", p.Name, p.MaintenanceInfo.Version, err)
+			}
+		}
+
+		if len(p.PlanUpdates) > 0 && !s.IsPlanUpdatable(&p) {
+			return fmt.Errorf("plan %s declares plan-updates but is not plan-updateable", p.Name)
+		}
+
+		err = validateTimeouts("plan "+p.Name, p.Timeouts)
+		if err != nil {
+			return err
+		}
+
+		err = validateQuotas("plan "+p.Name, p.Quotas)
+		if err != nil {
+			return err
+		}
+
+		if p.Namespace != nil && !s.HasDedicatedNamespace(&p) {
+			return fmt.Errorf("plan %s declares a namespace but no dedicated-namespace", p.Name)
+		}
+
+		err = validateNamespace("plan "+p.Name, p.Namespace)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *Catalog) Services() ServiceMap {
 	return c.services.Load().(ServiceMap)
 }
@@ -322,6 +575,9 @@ func (c *Catalog) Service(id string) *Service {
 }
 
 func (s *Service) Plan(id string) (*Plan, error) {
+	if s == nil {
+		return nil, fmt.Errorf("Service for plan with id %s could not be found", id)
+	}
 	for _, p := range s.Plans {
 		if strings.EqualFold(p.Id, id) {
 			return &p, nil
@@ -330,6 +586,110 @@ func (s *Service) Plan(id string) (*Plan, error) {
 	return nil, fmt.Errorf("Plan with id %s could not be found", id)
 }
 
+// Returns the declared plan-updateable flag or true if at least one plan of the service declares allowed plan updates
+func (s *Service) PlanUpdatable() bool {
+	if s.PlanUpdateable != nil {
+		return *s.PlanUpdateable
+	}
+
+	for _, p := range s.Plans {
+		if len(p.PlanUpdates) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if instances of the plan may be moved to other plans, the flag of the plan takes precedence
+func (s *Service) IsPlanUpdatable(p *Plan) bool {
+	if p.PlanUpdateable != nil {
+		return *p.PlanUpdateable
+	}
+	return s.PlanUpdatable()
+}
+
+// Returns true unless the service is declared as not bindable
+func (s *Service) IsBindable() bool {
+	return s.Bindable == nil || *s.Bindable
+}
+
+// Returns true if instances of the plan can be bound, the flag of the plan takes precedence
+func (s *Service) IsPlanBindable(p *Plan) bool {
+	if p.Bindable != nil {
+		return *p.Bindable
+	}
+	return s.IsBindable()
+}
+
+// Returns true if the release of a failed asynchronous provision should be kept for debugging, the flag of the plan takes precedence
+func (s *Service) KeepsFailedReleases(p *Plan) bool {
+	if p.KeepFailedReleases != nil {
+		return *p.KeepFailedReleases
+	}
+	return s.KeepFailedReleases != nil && *s.KeepFailedReleases
+}
+
+// Returns true if each instance of the plan gets a namespace of its own, the flag of the plan takes precedence
+func (s *Service) HasDedicatedNamespace(p *Plan) bool {
+	if p.DedicatedNamespace != nil {
+		return *p.DedicatedNamespace
+	}
+	return s.DedicatedNamespace != nil && *s.DedicatedNamespace
+}
+
+// Returns the resources of the dedicated namespaces of the plan, the namespace of the plan takes precedence
+func (s *Service) DedicatedNamespaceConfig(p *Plan) NamespaceConfig {
+	for _, namespace := range []*NamespaceConfig{p.Namespace, s.Namespace} {
+		if namespace != nil {
+			return *namespace
+		}
+	}
+	return NamespaceConfig{}
+}
+
+// Returns true if failed updates of instances of the plan are rolled back, the flag of the plan takes precedence
+func (s *Service) HasAutoRollback(p *Plan) bool {
+	if p.AutoRollback != nil {
+		return *p.AutoRollback
+	}
+	return s.AutoRollback != nil && *s.AutoRollback
+}
+
+// Returns the deadline declared for an operation on instances of the plan, the timeout of the plan takes precedence
+func (s *Service) OperationTimeout(p *Plan, operation string) (time.Duration, bool) {
+	for _, timeouts := range []map[string]string{p.Timeouts, s.Timeouts} {
+		if value, ok := timeouts[operation]; ok {
+			timeout, err := time.ParseDuration(value)
+			return timeout, err == nil
+		}
+	}
+	return 0, false
+}
+
+// Returns true unless the plan is declared as not free
+func (p *Plan) IsFree() bool {
+	return p.Free == nil || *p.Free
+}
+
+func (s *Service) findPlan(idOrName string) *Plan {
+	for _, p := range s.Plans {
+		if strings.EqualFold(p.Id, idOrName) || p.Name == idOrName {
+			return &p
+		}
+	}
+	return nil
+}
+
+// Returns true if instances of this plan may be moved to the target plan
+func (p *Plan) IsUpdatableTo(target *Plan) bool {
+	for _, idOrName := range p.PlanUpdates {
+		if strings.EqualFold(idOrName, target.Id) || idOrName == target.Name {
+			return true
+		}
+	}
+	return false
+}
+
 func templateFuncMap() template.FuncMap {
 	f := sprig.TxtFuncMap()
 
@@ -429,14 +789,43 @@ func interfaceMapToStringMap(m map[interface{}]interface{}) map[string]interface
 }
 
 func valueToStringMap(value interface{}) interface{} {
-	if valMap, ok := value.(map[interface{}]interface{}); ok {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
 		// convert values recursively
-		return interfaceMapToStringMap(valMap)
+		return interfaceMapToStringMap(v)
+	case []interface{}:
+		// lists may contain maps as well, e.g. `oneOf` in schemas
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = valueToStringMap(item)
+		}
+		return result
 	}
 
 	return value
 }
 
+// Returns the hash of parameters, empty for no parameters. Parameters read from a release or secret have the same hash
+// as the ones of a request, numbers are hashed by value regardless of their type.
+func ParametersHash(parameters map[string]interface{}) string {
+	if len(parameters) == 0 {
+		return ""
+	}
+
+	// maps are marshalled with sorted keys
+	data, err := json.Marshal(toStringMap(parameters))
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// Merges the parameters of an update request into the parameters used so far
+func MergeParameters(current map[string]interface{}, update map[string]interface{}) map[string]interface{} {
+	return mergeMaps(toStringMap(current), update)
+}
+
 // Merges a list of unmarshalled yaml maps into a single string-index map.
 // Conflicting values are merged recursively if they are maps, and overwritten if they are of any other type.
 func mergeMaps(maps ...map[string]interface{}) map[string]interface{} {
@@ -470,6 +859,7 @@ type chartValueVars struct {
 	Plan       *Plan
 	Parameters map[string]interface{}
 	Context    map[string]interface{}
+	Values     valueVars
 	Instance   *instanceInfo
 	Release    *releaseInfo
 	Cluster    *clusterVars
@@ -479,6 +869,23 @@ type Metadata struct {
 	ServiceId     string
 	PlanId        string
 	IngressDomain string
+	// parameters stored in the values by older helmi versions, newer ones keep them out of the release
+	Parameters map[string]interface{}
+	// hash of the parameters the revision was installed with, empty without parameters
+	ParametersHash string
+	// originating identity of the provision request, nil if the platform did not send one
+	Creator map[string]interface{}
+	// guid of the Cloud Foundry org of the instance, empty for other platforms
+	Org string
+	// version of the chart the revision was installed with, empty for releases of older helmi versions
+	ChartVersion string
+	// context of the platform the instance was provisioned or last updated with, nil if none was sent
+	Context map[string]interface{}
+	// dashboard URL rendered when the instance was provisioned, empty for releases of older helmi versions
+	DashboardURL string
+	// namespace requested for the instance, which is not the one of a dedicated namespace; empty for releases of
+	// older helmi versions
+	Namespace string
 }
 
 func ExtractMetadata(rawHelmValues map[string]interface{}) (Metadata, error) {
@@ -492,6 +899,14 @@ func ExtractMetadata(rawHelmValues map[string]interface{}) (Metadata, error) {
 	serviceId, hasServiceId := metadataMap[metadataServiceIdKey].(string)
 	planId, hasPlanId := metadataMap[metadataPlanIdKey].(string)
 	ingressDomain, _ := metadataMap[metadataIngressDomain].(string)
+	parameters, _ := metadataMap[metadataParametersKey].(map[string]interface{})
+	parametersHash, _ := metadataMap[metadataParamsHashKey].(string)
+	creator, _ := metadataMap[metadataCreatorKey].(map[string]interface{})
+	org, _ := metadataMap[metadataOrgKey].(string)
+	chartVersion, _ := metadataMap[metadataChartVersion].(string)
+	contextValues, _ := metadataMap[metadataContextKey].(map[string]interface{})
+	namespace, _ := metadataMap[metadataNamespaceKey].(string)
+	dashboardURL, _ := metadataMap[metadataDashboardKey].(string)
 
 	if !(hasServiceId && hasPlanId) {
 		return Metadata{}, errors.New("incomplete helmi metadata in helm values")
@@ -503,19 +918,44 @@ func ExtractMetadata(rawHelmValues map[string]interface{}) (Metadata, error) {
 	}
 
 	metadata := Metadata{
-		ServiceId:     serviceId,
-		PlanId:        planId,
-		IngressDomain: ingressDomain,
+		ServiceId:      serviceId,
+		PlanId:         planId,
+		IngressDomain:  ingressDomain,
+		Parameters:     parameters,
+		ParametersHash: parametersHash,
+		Creator:        creator,
+		Org:            org,
+		ChartVersion:   chartVersion,
+		Context:        contextValues,
+		Namespace:      namespace,
+		DashboardURL:   dashboardURL,
 	}
 
 	return metadata, nil
 }
 
-func (s *Service) getChartValueSection(p *Plan, instanceId string, releaseName string, namespace kubectl.Namespace, params map[string]interface{}, contextValues map[string]interface{}) (*bytes.Buffer, error) {
+// Records the identity which created the instance in the metadata of chart values
+func SetCreator(values map[string]interface{}, creator map[string]interface{}) {
+	metadataMap, ok := values[metadataKey].(map[string]interface{})
+	if ok && creator != nil {
+		metadataMap[metadataCreatorKey] = creator
+	}
+}
+
+// Records the namespace requested for the instance in the metadata of chart values, instances are counted per
+// requested namespace for quotas
+func SetNamespace(values map[string]interface{}, namespace string) {
+	metadataMap, ok := values[metadataKey].(map[string]interface{})
+	if ok && len(namespace) > 0 {
+		metadataMap[metadataNamespaceKey] = namespace
+	}
+}
+
+func (s *Service) getChartValueSection(ctx context.Context, p *Plan, instanceId string, releaseName string, namespace kubectl.Namespace, params map[string]interface{}, contextValues map[string]interface{}, currentValues map[string]interface{}) (*bytes.Buffer, error) {
 	b := new(bytes.Buffer)
 
 	// since Cluster.Address and Cluster.Hostname are never used in the ChartValues, errors here aren't handled
-	nodes, _ := kubectl.GetNodes()
+	nodes, _ := kubectl.GetNodes(ctx)
 
 	// define custom name if parameter was passed
 	hostname := releaseName
@@ -533,6 +973,7 @@ func (s *Service) getChartValueSection(p *Plan, instanceId string, releaseName s
 		},
 		Parameters: params,
 		Context:    contextValues,
+		Values:     currentValues,
 		Cluster: &clusterVars{
 			Address:       extractAddress(nodes),
 			Hostname:      extractHostname(nodes),
@@ -547,8 +988,8 @@ func (s *Service) getChartValueSection(p *Plan, instanceId string, releaseName s
 	return b, nil
 }
 
-func (s *Service) DashboardURL(p *Plan, instanceId string, releaseName string, namespace kubectl.Namespace, params map[string]interface{}, contextValues map[string]interface{}) (string, error) {
-	b, err := s.getChartValueSection(p, instanceId, releaseName, namespace, params, contextValues)
+func (s *Service) DashboardURL(ctx context.Context, p *Plan, instanceId string, releaseName string, namespace kubectl.Namespace, params map[string]interface{}, contextValues map[string]interface{}) (string, error) {
+	b, err := s.getChartValueSection(ctx, p, instanceId, releaseName, namespace, params, contextValues, valueVars{})
 
 	if err != nil {
 		return "", err
@@ -567,8 +1008,18 @@ func (s *Service) DashboardURL(p *Plan, instanceId string, releaseName string, n
 	return v.DashboardURL, nil
 }
 
-func (s *Service) ChartValues(p *Plan, instanceId string, releaseName string, namespace kubectl.Namespace, params map[string]interface{}, contextValues map[string]interface{}) (map[string]interface{}, error) {
-	b, err := s.getChartValueSection(p, instanceId, releaseName, namespace, params, contextValues)
+func (s *Service) ChartValues(ctx context.Context, p *Plan, instanceId string, releaseName string, namespace kubectl.Namespace, params map[string]interface{}, contextValues map[string]interface{}) (map[string]interface{}, error) {
+	return s.chartValues(ctx, p, instanceId, releaseName, namespace, params, contextValues, valueVars{})
+}
+
+// Renders the chart values of an existing release for the given plan.
+// The values of the running release are available as `.Values` in the template.
+func (s *Service) UpdatedChartValues(ctx context.Context, p *Plan, instanceId string, releaseName string, namespace kubectl.Namespace, params map[string]interface{}, contextValues map[string]interface{}, currentValues map[string]interface{}) (map[string]interface{}, error) {
+	return s.chartValues(ctx, p, instanceId, releaseName, namespace, params, contextValues, toStringMap(currentValues))
+}
+
+func (s *Service) chartValues(ctx context.Context, p *Plan, instanceId string, releaseName string, namespace kubectl.Namespace, params map[string]interface{}, contextValues map[string]interface{}, currentValues map[string]interface{}) (map[string]interface{}, error) {
+	b, err := s.getChartValueSection(ctx, p, instanceId, releaseName, namespace, params, contextValues, currentValues)
 
 	if err != nil {
 		return nil, err
@@ -584,12 +1035,64 @@ func (s *Service) ChartValues(p *Plan, instanceId string, releaseName string, na
 		return nil, err
 	}
 
+	metadataValues := map[string]interface{}{
+		metadataServiceIdKey:  s.Id,
+		metadataPlanIdKey:     p.Id,
+		metadataIngressDomain: namespace.IngressDomain,
+	}
+
+	// the parameters may contain secrets and are kept out of the release, their hash identifies them
+	if hash := ParametersHash(params); len(hash) > 0 {
+		metadataValues[metadataParamsHashKey] = hash
+	}
+
+	// the dashboard URL of the instance does not change, it is returned without rendering the values again
+	if v.DashboardURL != nil && len(*v.DashboardURL) > 0 {
+		metadataValues[metadataDashboardKey] = *v.DashboardURL
+	}
+
+	// requests without a context, like deprovisions, are audited with the context of the instance
+	if len(contextValues) > 0 {
+		metadataValues[metadataContextKey] = contextValues
+	}
+
+	org, _ := contextValues["organization_guid"].(string)
+
+	// updates keep the creator and org of the instance, and its context unless the platform sent a new one
+	if current, err := ExtractMetadata(currentValues); err == nil {
+		if current.Creator != nil {
+			metadataValues[metadataCreatorKey] = current.Creator
+		}
+		if len(current.Org) > 0 {
+			org = current.Org
+		}
+		if len(contextValues) == 0 && current.Context != nil {
+			metadataValues[metadataContextKey] = current.Context
+		}
+		if len(current.Namespace) > 0 {
+			metadataValues[metadataNamespaceKey] = current.Namespace
+		}
+		if len(current.DashboardURL) > 0 {
+			metadataValues[metadataDashboardKey] = current.DashboardURL
+		}
+	}
+
+	// instances are counted per org for quotas
+	if len(org) > 0 {
+		metadataValues[metadataOrgKey] = org
+	}
+
+	// revisions are listed with the chart version they were installed with
+	chartVersion := s.ChartVersion
+	if len(p.ChartVersion) > 0 {
+		chartVersion = p.ChartVersion
+	}
+	if len(chartVersion) > 0 {
+		metadataValues[metadataChartVersion] = chartVersion
+	}
+
 	metadata := map[string]interface{}{
-		metadataKey: map[string]interface{}{
-			metadataServiceIdKey:  s.Id,
-			metadataPlanIdKey:     p.Id,
-			metadataIngressDomain: namespace.IngressDomain,
-		},
+		metadataKey: metadataValues,
 	}
 
 	serviceValues := toStringMap(v.ChartValues)
@@ -606,6 +1109,7 @@ type credentialVars struct {
 	Release  releaseVars
 	Cluster  *clusterVars
 	Services *servicesVars
+	Binding  Binding
 }
 
 type valueVars map[string]interface{}
@@ -751,6 +1255,11 @@ func extractHostname(kubernetesNodes []kubectl.Node) string {
 }
 
 func (s *Service) ReleaseSection(plan *Plan, kubernetesNodes []kubectl.Node, helmStatus helm.Status, values map[string]interface{}) (*Release, error) {
+	return s.BindingReleaseSection(plan, kubernetesNodes, helmStatus, values, Binding{})
+}
+
+// Renders the credentials template for a binding, which is available as `.Binding` in the template
+func (s *Service) BindingReleaseSection(plan *Plan, kubernetesNodes []kubectl.Node, helmStatus helm.Status, values map[string]interface{}, binding Binding) (*Release, error) {
 	metadata, err := ExtractMetadata(values)
 	if err != nil {
 		return nil, err
@@ -773,6 +1282,7 @@ func (s *Service) ReleaseSection(plan *Plan, kubernetesNodes []kubectl.Node, hel
 			nodes:    kubernetesNodes,
 			services: helmStatus.Services,
 		},
+		Binding: binding,
 	}
 
 	b := new(bytes.Buffer)
@@ -784,11 +1294,12 @@ func (s *Service) ReleaseSection(plan *Plan, kubernetesNodes []kubectl.Node, hel
 	var section struct {
 		UserCredentials map[string]interface{} `yaml:"user-credentials"`
 		HealthCheckURLs []string               `yaml:"health-checks"`
+		Binding         *BindingSection        `yaml:"binding"`
 	}
 	err = yaml.UnmarshalStrict(b.Bytes(), &section)
 
 	if err != nil {
-		errWithMessage := fmt.Errorf("Could not deserialize %s into a map.\nIs the user-credentials section defined correctly as YAML map and health-checks as YAML list and that you have no extra fields there?\nError: %s", b, err)
+		errWithMessage := fmt.Errorf("Could not deserialize %s into a map.\nIs the user-credentials section defined correctly as YAML map, health-checks as YAML list, binding as YAML map and that you have no extra fields there?\nError: %s", b, err)
 
 		return nil, errWithMessage
 	}
@@ -797,9 +1308,14 @@ func (s *Service) ReleaseSection(plan *Plan, kubernetesNodes []kubectl.Node, hel
 	planCreds := toStringMap(plan.UserCredentials)
 	credentials := mergeMaps(serviceCreds, planCreds)
 
+	if section.Binding != nil {
+		section.Binding.Credentials = toStringMap(section.Binding.Credentials)
+	}
+
 	release := &Release{
 		UserCredentials: credentials,
 		HealthCheckURLs: section.HealthCheckURLs,
+		Binding:         section.Binding,
 	}
 
 	return release, nil
@@ -1,6 +1,7 @@
 package catalog
 
 import (
+	"context"
 	"fmt"
 	"github.com/monostream/helmi/pkg/helm"
 	"github.com/monostream/helmi/pkg/kubectl"
@@ -8,6 +9,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 var valueFromHelm = []byte(`
@@ -58,9 +60,9 @@ service:
             $schema: http://json-schema.org/draft-04/schema#
             type: object
             properties:
-            billing-account:
-              description: Billing account number used to charge use of shared fake server.
-              type: string
+              billing-account:
+                description: Billing account number used to charge use of shared fake server.
+                type: string
       service-binding:
         create:
           parameters:
@@ -202,6 +204,88 @@ some-wrong-name:
     plan_key: "{{ .Values.baz }}"
 `)
 
+var defPlanUpdates = []byte(`---
+service:
+  _id: 12345
+  _name: "test_service"
+  description: "service_description"
+  chart: service_chart
+  chart-version: 1.2.3
+  plans:
+  -
+    _id: small
+    _name: small_plan
+    description: "small plan"
+    plan-updates:
+    - large_plan
+    chart-values:
+      size: small
+  -
+    _id: large
+    _name: large_plan
+    description: "large plan"
+    chart-values:
+      size: large
+---
+chart-values:
+    password: "{{ default generatePassword .Values.password }}"
+---
+user-credentials:
+    password: "{{ .Values.password }}"
+`)
+
+var defInvalidPlanUpdates = []byte(`---
+service:
+  _id: 12345
+  _name: "test_service"
+  description: "service_description"
+  chart: service_chart
+  chart-version: 1.2.3
+  plans:
+  -
+    _id: small
+    _name: small_plan
+    description: "small plan"
+    plan-updates:
+    - missing_plan
+---
+chart-values: {}
+---
+user-credentials: {}
+`)
+
+var defBinding = []byte(`---
+service:
+  _id: 12345
+  _name: "test_service"
+  description: "service_description"
+  chart: service_chart
+  chart-version: 1.2.3
+  plans:
+  -
+    _id: 67890
+    _name: test_plan
+    description: "plan_description"
+---
+chart-values:
+    adminPassword: secret
+---
+user-credentials:
+    username: "{{ .Binding.Credentials.username }}"
+    app: "{{ .Binding.AppGuid }}"
+    database: "{{ .Binding.Parameters.database }}"
+binding:
+  credentials:
+    username: "{{ .Binding.Id }}-user"
+  create:
+    image: postgres
+    command: ["psql", "-c", "CREATE USER $(username)"]
+    args: ["{{ .Values.adminPassword }}"]
+  delete:
+    image: postgres
+    command: ["psql", "-c", "DROP USER $(username)"]
+`)
+
 var nodes = []kubectl.Node{
 	{
 		Name: "test_node",
@@ -368,7 +452,7 @@ func Test_GetDashboardUrl(t *testing.T) {
 		t.Error(red("service plan was not found"))
 	}
 
-	url, err := s.DashboardURL(p, "instance-id", "RELEASE-NAME", ns, nil, nil)
+	url, err := s.DashboardURL(context.Background(), p, "instance-id", "RELEASE-NAME", ns, nil, nil)
 	if err != nil {
 		t.Error(red(err.Error()))
 	}
@@ -384,6 +468,40 @@ func Test_GetDashboardUrl(t *testing.T) {
 	}
 }
 
+func Test_DashboardUrlInMetadata(t *testing.T) {
+	ns := kubectl.Namespace{
+		Name:          "testnamespace",
+		IngressDomain: "test.ingress.domain",
+	}
+
+	c := getCatalog(t)
+	s := c.Service("12345")
+	p, _ := s.Plan("67890")
+
+	values, err := s.ChartValues(context.Background(), p, "instance-id", "RELEASE-NAME", ns, nil, nil)
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	metadata, _ := ExtractMetadata(values)
+	if metadata.DashboardURL != "test.ingress.domain/dashboard" {
+		t.Error(red(fmt.Sprintf("expected rendered dashboard url in metadata, got %v", metadata.DashboardURL)))
+	}
+
+	// the url of the instance is kept when it is updated in another ingress domain
+	ns.IngressDomain = "other.ingress.domain"
+
+	updated, err := s.UpdatedChartValues(context.Background(), p, "instance-id", "RELEASE-NAME", ns, nil, nil, values)
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	metadata, _ = ExtractMetadata(updated)
+	if metadata.DashboardURL != "test.ingress.domain/dashboard" {
+		t.Error(red(fmt.Sprintf("dashboard url was not kept on update, got %v", metadata.DashboardURL)))
+	}
+}
+
 func Test_GetChartValues(t *testing.T) {
 	ns := kubectl.Namespace{
 		Name:          "testnamespace",
@@ -398,7 +516,7 @@ func Test_GetChartValues(t *testing.T) {
 		t.Error(red("service plan was not found"))
 	}
 
-	values, err := s.ChartValues(p, "instance-id", "RELEASE-NAME", ns, nil, nil)
+	values, err := s.ChartValues(context.Background(), p, "instance-id", "RELEASE-NAME", ns, nil, nil)
 	if err != nil {
 		t.Error(red(err.Error()))
 	}
@@ -418,6 +536,8 @@ func Test_GetChartValues(t *testing.T) {
 			metadataServiceIdKey:  s.Id,
 			metadataPlanIdKey:     p.Id,
 			metadataIngressDomain: ns.IngressDomain,
+			metadataChartVersion:  p.ChartVersion,
+			metadataDashboardKey:  "test.ingress.domain/dashboard",
 		},
 	}
 
@@ -440,7 +560,7 @@ func Test_GetUserCredentials(t *testing.T) {
 		t.Error(red("service plan was not found"))
 	}
 
-	values, err := s.ChartValues(p, "instance-id", "RELEASE-NAME", ns, nil, nil)
+	values, err := s.ChartValues(context.Background(), p, "instance-id", "RELEASE-NAME", ns, nil, nil)
 	if err != nil {
 		t.Error(red(err.Error()))
 	}
@@ -489,7 +609,7 @@ func Test_GetUserCredentialsWrongCredType(t *testing.T) {
 		t.Error(red(err.Error()))
 	}
 
-	values, err := s.ChartValues(p, "instance-id", "RELEASE-NAME", ns, nil, nil)
+	values, err := s.ChartValues(context.Background(), p, "instance-id", "RELEASE-NAME", ns, nil, nil)
 	if err != nil {
 		t.Error(red(err.Error()))
 	}
@@ -518,7 +638,7 @@ func Test_GetUserCredentialsWrongCredField(t *testing.T) {
 		t.Error(red(err.Error()))
 	}
 
-	values, err := s.ChartValues(p, "instance-id", "RELEASE-NAME", ns, nil, nil)
+	values, err := s.ChartValues(context.Background(), p, "instance-id", "RELEASE-NAME", ns, nil, nil)
 	if err != nil {
 		t.Error(red(err.Error()))
 	}
@@ -596,3 +716,437 @@ func Test_ExtractMetadata(t *testing.T) {
 		t.Error("PlanID doesn't match: ", metadata.PlanId)
 	}
 }
+
+func Test_PlanUpdates(t *testing.T) {
+	c := deserializeCatalog(t, defPlanUpdates)
+	s := c.Service("12345")
+
+	if !s.PlanUpdatable() {
+		t.Error(red("service with plan updates should be plan updatable"))
+	}
+
+	small, _ := s.Plan("small")
+	large, _ := s.Plan("large")
+
+	if !small.IsUpdatableTo(large) {
+		t.Error(red("small plan should be updatable to large plan"))
+	}
+
+	if large.IsUpdatableTo(small) {
+		t.Error(red("large plan should not be updatable to small plan"))
+	}
+
+	c = getCatalog(t)
+	if c.Service("12345").PlanUpdatable() {
+		t.Error(red("service without plan updates should not be plan updatable"))
+	}
+}
+
+func Test_InvalidPlanUpdates(t *testing.T) {
+	_, err := NewFromSerialized(defInvalidPlanUpdates)
+
+	if err == nil {
+		t.Error(red("plan update to unknown plan should have failed"))
+	}
+
+	_, err = NewFromSerialized([]byte(strings.Replace(string(defPlanUpdates), `    _name: large_plan
+`, `    _name: large_plan
+    dedicated-namespace: true
+`, 1)))
+
+	if err == nil {
+		t.Error(red("plan update to a plan with a different dedicated-namespace should have failed"))
+	}
+}
+
+func Test_PlanFlags(t *testing.T) {
+	c := getCatalog(t)
+	s := c.Service("12345")
+	p, _ := s.Plan("67890")
+
+	if !s.IsBindable() || !s.IsPlanBindable(p) || !p.IsFree() {
+		t.Error(red("services and plans should be bindable and free by default"))
+	}
+
+	notBindable := false
+	s.Bindable = &notBindable
+	if s.IsPlanBindable(p) {
+		t.Error(red("plans should inherit bindable from the service"))
+	}
+
+	bindable := true
+	p.Bindable = &bindable
+	if !s.IsPlanBindable(p) {
+		t.Error(red("bindable of the plan should take precedence"))
+	}
+
+	if s.KeepsFailedReleases(p) {
+		t.Error(red("failed releases should be purged by default"))
+	}
+
+	keep := true
+	s.KeepFailedReleases = &keep
+	if !s.KeepsFailedReleases(p) {
+		t.Error(red("plans should inherit keep-failed-releases from the service"))
+	}
+
+	if s.HasDedicatedNamespace(p) {
+		t.Error(red("instances should share the namespace by default"))
+	}
+
+	dedicated := true
+	s.DedicatedNamespace = &dedicated
+	if !s.HasDedicatedNamespace(p) {
+		t.Error(red("plans should inherit dedicated-namespace from the service"))
+	}
+
+	shared := false
+	p.DedicatedNamespace = &shared
+	if s.HasDedicatedNamespace(p) {
+		t.Error(red("dedicated-namespace of the plan should take precedence"))
+	}
+
+	if s.HasAutoRollback(p) {
+		t.Error(red("failed updates should not be rolled back by default"))
+	}
+
+	rollback := true
+	s.AutoRollback = &rollback
+	if !s.HasAutoRollback(p) {
+		t.Error(red("plans should inherit auto-rollback from the service"))
+	}
+
+	if namespace := s.DedicatedNamespaceConfig(p); namespace.ResourceQuota != nil || namespace.DefaultDenyNetworkPolicy {
+		t.Error(red("dedicated namespaces should have no quota and network policy by default"))
+	}
+
+	s.Namespace = &NamespaceConfig{ResourceQuota: map[string]string{"pods": "10"}}
+	if s.DedicatedNamespaceConfig(p).ResourceQuota["pods"] != "10" {
+		t.Error(red("plans should inherit the namespace from the service"))
+	}
+
+	p.Namespace = &NamespaceConfig{DefaultDenyNetworkPolicy: true}
+	if namespace := s.DedicatedNamespaceConfig(p); namespace.ResourceQuota != nil || !namespace.DefaultDenyNetworkPolicy {
+		t.Error(red("the namespace of the plan should take precedence"))
+	}
+}
+
+func Test_OperationTimeout(t *testing.T) {
+	c := getCatalog(t)
+	s := c.Service("12345")
+	p, _ := s.Plan("67890")
+
+	if _, ok := s.OperationTimeout(p, "provision"); ok {
+		t.Error(red("operations should not have a timeout by default"))
+	}
+
+	s.Timeouts = map[string]string{"provision": "10m", "bind": "1m"}
+	p.Timeouts = map[string]string{"provision": "20m"}
+
+	if timeout, _ := s.OperationTimeout(p, "provision"); timeout != time.Minute*20 {
+		t.Error(red("timeout of the plan should take precedence"))
+	}
+
+	if timeout, _ := s.OperationTimeout(p, "bind"); timeout != time.Minute {
+		t.Error(red("plans should inherit timeouts from the service"))
+	}
+}
+
+func Test_InvalidPlanFlags(t *testing.T) {
+	plans := map[string]string{
+		"negative polling duration": `
+    maximum-polling-duration: -1`,
+		"maintenance without version": `
+    maintenance-info:
+      description: "missing version"`,
+		"maintenance with invalid version": `
+    maintenance-info:
+      version: "not a version"`,
+		"plan updates of a plan which is not updateable": `
+    plan-updateable: false
+    plan-updates:
+    - small_plan`,
+		"timeout of an unknown operation": `
+    timeouts:
+      restart: 5m`,
+		"invalid timeout": `
+    timeouts:
+      provision: soon`,
+		"negative quota": `
+    quotas:
+      instances-per-org: -1`,
+		"namespace without dedicated namespace": `
+    namespace:
+      default-deny-network-policy: true`,
+		"invalid resource quota": `
+    dedicated-namespace: true
+    namespace:
+      resource-quota:
+        requests.cpu: lots`,
+		"limit range of an unknown type": `
+    dedicated-namespace: true
+    namespace:
+      limit-ranges:
+      - type: Node
+        max:
+          memory: 1Gi`,
+	}
+
+	for name, flags := range plans {
+		_, err := NewFromSerialized([]byte(`---
+service:
+  _id: 12345
+  _name: "test_service"
+  description: "service_description"
+  chart: service_chart
+  plans:
+  -
+    _id: small
+    _name: small_plan
+    description: "small plan"` + flags + `
+---
+chart-values: {}
+---
+user-credentials: {}
+`))
+
+		if err == nil {
+			t.Error(red("catalog with " + name + " should be rejected"))
+		}
+	}
+}
+
+func Test_UpdatedChartValues(t *testing.T) {
+	ns := kubectl.Namespace{
+		Name:          "testnamespace",
+		IngressDomain: "test.ingress.domain",
+	}
+
+	c := deserializeCatalog(t, defPlanUpdates)
+	s := c.Service("12345")
+	small, _ := s.Plan("small")
+	large, _ := s.Plan("large")
+
+	contextValues := map[string]interface{}{"platform": "cloudfoundry", "space_guid": "space"}
+
+	values, err := s.ChartValues(context.Background(), small, "instance-id", "RELEASE-NAME", ns, nil, contextValues)
+	if err != nil {
+		t.Error(red(err.Error()))
+		return
+	}
+
+	SetCreator(values, map[string]interface{}{"platform": "cloudfoundry"})
+	SetNamespace(values, "space")
+
+	updated, err := s.UpdatedChartValues(context.Background(), large, "instance-id", "RELEASE-NAME", ns, nil, nil, values)
+	if err != nil {
+		t.Error(red(err.Error()))
+		return
+	}
+
+	if updated["size"] != "large" {
+		t.Error(red(fmt.Sprintf("expected size large, got %v", updated["size"])))
+	}
+
+	if updated["password"] != values["password"] {
+		t.Error(red("generated password was not kept on update"))
+	}
+
+	metadata, err := ExtractMetadata(updated)
+	if err != nil {
+		t.Error(red(err.Error()))
+		return
+	}
+
+	if metadata.PlanId != "large" {
+		t.Error(red(fmt.Sprintf("expected plan id large in metadata, got %v", metadata.PlanId)))
+	}
+
+	if metadata.Creator["platform"] != "cloudfoundry" {
+		t.Error(red("creator was not kept on update"))
+	}
+
+	if metadata.Context["space_guid"] != "space" {
+		t.Error(red("context was not kept on update without one"))
+	}
+
+	if metadata.Namespace != "space" {
+		t.Error(red("requested namespace was not kept on update"))
+	}
+}
+
+func Test_ParametersInMetadata(t *testing.T) {
+	ns := kubectl.Namespace{
+		Name:          "testnamespace",
+		IngressDomain: "test.ingress.domain",
+	}
+
+	c := getCatalog(t)
+	s := c.Service("12345")
+	p, _ := s.Plan("67890")
+
+	params := map[string]interface{}{
+		"replicas": 2,
+		"nested": map[string]interface{}{
+			"a": "b",
+		},
+	}
+
+	values, err := s.ChartValues(context.Background(), p, "instance-id", "RELEASE-NAME", ns, params, nil)
+	if err != nil {
+		t.Error(red(err.Error()))
+		return
+	}
+
+	metadata, err := ExtractMetadata(values)
+	if err != nil {
+		t.Error(red(err.Error()))
+		return
+	}
+
+	// parameters may contain secrets and are kept out of the values
+	if metadata.Parameters != nil || metadata.ParametersHash != ParametersHash(params) {
+		t.Error(red("metadata should contain the hash of the parameters only"))
+	}
+
+	merged := MergeParameters(params, map[string]interface{}{
+		"nested": map[string]interface{}{
+			"c": "d",
+		},
+	})
+
+	expected := map[string]interface{}{
+		"replicas": 2,
+		"nested": map[string]interface{}{
+			"a": "b",
+			"c": "d",
+		},
+	}
+
+	if !reflect.DeepEqual(expected, merged) {
+		t.Error(red(fmt.Sprintf("expected %v, got %v", expected, merged)))
+	}
+}
+
+func Test_OrgInMetadata(t *testing.T) {
+	ns := kubectl.Namespace{
+		Name:          "testnamespace",
+		IngressDomain: "test.ingress.domain",
+	}
+
+	c := getCatalog(t)
+	s := c.Service("12345")
+	p, _ := s.Plan("67890")
+
+	contextValues := map[string]interface{}{
+		"platform":          "cloudfoundry",
+		"organization_guid": "org-guid",
+	}
+
+	values, err := s.ChartValues(context.Background(), p, "instance-id", "RELEASE-NAME", ns, nil, contextValues)
+	if err != nil {
+		t.Error(red(err.Error()))
+		return
+	}
+
+	metadata, _ := ExtractMetadata(values)
+	if metadata.Org != "org-guid" {
+		t.Error(red("org of the context should be kept in the metadata"))
+	}
+
+	updated, err := s.UpdatedChartValues(context.Background(), p, "instance-id", "RELEASE-NAME", ns, nil, nil, values)
+	if err != nil {
+		t.Error(red(err.Error()))
+		return
+	}
+
+	metadata, _ = ExtractMetadata(updated)
+	if metadata.Org != "org-guid" {
+		t.Error(red("updates should keep the org of the instance"))
+	}
+}
+
+func Test_GetBindingCredentials(t *testing.T) {
+	ns := kubectl.Namespace{
+		Name:          "testnamespace",
+		IngressDomain: "test.ingress.domain",
+	}
+
+	c := deserializeCatalog(t, defBinding)
+	s := c.Service("12345")
+	p, _ := s.Plan("67890")
+
+	values, err := s.ChartValues(context.Background(), p, "instance-id", "RELEASE-NAME", ns, nil, nil)
+	if err != nil {
+		t.Error(red(err.Error()))
+		return
+	}
+
+	binding := Binding{
+		Id:         "binding-id",
+		AppGuid:    "app-guid",
+		Parameters: map[string]interface{}{"database": "db"},
+	}
+
+	release, err := s.BindingReleaseSection(p, nodes, status, values, binding)
+	if err != nil {
+		t.Error(red(err.Error()))
+		return
+	}
+
+	if release.Binding == nil {
+		t.Error(red("binding section is missing"))
+		return
+	}
+
+	if release.Binding.Credentials["username"] != "binding-id-user" {
+		t.Error(red(fmt.Sprintf("unexpected binding credentials %v", release.Binding.Credentials)))
+	}
+
+	if release.Binding.Create.Image != "postgres" || release.Binding.Create.Args[0] != "secret" {
+		t.Error(red(fmt.Sprintf("unexpected create job %#v", release.Binding.Create)))
+	}
+
+	binding.Credentials = release.Binding.Credentials
+
+	release, err = s.BindingReleaseSection(p, nodes, status, values, binding)
+	if err != nil {
+		t.Error(red(err.Error()))
+		return
+	}
+
+	expected := map[string]interface{}{
+		"username": "binding-id-user",
+		"app":      "app-guid",
+		"database": "db",
+	}
+
+	if !reflect.DeepEqual(expected, release.UserCredentials) {
+		t.Error(red(fmt.Sprintf("expected %v, got %v", expected, release.UserCredentials)))
+	}
+}
+
+func Test_ParametersHash(t *testing.T) {
+	stored := map[string]interface{}{
+		"replicas": 3,
+		"backup":   map[string]interface{}{"enabled": true},
+	}
+
+	requested := map[string]interface{}{
+		"replicas": float64(3),
+		"backup":   map[string]interface{}{"enabled": true},
+	}
+
+	if ParametersHash(stored) != ParametersHash(requested) {
+		t.Error(red("parameters read from a release should have the hash of the ones of a request"))
+	}
+
+	requested["replicas"] = float64(2)
+	if ParametersHash(stored) == ParametersHash(requested) {
+		t.Error(red("different parameters should have different hashes"))
+	}
+
+	if ParametersHash(nil) != ParametersHash(map[string]interface{}{}) {
+		t.Error(red("missing parameters should have the hash of empty parameters"))
+	}
+}
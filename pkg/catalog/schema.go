@@ -0,0 +1,146 @@
+package catalog
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Returned if request parameters do not match the schema declared in the catalog
+type ValidationError struct {
+	Violations []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid parameters: " + strings.Join(e.Violations, "; ")
+}
+
+// Returns the schema for parameters of provision requests
+func (p *Plan) CreateSchema() InputParameterSchema {
+	if p.Schemas == nil {
+		return InputParameterSchema{}
+	}
+	return p.Schemas.ServiceInstance.Create
+}
+
+// Returns the schema for parameters of bind requests
+func (p *Plan) BindSchema() InputParameterSchema {
+	if p.Schemas == nil {
+		return InputParameterSchema{}
+	}
+	return p.Schemas.ServiceBinding.Create
+}
+
+// Returns the schema for parameters of update requests
+func (p *Plan) UpdateSchema() InputParameterSchema {
+	if p.Schemas == nil {
+		return InputParameterSchema{}
+	}
+	return p.Schemas.ServiceInstance.Update
+}
+
+// Validates parameters against the JSON schema of this section
+func (s InputParameterSchema) Validate(params map[string]interface{}) error {
+	if len(s.Parameters) == 0 || s.invalid {
+		return nil
+	}
+
+	schema, err := s.compile()
+	if err != nil {
+		return err
+	}
+
+	var value interface{} = params
+	if params == nil {
+		value = map[string]interface{}{}
+	}
+
+	result, err := schema.Validate(gojsonschema.NewGoLoader(value))
+	if err != nil {
+		return err
+	}
+
+	if result.Valid() {
+		return nil
+	}
+
+	violations := make([]string, 0, len(result.Errors()))
+	for _, e := range result.Errors() {
+		violations = append(violations, fmt.Sprintf("%s: %s", e.Field(), e.Description()))
+	}
+
+	return &ValidationError{Violations: violations}
+}
+
+// Returns a copy of the parameters with the defaults declared in the schema filled in
+func (s InputParameterSchema) ApplyDefaults(params map[string]interface{}) map[string]interface{} {
+	if len(s.Parameters) == 0 || s.invalid {
+		return params
+	}
+
+	return applyDefaults(s.Parameters, params)
+}
+
+func applyDefaults(schema map[string]interface{}, object map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(object))
+	for k, v := range object {
+		result[k] = v
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	for key, value := range properties {
+		property, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		current, exists := result[key]
+		if !exists {
+			if defaultValue, hasDefault := property["default"]; hasDefault {
+				result[key] = defaultValue
+			}
+			continue
+		}
+
+		// defaults of nested objects are filled in if the object is given
+		if nested, isObject := current.(map[string]interface{}); isObject {
+			result[key] = applyDefaults(property, nested)
+		}
+	}
+
+	return result
+}
+
+func (s InputParameterSchema) compile() (*gojsonschema.Schema, error) {
+	return gojsonschema.NewSchema(gojsonschema.NewGoLoader(s.Parameters))
+}
+
+// Schemas which are not valid JSON schema are ignored with a warning, catalogs loaded before parameters were
+// validated keep working. Platforms are still shown the schema.
+func ignoreInvalidSchemas(s *Service) {
+	for _, p := range s.Plans {
+		if p.Schemas == nil {
+			continue
+		}
+
+		sections := map[string]*InputParameterSchema{
+			"service-instance.create": &p.Schemas.ServiceInstance.Create,
+			"service-instance.update": &p.Schemas.ServiceInstance.Update,
+			"service-binding.create":  &p.Schemas.ServiceBinding.Create,
+		}
+
+		for name, section := range sections {
+			if len(section.Parameters) == 0 {
+				continue
+			}
+
+			if _, err := section.compile(); err != nil {
+				log.Printf("ignoring invalid %s schema of plan %s of service %s, parameters are not validated: %s", name, p.Name, s.Name, err)
+				section.invalid = true
+			}
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package catalog
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+var testSchema = []byte(`
+type: object
+required:
+- size
+additionalProperties: false
+properties:
+  size:
+    type: string
+    enum: [small, large]
+  replicas:
+    type: integer
+    minimum: 1
+    maximum: 5
+  name:
+    type: string
+    pattern: "^[a-z]+$"
+    maxLength: 8
+  tags:
+    type: array
+    maxItems: 2
+    items:
+      type: string
+`)
+
+func getSchema(t *testing.T) InputParameterSchema {
+	var parameters map[string]interface{}
+	err := yaml.Unmarshal(testSchema, &parameters)
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	return InputParameterSchema{Parameters: toStringMap(parameters)}
+}
+
+func Test_ValidateValidParameters(t *testing.T) {
+	schema := getSchema(t)
+
+	params := map[string]interface{}{
+		"size":     "small",
+		"replicas": float64(3),
+		"name":     "abc",
+		"tags":     []interface{}{"a", "b"},
+	}
+
+	err := schema.Validate(params)
+	if err != nil {
+		t.Error(red(err.Error()))
+	}
+}
+
+func Test_ValidateInvalidParameters(t *testing.T) {
+	schema := getSchema(t)
+
+	params := map[string]interface{}{
+		"replicas": float64(1.5),
+		"name":     "ABCDEFGHIJ",
+		"tags":     []interface{}{"a", "b", 3},
+		"unknown":  true,
+	}
+
+	err := schema.Validate(params)
+	if err == nil {
+		t.Error(red("validation of invalid parameters should have failed"))
+		return
+	}
+
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Error(red(fmt.Sprintf("expected validation error, got %#v", err)))
+		return
+	}
+
+	expected := []string{
+		"(root): size is required",
+		"(root): Additional property unknown is not allowed",
+		"name: Does not match pattern '^[a-z]+$'",
+		"name: String length must be less than or equal to 8",
+		"replicas: Invalid type. Expected: integer, given: number",
+		"tags.2: Invalid type. Expected: string, given: integer",
+		"tags: Array must have at most 2 items",
+	}
+
+	violations := append([]string(nil), validationErr.Violations...)
+	sort.Strings(expected)
+	sort.Strings(violations)
+
+	if fmt.Sprint(expected) != fmt.Sprint(violations) {
+		t.Error(red(fmt.Sprintf("expected %v, got %v", expected, violations)))
+	}
+}
+
+func Test_ValidateReferences(t *testing.T) {
+	var parameters map[string]interface{}
+	err := yaml.Unmarshal([]byte(`
+type: object
+definitions:
+  size:
+    type: string
+    enum: [small, large]
+properties:
+  size:
+    $ref: "#/definitions/size"
+  storage:
+    oneOf:
+    - type: integer
+    - type: string
+      pattern: "^[0-9]+Gi$"
+`), &parameters)
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	schema := InputParameterSchema{Parameters: toStringMap(parameters)}
+
+	err = schema.Validate(map[string]interface{}{"size": "small", "storage": "10Gi"})
+	if err != nil {
+		t.Error(red(err.Error()))
+	}
+
+	err = schema.Validate(map[string]interface{}{"size": "huge"})
+	if err == nil {
+		t.Error(red("referenced definitions should be enforced"))
+	}
+
+	err = schema.Validate(map[string]interface{}{"storage": "10 gigabytes"})
+	if err == nil {
+		t.Error(red("oneOf should be enforced"))
+	}
+}
+
+func Test_InvalidSchemaInCatalog(t *testing.T) {
+	c, err := NewFromSerialized([]byte(`---
+service:
+  _id: 12345
+  _name: "test_service"
+  description: "service_description"
+  chart: service_chart
+  plans:
+  -
+    _id: 67890
+    _name: test_plan
+    description: "plan_description"
+    schemas:
+      service-instance:
+        create:
+          parameters:
+            type: object
+            properties: not-an-object
+---
+chart-values: {}
+---
+user-credentials: {}
+`))
+
+	if err != nil {
+		t.Fatal(red("catalog with an invalid schema should be loaded: " + err.Error()))
+	}
+
+	plan, _ := c.Service("12345").Plan("67890")
+	err = plan.CreateSchema().Validate(map[string]interface{}{"any": "thing"})
+	if err != nil {
+		t.Error(red("invalid schema should be ignored: " + err.Error()))
+	}
+}
+
+func Test_ValidateEmptySchema(t *testing.T) {
+	err := InputParameterSchema{}.Validate(map[string]interface{}{"any": "thing"})
+	if err != nil {
+		t.Error(red(err.Error()))
+	}
+}
+
+func Test_ApplyDefaults(t *testing.T) {
+	var parameters map[string]interface{}
+	err := yaml.Unmarshal([]byte(`
+type: object
+properties:
+  size:
+    type: string
+    default: small
+  replicas:
+    type: integer
+    default: 1
+  backup:
+    type: object
+    properties:
+      enabled:
+        type: boolean
+        default: false
+      schedule:
+        type: string
+        default: daily
+`), &parameters)
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	schema := InputParameterSchema{Parameters: toStringMap(parameters)}
+
+	params := map[string]interface{}{
+		"size":   "large",
+		"backup": map[string]interface{}{"enabled": true},
+	}
+
+	result := schema.ApplyDefaults(params)
+
+	if result["size"] != "large" {
+		t.Error(red("given parameters should not be replaced by defaults"))
+	}
+
+	if result["replicas"] != 1 {
+		t.Error(red(fmt.Sprintf("expected default replicas 1, got %v", result["replicas"])))
+	}
+
+	backup := result["backup"].(map[string]interface{})
+	if backup["enabled"] != true || backup["schedule"] != "daily" {
+		t.Error(red(fmt.Sprintf("expected nested defaults to be filled in, got %v", backup)))
+	}
+
+	if _, ok := params["replicas"]; ok {
+		t.Error(red("the given parameters should not be modified"))
+	}
+
+	err = schema.Validate(result)
+	if err != nil {
+		t.Error(red(err.Error()))
+	}
+}
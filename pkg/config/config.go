@@ -8,14 +8,32 @@ import (
 type Config struct {
 	RepositoryURLs string `env:"REPOSITORY_URLS" default:"{}"`
 	HelmNamespace  string `env:"HELM_NAMESPACE"`
+	LockNamespace  string `env:"LOCK_NAMESPACE"`
 	IngressDomain  string `env:"INGRESS_DOMAIN"`
 
-	Username  string `env:"USERNAME"`
-	Password  string `env:"PASSWORD"`
-	Port      string `env:"PORT" default:"5000"`
+	Username string `env:"USERNAME"`
+	Password string `env:"PASSWORD"`
+	Port     string `env:"PORT" default:"5000"`
 
-	CatalogURL             string `env:"CATALOG_URL" default:"./catalog"`
-	CatalogUpdateInterval  string `env:"CATALOG_UPDATE_INTERVAL" default:"20s"`
+	CatalogURL            string `env:"CATALOG_URL" default:"./catalog"`
+	CatalogUpdateInterval string `env:"CATALOG_UPDATE_INTERVAL" default:"20s"`
+
+	AuditSink string `env:"AUDIT_SINK"`
+
+	// maximum number of instances across all services, unlimited if empty
+	MaxInstances string `env:"MAX_INSTANCES"`
+
+	// fallback, strict or create, see README
+	NamespacePolicy   string `env:"NAMESPACE_POLICY" default:"fallback"`
+	NamespaceTemplate string `env:"NAMESPACE_TEMPLATE"`
+	CFOrgLabel        string `env:"CF_ORG_LABEL" default:"cf-org"`
+	CFSpaceLabel      string `env:"CF_SPACE_LABEL" default:"cf-space"`
+
+	// helm2 or helm3
+	HelmBackend          string `env:"HELM_BACKEND" default:"helm2"`
+	HelmBinary           string `env:"HELM_BINARY" default:"helm"`
+	TillerNamespace      string `env:"TILLER_NAMESPACE" default:"kube-system"`
+	MigrateHelm2Releases string `env:"MIGRATE_HELM2_RELEASES"`
 }
 
 // This loads environment variables or sets a default value based on the tag in the struct definition
@@ -39,4 +57,4 @@ func (c *Config) LoadConfig() {
 			val.Field(i).SetString(defaultValue)
 		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,529 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/monostream/helmi/pkg/kubectl"
+	"gopkg.in/yaml.v2"
+)
+
+// Client which runs the Helm 2 binary. Instead of the tables helm prints for humans, it reads JSON output
+// and the repository files in the helm home wherever helm 2 offers them.
+type CLI struct {
+	binary string
+	home   string
+}
+
+var _ Client = &CLI{}
+
+// Runs the binary, `helm` if empty, with the helm home of HELM_HOME like the binary itself, ~/.helm if it is not set
+func NewCLI(binary string) *CLI {
+	if len(binary) == 0 {
+		binary = "helm"
+	}
+
+	home := os.Getenv("HELM_HOME")
+	if len(home) == 0 {
+		userHome, _ := os.UserHomeDir()
+		home = filepath.Join(userHome, ".helm")
+	}
+
+	return &CLI{binary: binary, home: home}
+}
+
+// repository/repositories.yaml of the helm home
+type repositoryFile struct {
+	Repositories []struct {
+		Name  string `yaml:"name"`
+		URL   string `yaml:"url"`
+		Cache string `yaml:"cache"`
+	} `yaml:"repositories"`
+}
+
+// Index of a repository as cached by helm repo update
+type repositoryIndex struct {
+	Entries map[string][]indexedChart `yaml:"entries"`
+}
+
+type indexedChart struct {
+	Name        string `yaml:"name"`
+	Version     string `yaml:"version"`
+	AppVersion  string `yaml:"appVersion"`
+	Description string `yaml:"description"`
+}
+
+func (c *CLI) repositories() (repositoryFile, error) {
+	var file repositoryFile
+
+	data, err := ioutil.ReadFile(filepath.Join(c.home, "repository", "repositories.yaml"))
+	if os.IsNotExist(err) {
+		return file, nil
+	}
+	if err != nil {
+		return file, err
+	}
+
+	err = yaml.Unmarshal(data, &file)
+	return file, err
+}
+
+// Older helm versions store the absolute path of the index, newer ones its file name
+func (c *CLI) indexPath(name string, cache string) string {
+	if len(cache) == 0 {
+		cache = name + "-index.yaml"
+	}
+
+	if filepath.IsAbs(cache) {
+		return cache
+	}
+
+	return filepath.Join(c.home, "repository", "cache", cache)
+}
+
+func (c *CLI) ListCharts(ctx context.Context) (map[string]Chart, error) {
+	file, err := c.repositories()
+	if err != nil {
+		return nil, err
+	}
+
+	charts := make(map[string]Chart)
+
+	for _, repo := range file.Repositories {
+		data, err := ioutil.ReadFile(c.indexPath(repo.Name, repo.Cache))
+		if err != nil {
+			return nil, err
+		}
+
+		var index repositoryIndex
+
+		err = yaml.Unmarshal(data, &index)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index of repository %s: %s", repo.Name, err)
+		}
+
+		for name, versions := range index.Entries {
+			latest, ok := latestVersion(versions)
+			if !ok {
+				continue
+			}
+
+			chart := Chart{
+				Name:        repo.Name + "/" + name,
+				Description: latest.Description,
+
+				AppVersion:   latest.AppVersion,
+				ChartVersion: latest.Version,
+			}
+
+			charts[chart.Name] = chart
+		}
+	}
+
+	return charts, nil
+}
+
+// Returns the highest version which is not a pre-release, like helm search without --devel
+func latestVersion(charts []indexedChart) (indexedChart, bool) {
+	var latest indexedChart
+	var latestVersion *semver.Version
+
+	for _, chart := range charts {
+		version, err := semver.NewVersion(chart.Version)
+		if err != nil || len(version.Prerelease()) > 0 {
+			continue
+		}
+
+		if latestVersion == nil || version.GreaterThan(latestVersion) {
+			latest = chart
+			latestVersion = version
+		}
+	}
+
+	return latest, latestVersion != nil
+}
+
+// Looks the release up in the list of releases, helm status does not tell missing releases from other errors
+func (c *CLI) Exists(ctx context.Context, release string) (bool, error) {
+	output, err := runCommand(ctx, c.binary, nil, "list", "--all", "--output", "json", "^"+release+"$")
+	if err != nil {
+		return false, err
+	}
+
+	// helm prints nothing if there are no releases
+	if len(bytes.TrimSpace(output)) == 0 {
+		return false, nil
+	}
+
+	var page struct {
+		Releases []ListedRelease
+	}
+
+	err = json.Unmarshal(output, &page)
+	if err != nil {
+		return false, err
+	}
+
+	for _, r := range page.Releases {
+		if r.Name == release {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (c *CLI) Install(ctx context.Context, release string, chart string, version string, values map[string]interface{}, namespace string, acceptsIncomplete bool) error {
+	arguments := make([]string, 0)
+
+	arguments = append(arguments, "install", chart)
+	arguments = append(arguments, "--name", release)
+
+	if len(namespace) > 0 {
+		arguments = append(arguments, "--namespace", namespace)
+	}
+
+	if len(version) > 0 {
+		arguments = append(arguments, "--version", version)
+	}
+
+	if acceptsIncomplete == false {
+		arguments = append(arguments, "--wait")
+		arguments = append(arguments, timeoutArguments(ctx)...)
+	}
+
+	valuesArgs, stdin, err := valuesArguments(values)
+	if err != nil {
+		return err
+	}
+
+	_, err = runCommand(ctx, c.binary, stdin, append(arguments, valuesArgs...)...)
+	return err
+}
+
+func (c *CLI) Upgrade(ctx context.Context, release string, chart string, version string, values map[string]interface{}, acceptsIncomplete bool) error {
+	arguments := make([]string, 0)
+
+	arguments = append(arguments, "upgrade", release, chart)
+
+	if len(version) > 0 {
+		arguments = append(arguments, "--version", version)
+	}
+
+	if acceptsIncomplete == false {
+		arguments = append(arguments, "--wait")
+		arguments = append(arguments, timeoutArguments(ctx)...)
+	}
+
+	valuesArgs, stdin, err := valuesArguments(values)
+	if err != nil {
+		return err
+	}
+
+	_, err = runCommand(ctx, c.binary, stdin, append(arguments, valuesArgs...)...)
+	return err
+}
+
+func (c *CLI) Delete(ctx context.Context, release string) error {
+	_, err := runCommand(ctx, c.binary, nil, "delete", release, "--purge")
+	return err
+}
+
+// Returns the names of all releases in the namespace, including failed ones
+func (c *CLI) ListReleases(ctx context.Context, namespace string) ([]string, error) {
+	output, err := runCommand(ctx, c.binary, nil, "list", "--all", "--short", "--namespace", namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(string(output)), nil
+}
+
+// Returns the releases of all namespaces, helm lists them in pages
+func (c *CLI) ListAll(ctx context.Context) ([]ListedRelease, error) {
+	var releases []ListedRelease
+
+	offset := ""
+	for {
+		args := []string{"list", "--all", "--output", "json"}
+		if len(offset) > 0 {
+			args = append(args, "--offset", offset)
+		}
+
+		output, err := runCommand(ctx, c.binary, nil, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		// helm prints nothing if there are no releases
+		if len(bytes.TrimSpace(output)) == 0 {
+			return releases, nil
+		}
+
+		var page struct {
+			Next     string
+			Releases []ListedRelease
+		}
+
+		err = json.Unmarshal(output, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		releases = append(releases, page.Releases...)
+
+		if len(page.Next) == 0 {
+			return releases, nil
+		}
+		offset = page.Next
+	}
+}
+
+// Rolls a release back to a previous revision
+func (c *CLI) Rollback(ctx context.Context, release string, revision int) error {
+	_, err := runCommand(ctx, c.binary, nil, "rollback", release, strconv.Itoa(revision))
+	return err
+}
+
+// Helm waits for resources for 5 minutes by default, the deadline of the context takes precedence
+func timeoutArguments(ctx context.Context) []string {
+	seconds, ok := timeoutSeconds(ctx)
+	if !ok {
+		return nil
+	}
+
+	return []string{"--timeout", strconv.FormatInt(seconds, 10)}
+}
+
+func timeoutSeconds(ctx context.Context) (int64, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+
+	seconds := int64(time.Until(deadline).Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return seconds, true
+}
+
+// Runs a helm command and returns what it prints on stdout. If it fails, the error is what it printed on stderr.
+func runCommand(ctx context.Context, binary string, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdin = stdin
+
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		if stderr.Len() == 0 {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		return nil, commandError(ctx, stderr.Bytes())
+	}
+
+	return output, nil
+}
+
+// Returns the output of a failed command, or the reason if it has been killed because the context is done
+func commandError(ctx context.Context, output []byte) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return errors.New(strings.TrimSpace(string(output)))
+}
+
+func (c *CLI) GetValues(ctx context.Context, release string) (map[string]interface{}, error) {
+	return c.getValues(ctx, release)
+}
+
+func (c *CLI) GetRevisionValues(ctx context.Context, release string, revision int) (map[string]interface{}, error) {
+	return c.getValues(ctx, release, "--revision", strconv.Itoa(revision))
+}
+
+func (c *CLI) getValues(ctx context.Context, release string, args ...string) (map[string]interface{}, error) {
+	output, err := runCommand(ctx, c.binary, nil, append([]string{"get", "values", release, "--all"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]interface{}
+
+	err = yaml.Unmarshal(output, &values)
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// Output of helm status --output json
+type releaseStatus struct {
+	Namespace string `json:"namespace"`
+	Info      struct {
+		Status struct {
+			Code int `json:"code"`
+		} `json:"status"`
+		LastDeployed struct {
+			Seconds int64 `json:"seconds"`
+			Nanos   int64 `json:"nanos"`
+		} `json:"last_deployed"`
+	} `json:"info"`
+}
+
+// Status codes of helm 2 releases
+const (
+	statusCodeDeployed = 1
+	statusCodeFailed   = 4
+)
+
+func (c *CLI) GetStatus(ctx context.Context, release string) (Status, error) {
+	output, err := runCommand(ctx, c.binary, nil, "status", release, "--output", "json")
+
+	status := Status{
+		DesiredNodes:   0,
+		AvailableNodes: 0,
+
+		Services: make(map[string]kubectl.Service),
+	}
+
+	if err != nil {
+		return status, err
+	}
+
+	var result releaseStatus
+
+	err = json.Unmarshal(output, &result)
+	if err != nil {
+		return status, err
+	}
+
+	status.Name = release
+	status.Namespace = result.Namespace
+	status.IsFailed = result.Info.Status.Code == statusCodeFailed
+	status.IsDeployed = result.Info.Status.Code == statusCodeDeployed
+	status.DeploymentTime = time.Unix(result.Info.LastDeployed.Seconds, result.Info.LastDeployed.Nanos)
+
+	manifest, err := c.manifest(ctx, release)
+	if err != nil {
+		return Status{}, err
+	}
+
+	err = addManifestResources(ctx, &status, manifest)
+	if err != nil {
+		return Status{}, err
+	}
+
+	return status, nil
+}
+
+// Returns the objects of the last revision of a release as rendered by tiller
+func (c *CLI) manifest(ctx context.Context, release string) (string, error) {
+	output, err := runCommand(ctx, c.binary, nil, "get", "manifest", release)
+	if err != nil {
+		return "", err
+	}
+
+	return string(output), nil
+}
+
+// Returns the last revisions of a release, the newest revision comes last
+func (c *CLI) History(ctx context.Context, release string, max int) ([]Revision, error) {
+	output, err := runCommand(ctx, c.binary, nil, "history", release, "--max", strconv.Itoa(max), "--output", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []Revision
+
+	err = json.Unmarshal(output, &revisions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+func (c *CLI) IsReady(ctx context.Context) error {
+	_, err := runCommand(ctx, c.binary, nil, "list", "--short")
+	return err
+}
+
+func (c *CLI) RepoAdd(ctx context.Context, name string, repoURI string) error {
+	return repoAdd(ctx, c.binary, name, repoURI)
+}
+
+// Adds a repository, both helm versions take the same arguments
+func repoAdd(ctx context.Context, binary string, name string, repoURI string) error {
+	uri, err := url.Parse(repoURI)
+
+	if err != nil {
+		return err
+	}
+
+	// extract and remove username and password form uri
+	username := ""
+	password := ""
+	if uri.User != nil {
+		username = uri.User.Username()
+		password, _ = uri.User.Password()
+		uri.User = nil
+	}
+
+	args := []string{"repo", "add", name, uri.String()}
+
+	if len(username) > 0 {
+		args = append(args, "--username", username)
+	}
+
+	if len(password) > 0 {
+		args = append(args, "--password", password)
+	}
+
+	_, err = runCommand(ctx, binary, nil, args...)
+	return err
+}
+
+func (c *CLI) Repos(ctx context.Context) (map[string]string, error) {
+	file, err := c.repositories()
+	if err != nil {
+		return nil, err
+	}
+
+	repos := map[string]string{}
+	for _, repo := range file.Repositories {
+		repos[repo.Name] = repo.URL
+	}
+
+	return repos, nil
+}
+
+func (c *CLI) RepoUpdate(ctx context.Context) error {
+	if repos, err := c.Repos(ctx); err == nil && len(repos) == 0 {
+		return nil
+	}
+
+	_, err := runCommand(ctx, c.binary, nil, "repo", "update")
+	return err
+}
@@ -0,0 +1,474 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monostream/helmi/pkg/kubectl"
+	"gopkg.in/yaml.v2"
+)
+
+// Returned if no namespace has a release of the name
+var errReleaseNotFound = errors.New("release not found")
+
+// Client which runs the Helm 3 binary. Helm 3 has no tiller and keeps the releases in Secrets of their namespace,
+// operations on a release look up its namespace first. A release never moves to another namespace, so the namespaces
+// are cached until the release is deleted or a command on it fails, e.g. because another broker instance deleted it.
+// Statuses of releases and revisions are returned in the upper case of Helm 2, e.g. `PENDING_INSTALL`.
+type Helm3CLI struct {
+	binary string
+
+	namespaces struct {
+		sync.Mutex
+		releases map[string]string
+	}
+}
+
+var _ Client = &Helm3CLI{}
+
+// Runs the binary, `helm` if empty
+func NewHelm3CLI(binary string) *Helm3CLI {
+	if len(binary) == 0 {
+		binary = "helm"
+	}
+
+	c := &Helm3CLI{binary: binary}
+	c.namespaces.releases = make(map[string]string)
+
+	return c
+}
+
+// Entry of helm list --output json
+type helm3Release struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Revision  string `json:"revision"`
+	Status    string `json:"status"`
+}
+
+// Converts a status of Helm 3 to the one of Helm 2
+func helm2Status(status string) string {
+	switch status {
+	case "uninstalled":
+		return "DELETED"
+	case "uninstalling":
+		return "DELETING"
+	}
+
+	return strings.ToUpper(strings.Replace(status, "-", "_", -1))
+}
+
+// Helm 3 expects a duration, the deadline of the context takes precedence over its 5 minutes
+func helm3TimeoutArguments(ctx context.Context) []string {
+	seconds, ok := timeoutSeconds(ctx)
+	if !ok {
+		return nil
+	}
+
+	return []string{"--timeout", strconv.FormatInt(seconds, 10) + "s"}
+}
+
+func (c *Helm3CLI) run(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	return runCommand(ctx, c.binary, stdin, args...)
+}
+
+func (c *Helm3CLI) list(ctx context.Context, args ...string) ([]helm3Release, error) {
+	output, err := c.run(ctx, nil, append([]string{"list", "--all", "--max", "0", "--output", "json"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []helm3Release
+
+	err = json.Unmarshal(output, &releases)
+	if err != nil {
+		return nil, err
+	}
+
+	return releases, nil
+}
+
+// Returns the namespace of a release, looked up only if it is not cached
+func (c *Helm3CLI) namespace(ctx context.Context, release string) (string, error) {
+	c.namespaces.Lock()
+	namespace, cached := c.namespaces.releases[release]
+	c.namespaces.Unlock()
+
+	if cached {
+		return namespace, nil
+	}
+
+	return c.lookupNamespace(ctx, release)
+}
+
+// Looks up the namespace of a release in all namespaces and caches it
+func (c *Helm3CLI) lookupNamespace(ctx context.Context, release string) (string, error) {
+	releases, err := c.list(ctx, "--all-namespaces", "--filter", "^"+release+"$")
+	if err != nil {
+		return "", err
+	}
+
+	for _, r := range releases {
+		if r.Name == release {
+			c.cacheNamespace(release, r.Namespace)
+			return r.Namespace, nil
+		}
+	}
+
+	c.forgetNamespace(release)
+	return "", errReleaseNotFound
+}
+
+func (c *Helm3CLI) cacheNamespace(release string, namespace string) {
+	c.namespaces.Lock()
+	defer c.namespaces.Unlock()
+
+	c.namespaces.releases[release] = namespace
+}
+
+func (c *Helm3CLI) forgetNamespace(release string) {
+	c.namespaces.Lock()
+	defer c.namespaces.Unlock()
+
+	delete(c.namespaces.releases, release)
+}
+
+// Runs a command on a release in its namespace, the cached namespace is dropped if the command fails
+func (c *Helm3CLI) runInNamespace(ctx context.Context, release string, stdin io.Reader, args ...string) ([]byte, error) {
+	namespace, err := c.namespace(ctx, release)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := c.run(ctx, stdin, append(args, "--namespace", namespace)...)
+	if err != nil {
+		c.forgetNamespace(release)
+	}
+
+	return output, err
+}
+
+// Values are passed as yaml on stdin
+func valuesArguments(values map[string]interface{}) ([]string, io.Reader, error) {
+	if len(values) == 0 {
+		return nil, nil, nil
+	}
+
+	buf, err := yaml.Marshal(values)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return []string{"--values", "-"}, bytes.NewReader(buf), nil
+}
+
+func (c *Helm3CLI) Install(ctx context.Context, release string, chart string, version string, values map[string]interface{}, namespace string, acceptsIncomplete bool) error {
+	arguments := []string{"install", release, chart}
+
+	// tiller created missing namespaces, helm 3 has to be asked to
+	if len(namespace) > 0 {
+		arguments = append(arguments, "--namespace", namespace, "--create-namespace")
+	}
+
+	if len(version) > 0 {
+		arguments = append(arguments, "--version", version)
+	}
+
+	if !acceptsIncomplete {
+		arguments = append(arguments, "--wait")
+		arguments = append(arguments, helm3TimeoutArguments(ctx)...)
+	}
+
+	valuesArgs, stdin, err := valuesArguments(values)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.run(ctx, stdin, append(arguments, valuesArgs...)...)
+	if err == nil && len(namespace) > 0 {
+		c.cacheNamespace(release, namespace)
+	}
+
+	return err
+}
+
+func (c *Helm3CLI) Upgrade(ctx context.Context, release string, chart string, version string, values map[string]interface{}, acceptsIncomplete bool) error {
+	arguments := []string{"upgrade", release, chart}
+
+	if len(version) > 0 {
+		arguments = append(arguments, "--version", version)
+	}
+
+	if !acceptsIncomplete {
+		arguments = append(arguments, "--wait")
+		arguments = append(arguments, helm3TimeoutArguments(ctx)...)
+	}
+
+	valuesArgs, stdin, err := valuesArguments(values)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.runInNamespace(ctx, release, stdin, append(arguments, valuesArgs...)...)
+	return err
+}
+
+func (c *Helm3CLI) Delete(ctx context.Context, release string) error {
+	_, err := c.runInNamespace(ctx, release, nil, "uninstall", release)
+	c.forgetNamespace(release)
+
+	return err
+}
+
+func (c *Helm3CLI) Rollback(ctx context.Context, release string, revision int) error {
+	_, err := c.runInNamespace(ctx, release, nil, "rollback", release, strconv.Itoa(revision))
+	return err
+}
+
+// Always looks the release up, another broker instance may have deleted it since its namespace has been cached
+func (c *Helm3CLI) Exists(ctx context.Context, release string) (bool, error) {
+	_, err := c.lookupNamespace(ctx, release)
+	if err == errReleaseNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Output of helm status --output json
+type helm3Status struct {
+	Namespace string `json:"namespace"`
+	Manifest  string `json:"manifest"`
+	Info      struct {
+		Status       string    `json:"status"`
+		LastDeployed time.Time `json:"last_deployed"`
+	} `json:"info"`
+}
+
+func (c *Helm3CLI) GetStatus(ctx context.Context, release string) (Status, error) {
+	status := Status{
+		Services: make(map[string]kubectl.Service),
+	}
+
+	output, err := c.runInNamespace(ctx, release, nil, "status", release, "--output", "json")
+	if err != nil {
+		return status, err
+	}
+
+	var result helm3Status
+
+	err = json.Unmarshal(output, &result)
+	if err != nil {
+		return status, err
+	}
+
+	status.Name = release
+	status.Namespace = result.Namespace
+	status.IsFailed = result.Info.Status == "failed"
+	status.IsDeployed = result.Info.Status == "deployed"
+	status.DeploymentTime = result.Info.LastDeployed.Local()
+
+	err = addManifestResources(ctx, &status, result.Manifest)
+	if err != nil {
+		return Status{}, err
+	}
+
+	return status, nil
+}
+
+func (c *Helm3CLI) GetValues(ctx context.Context, release string) (map[string]interface{}, error) {
+	return c.getValues(ctx, release)
+}
+
+func (c *Helm3CLI) GetRevisionValues(ctx context.Context, release string, revision int) (map[string]interface{}, error) {
+	return c.getValues(ctx, release, "--revision", strconv.Itoa(revision))
+}
+
+func (c *Helm3CLI) getValues(ctx context.Context, release string, args ...string) (map[string]interface{}, error) {
+	// yaml like helm 2, values are decoded to the same types
+	arguments := []string{"get", "values", release, "--all", "--output", "yaml"}
+
+	output, err := c.runInNamespace(ctx, release, nil, append(arguments, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]interface{}
+
+	err = yaml.Unmarshal(output, &values)
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// Revision of helm history --output json
+type helm3Revision struct {
+	Revision    int       `json:"revision"`
+	Updated     time.Time `json:"updated"`
+	Status      string    `json:"status"`
+	Chart       string    `json:"chart"`
+	Description string    `json:"description"`
+}
+
+func (c *Helm3CLI) History(ctx context.Context, release string, max int) ([]Revision, error) {
+	output, err := c.runInNamespace(ctx, release, nil, "history", release, "--max", strconv.Itoa(max), "--output", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	var history []helm3Revision
+
+	err = json.Unmarshal(output, &history)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]Revision, 0, len(history))
+	for _, revision := range history {
+		revisions = append(revisions, Revision{
+			Revision:    revision.Revision,
+			Updated:     revision.Updated.Local().Format(time.ANSIC),
+			Status:      helm2Status(revision.Status),
+			Chart:       revision.Chart,
+			Description: revision.Description,
+		})
+	}
+
+	return revisions, nil
+}
+
+func (c *Helm3CLI) ListReleases(ctx context.Context, namespace string) ([]string, error) {
+	releases, err := c.list(ctx, "--namespace", namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(releases))
+	for _, release := range releases {
+		names = append(names, release.Name)
+	}
+
+	return names, nil
+}
+
+func (c *Helm3CLI) ListAll(ctx context.Context) ([]ListedRelease, error) {
+	releases, err := c.list(ctx, "--all-namespaces")
+	if err != nil {
+		return nil, err
+	}
+
+	listed := make([]ListedRelease, 0, len(releases))
+	for _, release := range releases {
+		// helm 3 lists the revision as string
+		revision, _ := strconv.Atoi(release.Revision)
+
+		listed = append(listed, ListedRelease{
+			Name:      release.Name,
+			Namespace: release.Namespace,
+			Revision:  revision,
+			Status:    helm2Status(release.Status),
+		})
+	}
+
+	return listed, nil
+}
+
+func (c *Helm3CLI) ListCharts(ctx context.Context) (map[string]Chart, error) {
+	output, err := c.run(ctx, nil, "search", "repo", "--output", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	var results []struct {
+		Name        string `json:"name"`
+		Version     string `json:"version"`
+		AppVersion  string `json:"app_version"`
+		Description string `json:"description"`
+	}
+
+	err = json.Unmarshal(output, &results)
+	if err != nil {
+		return nil, err
+	}
+
+	charts := make(map[string]Chart)
+	for _, result := range results {
+		charts[result.Name] = Chart{
+			Name:        result.Name,
+			Description: result.Description,
+
+			AppVersion:   result.AppVersion,
+			ChartVersion: result.Version,
+		}
+	}
+
+	return charts, nil
+}
+
+func (c *Helm3CLI) RepoAdd(ctx context.Context, name string, repoURI string) error {
+	return repoAdd(ctx, c.binary, name, repoURI)
+}
+
+func (c *Helm3CLI) Repos(ctx context.Context) (map[string]string, error) {
+	repos := map[string]string{}
+
+	output, err := c.run(ctx, nil, "repo", "list", "--output", "json")
+	if err != nil {
+		if strings.Contains(err.Error(), "no repositories") {
+			return repos, nil
+		}
+		return nil, err
+	}
+
+	var list []struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	}
+
+	err = json.Unmarshal(output, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, repo := range list {
+		repos[repo.Name] = repo.URL
+	}
+
+	return repos, nil
+}
+
+func (c *Helm3CLI) RepoUpdate(ctx context.Context) error {
+	if repos, err := c.Repos(ctx); err == nil && len(repos) == 0 {
+		return nil
+	}
+
+	_, err := c.run(ctx, nil, "repo", "update")
+	return err
+}
+
+// Helm 3 has no tiller, it is ready if it can list the releases of the cluster
+func (c *Helm3CLI) IsReady(ctx context.Context) error {
+	_, err := c.run(ctx, nil, "list", "--all-namespaces", "--short")
+	return err
+}
+
+// Converts a Helm 2 release, with all its revisions and values, into a Helm 3 release with the helm-2to3 plugin.
+// The resources of the release are not touched, the Helm 2 release is deleted from the tiller namespace.
+func (c *Helm3CLI) ConvertHelm2(ctx context.Context, release string, tillerNamespace string) error {
+	_, err := c.run(ctx, nil, "2to3", "convert", release, "--tiller-ns", tillerNamespace, "--delete-v2-releases")
+	if err != nil {
+		return fmt.Errorf("failed to convert helm 2 release %s: %s", release, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,301 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/monostream/helmi/pkg/kubectl"
+	"gopkg.in/yaml.v2"
+)
+
+// In-memory Client for tests. Releases are deployed as soon as they are installed or upgraded,
+// their values are stored like helm returns them.
+type Fake struct {
+	// charts returned by ListCharts
+	Charts map[string]Chart
+	// returned by IsReady
+	NotReady error
+	// readiness of the objects of releases by release name, releases without are available
+	Resources map[string][]kubectl.Resource
+
+	mutex    sync.Mutex
+	releases map[string]*fakeRelease
+	repos    map[string]string
+}
+
+var _ Client = &Fake{}
+
+type fakeRelease struct {
+	namespace string
+	revisions []Revision
+	// values of each revision
+	values []map[string]interface{}
+}
+
+func NewFake() *Fake {
+	return &Fake{
+		Charts:    map[string]Chart{},
+		Resources: map[string][]kubectl.Resource{},
+		releases:  map[string]*fakeRelease{},
+		repos:     map[string]string{},
+	}
+}
+
+func releaseNotFound(release string) error {
+	return fmt.Errorf("Error: release: \"%s\" not found", release)
+}
+
+// Stores values as they would be read back from helm
+func copyValues(values map[string]interface{}) (map[string]interface{}, error) {
+	data, err := yaml.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+
+	var copied map[string]interface{}
+	err = yaml.Unmarshal(data, &copied)
+	return copied, err
+}
+
+func (f *Fake) addRevision(r *fakeRelease, chart string, version string, values map[string]interface{}, description string) error {
+	copied, err := copyValues(values)
+	if err != nil {
+		return err
+	}
+
+	for i := range r.revisions {
+		r.revisions[i].Status = "SUPERSEDED"
+	}
+
+	if len(version) > 0 {
+		chart = chart + "-" + version
+	}
+
+	r.revisions = append(r.revisions, Revision{
+		Revision:    len(r.revisions) + 1,
+		Updated:     time.Now().Format(time.ANSIC),
+		Status:      "DEPLOYED",
+		Chart:       chart,
+		Description: description,
+	})
+	r.values = append(r.values, copied)
+
+	return nil
+}
+
+func (f *Fake) Install(ctx context.Context, release string, chart string, version string, values map[string]interface{}, namespace string, acceptsIncomplete bool) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if _, exists := f.releases[release]; exists {
+		return fmt.Errorf("Error: a release named %s already exists", release)
+	}
+
+	r := &fakeRelease{namespace: namespace}
+
+	err := f.addRevision(r, chart, version, values, "Install complete")
+	if err != nil {
+		return err
+	}
+
+	f.releases[release] = r
+	return nil
+}
+
+func (f *Fake) Upgrade(ctx context.Context, release string, chart string, version string, values map[string]interface{}, acceptsIncomplete bool) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	r, exists := f.releases[release]
+	if !exists {
+		return releaseNotFound(release)
+	}
+
+	return f.addRevision(r, chart, version, values, "Upgrade complete")
+}
+
+func (f *Fake) Delete(ctx context.Context, release string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if _, exists := f.releases[release]; !exists {
+		return releaseNotFound(release)
+	}
+
+	delete(f.releases, release)
+	return nil
+}
+
+func (f *Fake) Rollback(ctx context.Context, release string, revision int) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	r, exists := f.releases[release]
+	if !exists {
+		return releaseNotFound(release)
+	}
+
+	if revision < 1 || revision > len(r.revisions) {
+		return fmt.Errorf("Error: release %s has no revision %d", release, revision)
+	}
+
+	target := r.revisions[revision-1]
+
+	return f.addRevision(r, target.Chart, "", r.values[revision-1], fmt.Sprintf("Rollback to %d", revision))
+}
+
+func (f *Fake) Exists(ctx context.Context, release string) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	_, exists := f.releases[release]
+	return exists, nil
+}
+
+func (f *Fake) GetStatus(ctx context.Context, release string) (Status, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	status := Status{
+		Services: make(map[string]kubectl.Service),
+	}
+
+	r, exists := f.releases[release]
+	if !exists {
+		return status, releaseNotFound(release)
+	}
+
+	latest := r.revisions[len(r.revisions)-1]
+
+	status.Name = release
+	status.Namespace = r.namespace
+	status.IsDeployed = latest.Status == "DEPLOYED"
+	status.IsFailed = latest.Status == "FAILED"
+	status.DeploymentTime, _ = latest.UpdatedTime()
+	status.addResources(f.Resources[release])
+
+	return status, nil
+}
+
+func (f *Fake) GetValues(ctx context.Context, release string) (map[string]interface{}, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	r, exists := f.releases[release]
+	if !exists {
+		return nil, releaseNotFound(release)
+	}
+
+	return copyValues(r.values[len(r.values)-1])
+}
+
+func (f *Fake) GetRevisionValues(ctx context.Context, release string, revision int) (map[string]interface{}, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	r, exists := f.releases[release]
+	if !exists {
+		return nil, releaseNotFound(release)
+	}
+
+	if revision < 1 || revision > len(r.values) {
+		return nil, fmt.Errorf("Error: release %s has no revision %d", release, revision)
+	}
+
+	return copyValues(r.values[revision-1])
+}
+
+func (f *Fake) History(ctx context.Context, release string, max int) ([]Revision, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	r, exists := f.releases[release]
+	if !exists {
+		return nil, releaseNotFound(release)
+	}
+
+	revisions := r.revisions
+	if max > 0 && len(revisions) > max {
+		revisions = revisions[len(revisions)-max:]
+	}
+
+	return append([]Revision(nil), revisions...), nil
+}
+
+func (f *Fake) ListReleases(ctx context.Context, namespace string) ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var names []string
+	for name, r := range f.releases {
+		if r.namespace == namespace {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (f *Fake) ListAll(ctx context.Context) ([]ListedRelease, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var releases []ListedRelease
+	for name, r := range f.releases {
+		releases = append(releases, ListedRelease{
+			Name:      name,
+			Namespace: r.namespace,
+			Revision:  r.revisions[len(r.revisions)-1].Revision,
+			Status:    r.revisions[len(r.revisions)-1].Status,
+		})
+	}
+
+	sort.Slice(releases, func(i, j int) bool {
+		return releases[i].Name < releases[j].Name
+	})
+	return releases, nil
+}
+
+func (f *Fake) ListCharts(ctx context.Context) (map[string]Chart, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	charts := make(map[string]Chart)
+	for name, chart := range f.Charts {
+		charts[name] = chart
+	}
+
+	return charts, nil
+}
+
+func (f *Fake) RepoAdd(ctx context.Context, name string, repoURI string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.repos[name] = repoURI
+	return nil
+}
+
+func (f *Fake) Repos(ctx context.Context) (map[string]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	repos := map[string]string{}
+	for name, url := range f.repos {
+		repos[name] = url
+	}
+
+	return repos, nil
+}
+
+func (f *Fake) RepoUpdate(ctx context.Context) error {
+	return nil
+}
+
+func (f *Fake) IsReady(ctx context.Context) error {
+	return f.NotReady
+}
@@ -1,19 +1,47 @@
 package helm
 
 import (
-	"bufio"
-	"bytes"
-	"errors"
-	"net/url"
-	"os/exec"
-	"strconv"
+	"context"
+	"fmt"
 	"strings"
 	"time"
 
 	"github.com/monostream/helmi/pkg/kubectl"
-	"gopkg.in/yaml.v2"
 )
 
+// Releases, charts and repositories of Helm
+type Client interface {
+	Install(ctx context.Context, release string, chart string, version string, values map[string]interface{}, namespace string, acceptsIncomplete bool) error
+	Upgrade(ctx context.Context, release string, chart string, version string, values map[string]interface{}, acceptsIncomplete bool) error
+	// Deletes and purges a release
+	Delete(ctx context.Context, release string) error
+	// Rolls a release back to a previous revision
+	Rollback(ctx context.Context, release string, revision int) error
+
+	Exists(ctx context.Context, release string) (bool, error)
+	GetStatus(ctx context.Context, release string) (Status, error)
+	// Returns the computed values of a release, including the defaults of its chart
+	GetValues(ctx context.Context, release string) (map[string]interface{}, error)
+	// Returns the computed values of a revision of a release
+	GetRevisionValues(ctx context.Context, release string, revision int) (map[string]interface{}, error)
+	// Returns the last revisions of a release, the newest revision comes last
+	History(ctx context.Context, release string, max int) ([]Revision, error)
+	// Returns the names of all releases in the namespace, including failed ones
+	ListReleases(ctx context.Context, namespace string) ([]string, error)
+	// Returns the releases of all namespaces
+	ListAll(ctx context.Context) ([]ListedRelease, error)
+
+	// Returns the latest version of every chart in the repositories by `<repository>/<chart>`
+	ListCharts(ctx context.Context) (map[string]Chart, error)
+	RepoAdd(ctx context.Context, name string, repoURI string) error
+	// Returns the URLs of the repositories by name
+	Repos(ctx context.Context) (map[string]string, error)
+	RepoUpdate(ctx context.Context) error
+
+	// Returns an error if releases can not be managed, e.g. because tiller is not reachable
+	IsReady(ctx context.Context) error
+}
+
 type Chart struct {
 	Name        string
 	Description string
@@ -22,75 +50,6 @@ type Chart struct {
 	ChartVersion string
 }
 
-func ListCharts() (map[string]Chart, error) {
-	cmd := exec.Command("helm", "search")
-	output, err := cmd.CombinedOutput()
-
-	if err != nil {
-		return nil, err
-	}
-
-	charts := make(map[string]Chart)
-
-	scanner := bufio.NewScanner(bytes.NewReader(output))
-
-	const NameLabel = "NAME"
-	const DescriptionLabel = "DESCRIPTION"
-	const AppVersionLabel = "APP VERSION"
-	const ChartVersionLabel = "CHART VERSION"
-
-	columnName := -1
-	columnDescription := -1
-	columnAppVersion := -1
-	columnChartVersion := -1
-
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		indexName := strings.Index(line, NameLabel)
-		indexDescription := strings.Index(line, DescriptionLabel)
-		indexAppVersion := strings.Index(line, AppVersionLabel)
-		indexChartVersion := strings.Index(line, ChartVersionLabel)
-
-		if indexName >= 0 && indexDescription >= 0 && indexAppVersion >= 0 && indexChartVersion >= 0 {
-			columnName = indexName
-			columnDescription = indexDescription
-
-			columnAppVersion = indexAppVersion
-			columnChartVersion = indexChartVersion
-		} else {
-			if columnName >= 0 && columnDescription >= 0 && columnAppVersion >= 0 && columnChartVersion >= 0 {
-				name := strings.Fields(line[columnName:])[0]
-				chartVersion := strings.Fields(line[columnChartVersion:])[0]
-
-				// the next fields can be empty
-				descriptionSlice := strings.Fields(line[columnDescription:])
-				description := ""
-				if len(descriptionSlice) > 0 {
-					description = descriptionSlice[0]
-				}
-				appVersionSlice := strings.Fields(line[columnAppVersion:])
-				appVersion := ""
-				if len(appVersionSlice) > 0 {
-					appVersion = appVersionSlice[0]
-				}
-
-				chart := Chart{
-					Name:        name,
-					Description: description,
-
-					AppVersion:   appVersion,
-					ChartVersion: chartVersion,
-				}
-
-				charts[chart.Name] = chart
-			}
-		}
-	}
-
-	return charts, nil
-}
-
 type Status struct {
 	Name       string
 	Namespace  string
@@ -102,377 +61,92 @@ type Status struct {
 
 	Services       map[string]kubectl.Service
 	DeploymentTime time.Time
-}
-
-func (s *Status) IsAvailable() bool {
-	pendingServices := 0
 
-	for _, svc := range s.Services {
-		if svc.Type == "LoadBalancer" && len(svc.ExternalIP) == 0 {
-			pendingServices++
-		}
-	}
-
-	return !s.IsFailed &&
-		s.IsDeployed &&
-		s.AvailableNodes >= s.DesiredNodes &&
-		pendingServices == 0
+	// readiness of the objects in the manifest of the release
+	Resources []kubectl.Resource
 }
 
-func Exists(release string) (bool, error) {
-	cmd := exec.Command("helm", "status", release)
-	output, err := cmd.CombinedOutput()
-
-	if err == nil && len(output) > 0 {
-		return true, nil
-	}
-
-	if output != nil && len(output) > 0 {
-		text := string(output)
-
-		if strings.Contains(strings.ToLower(text), "not found") {
-			return false, nil
+// Adds the readiness of objects of the release, counting the replicas of workloads and keeping services by their
+// name without the release prefix
+// Objects of a deployed release missing in Kubernetes have been deleted since and do not come back on their own,
+// the release is failed. Jobs may be deleted once they finished, e.g. by ttlSecondsAfterFinished, and are ready.
+func (s *Status) addResources(resources []kubectl.Resource) {
+	for _, resource := range resources {
+		if resource.Missing {
+			if resource.Kind == "Job" {
+				resource.Ready = true
+				resource.Reason = ""
+			} else if s.IsDeployed {
+				s.IsFailed = true
+			}
 		}
-	}
-
-	return false, err
-}
 
-func Install(release string, chart string, version string, values map[string]interface{}, namespace string, acceptsIncomplete bool) error {
-	arguments := make([]string, 0)
-
-	arguments = append(arguments, "install", chart)
-	arguments = append(arguments, "--name", release)
-
-	if len(namespace) > 0 {
-		arguments = append(arguments, "--namespace", namespace)
-	}
-
-	if len(version) > 0 {
-		arguments = append(arguments, "--version", version)
-	}
-
-	if acceptsIncomplete == false {
-		arguments = append(arguments, "--wait")
-	}
-
-	if len(values) > 0 {
-		arguments = append(arguments, "--values", "-")
-	}
-
-	cmd := exec.Command("helm", arguments...)
-
-	if len(values) > 0 {
-		// pass values as yaml on stdin
-		buf, err := yaml.Marshal(values)
-		if err != nil {
-			return err
+		if resource.IsWorkload() {
+			s.DesiredNodes += resource.Desired
+			s.AvailableNodes += resource.Available
 		}
-		cmd.Stdin = bytes.NewReader(buf)
-	}
-
-	output, err := cmd.CombinedOutput()
-
-	if err != nil {
-		return errors.New(string(output[:]))
-	}
-
-	return nil
-}
-
-func Delete(release string) error {
-	cmd := exec.Command("helm", "delete", release, "--purge")
-	output, err := cmd.CombinedOutput()
-
-	if err != nil {
-		return errors.New(string(output[:]))
-	}
 
-	return nil
-}
-
-func GetValues(release string) (map[string]interface{}, error) {
-	cmd := exec.Command("helm", "get", "values", release, "--all")
-	output, err := cmd.Output()
-
-	if err != nil {
-		return nil, err
-	}
-
-	var values map[string]interface{}
-
-	err = yaml.Unmarshal(output, &values)
+		if resource.Service != nil {
+			s.Services[strings.TrimPrefix(resource.Name, s.Name+"-")] = *resource.Service
+		}
 
-	if err != nil {
-		return nil, err
+		s.Resources = append(s.Resources, resource)
 	}
-
-	return values, err
 }
 
-func GetStatus(release string) (Status, error) {
-	cmd := exec.Command("helm", "status", release)
-	output, err := cmd.CombinedOutput()
-
-	status := Status{
-		DesiredNodes:   0,
-		AvailableNodes: 0,
-
-		Services: make(map[string]kubectl.Service),
-	}
-
-	if err != nil {
-		return status, err
-	}
-
-	scanner := bufio.NewScanner(bytes.NewReader(output))
-
-	const StatusFailed = "STATUS: FAILED"
-	const StatusDeployed = "STATUS: DEPLOYED"
-
-	const ResourcePrefix = "==> "
-
-	const NamespacePrefix = "NAMESPACE: "
-	const DeploymentTimePrefix = "LAST DEPLOYED: "
-
-	const DesiredLabel = "DESIRED"
-	const CurrentLabel = "CURRENT"
-	const AvailableLabel = "AVAILABLE"
-
-	const NameLabel = "NAME"
+// Returns the objects of the release which are not ready
+func (s *Status) PendingResources() []kubectl.Resource {
+	var pending []kubectl.Resource
 
-	var lastResource string
-	var lastDeploymentTime time.Time
-
-	columnDesired := -1
-	columnCurrent := -1
-	columnAvailable := -1
-
-	columnName := -1
-
-	// our name
-	status.Name = release
-
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		if strings.HasPrefix(line, StatusFailed) {
-			status.IsFailed = true
-		}
-
-		if strings.HasPrefix(line, StatusDeployed) {
-			status.IsDeployed = true
-		}
-
-		if len(line) == 0 {
-			lastResource = ""
-
-			columnDesired = -1
-			columnCurrent = -1
-			columnAvailable = -1
-
-			columnName = -1
-		}
-
-		if strings.HasPrefix(line, ResourcePrefix) {
-			lastResource = strings.TrimPrefix(line, ResourcePrefix)
-		}
-
-		// namespace
-		if strings.HasPrefix(line, NamespacePrefix) {
-			status.Namespace = strings.TrimPrefix(line, NamespacePrefix)
-		}
-
-		// deployment time
-		if strings.HasPrefix(line, DeploymentTimePrefix) {
-			loc, _ := time.LoadLocation("Local")
-			lastDeploymentTime, _ = time.ParseInLocation(time.ANSIC, strings.TrimPrefix(line, DeploymentTimePrefix), loc)
-			status.DeploymentTime = lastDeploymentTime
-		}
-
-		// deployment columns
-		indexDesired := strings.Index(line, DesiredLabel)
-		indexCurrent := strings.Index(line, CurrentLabel)
-		indexAvailable := strings.Index(line, AvailableLabel)
-
-		if indexDesired >= 0 && indexCurrent >= 0 {
-			columnDesired = indexDesired
-			columnCurrent = indexCurrent
-
-			if indexAvailable >= 0 {
-				columnAvailable = indexAvailable
-			}
-		} else {
-			if columnDesired >= 0 && columnCurrent >= 0 {
-				nodesDesired := 0
-				nodesAvailable := 0
-
-				desired, desiredErr := strconv.Atoi(strings.Fields(line[columnDesired:])[0])
-				current, currentErr := strconv.Atoi(strings.Fields(line[columnCurrent:])[0])
-
-				if desiredErr == nil {
-					nodesDesired = desired
-				}
-
-				if currentErr == nil {
-					nodesAvailable = current
-				}
-
-				if columnAvailable >= 0 {
-					available, availableErr := strconv.Atoi(strings.Fields(line[columnAvailable:])[0])
-
-					if availableErr == nil {
-						nodesAvailable = available
-					}
-				}
-
-				status.DesiredNodes += nodesDesired
-				status.AvailableNodes += nodesAvailable
-			}
-		}
-
-		// service columns
-		indexName := strings.Index(line, NameLabel)
-
-		if indexName >= 0 {
-			columnName = indexName
-		} else {
-			if columnName >= 0 && lastResource == "v1/Service" {
-				svcName := strings.Fields(line[columnName:])[0]
-				shortName := strings.TrimPrefix(svcName, release+"-")
-
-				svc, err := kubectl.GetService(svcName, status.Namespace)
-
-				if err != nil {
-					return Status{}, err
-				}
-
-				status.Services[shortName] = svc
-			}
+	for _, resource := range s.Resources {
+		if !resource.Ready {
+			pending = append(pending, resource)
 		}
 	}
 
-	return status, err
+	return pending
 }
 
-func IsReady() error {
-	cmd := exec.Command("helm", "list", "--short")
-
-	stderr := new(bytes.Buffer)
-	cmd.Stderr = stderr
-
-	err := cmd.Run()
-
-	if _, exited := err.(*exec.ExitError); exited {
-		msg := strings.TrimSpace(stderr.String())
-		err = errors.New(msg)
-	}
-
-	return err
+func (s *Status) IsAvailable() bool {
+	return !s.IsFailed &&
+		s.IsDeployed &&
+		s.AvailableNodes >= s.DesiredNodes &&
+		len(s.PendingResources()) == 0
 }
 
-func RepoAdd(name string, repoURI string) error {
-	uri, err := url.Parse(repoURI)
-
-	if err != nil {
-		return err
-	}
-
-	// extract and remove username and password form uri
-	username := ""
-	password := ""
-	if uri.User != nil {
-		username = uri.User.Username()
-		password, _ = uri.User.Password()
-		uri.User = nil
-	}
-
-	args := []string{"repo", "add", name, uri.String()}
-
-	if len(username) > 0 {
-		args = append(args, "--username", username)
-	}
+// Describes why an object is not ready, e.g. `StatefulSet/helmi-abc-mariadb: 0/1 ready`
+func DescribeResource(resource kubectl.Resource) string {
+	description := resource.Kind + "/" + resource.Name + ": "
 
-	if len(password) > 0 {
-		args = append(args, "--password", password)
+	if len(resource.Reason) > 0 {
+		return description + resource.Reason
 	}
 
-	cmd := exec.Command("helm", args...)
-
-	stderr := new(bytes.Buffer)
-	cmd.Stderr = stderr
-
-	err = cmd.Run()
-
-	if _, exited := err.(*exec.ExitError); exited {
-		msg := strings.TrimSpace(stderr.String())
-		return errors.New(msg)
+	if resource.Kind == "Job" {
+		return description + fmt.Sprintf("%d/%d completed", resource.Available, resource.Desired)
 	}
 
-	return nil
+	return description + fmt.Sprintf("%d/%d ready", resource.Available, resource.Desired)
 }
 
-func Repos() (map[string]string, error) {
-	repos := map[string]string{}
-
-	cmd := exec.Command("helm", "repo", "list")
-	output, err := cmd.CombinedOutput()
-
-	if err != nil {
-		data := strings.TrimSpace(string(output))
-
-		if strings.Contains(data, "no repositories to show") {
-			return repos, nil
-		}
-
-		return nil, err
-	}
-
-	scanner := bufio.NewScanner(bytes.NewReader(output))
-
-	const NameLabel = "NAME"
-	const URLLabel = "URL"
-
-	columnName := -1
-	columnURL := -1
-
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		indexName := strings.Index(line, NameLabel)
-		indexURL := strings.Index(line, URLLabel)
-
-		if indexName >= 0 && indexURL >= 0 {
-			columnName = indexName
-			columnURL = indexURL
-		} else {
-			if columnName >= 0 && columnURL >= 0 {
-				name := strings.Fields(line[columnName:])[0]
-				url := strings.Fields(line[columnURL:])[0]
-
-				repos[name] = url
-			}
-		}
-	}
-
-	return repos, nil
+// Release as listed by helm list
+type ListedRelease struct {
+	Name      string
+	Namespace string
+	Revision  int
+	Status    string
 }
-func RepoUpdate() error {
-	if repos, err := Repos(); err == nil && len(repos) == 0 {
-		return nil
-	}
-
-	cmd := exec.Command("helm", "repo", "update")
 
-	stderr := new(bytes.Buffer)
-	cmd.Stderr = stderr
-
-	err := cmd.Run()
-
-	if _, exited := err.(*exec.ExitError); exited {
-		msg := strings.TrimSpace(stderr.String())
-		err = errors.New(msg)
-	}
+type Revision struct {
+	Revision    int    `json:"revision"`
+	Updated     string `json:"updated"`
+	Status      string `json:"status"`
+	Chart       string `json:"chart"`
+	Description string `json:"description"`
+}
 
-	return err
+// Returns the time the revision was last updated at
+func (r Revision) UpdatedTime() (time.Time, error) {
+	loc, _ := time.LoadLocation("Local")
+	return time.ParseInLocation(time.ANSIC, r.Updated, loc)
 }
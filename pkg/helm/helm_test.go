@@ -1,9 +1,16 @@
 package helm
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/monostream/helmi/pkg/kubectl"
 )
 
 func red(msg string) string {
@@ -39,3 +46,287 @@ func Test_Exists(t *testing.T) {
 		t.Errorf("Expected %q, got %q", true, out)
 	}*/
 }
+
+func writeHelmHome(t *testing.T) string {
+	home, err := ioutil.TempDir("", "helm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.MkdirAll(filepath.Join(home, "repository", "cache"), 0700)
+
+	ioutil.WriteFile(filepath.Join(home, "repository", "repositories.yaml"), []byte(`
+apiVersion: v1
+repositories:
+- name: monostream
+  url: http://helm-charts.monocloud.io
+  cache: monostream-index.yaml
+`), 0600)
+
+	ioutil.WriteFile(filepath.Join(home, "repository", "cache", "monostream-index.yaml"), []byte(`
+apiVersion: v1
+entries:
+  mariadb:
+  - name: mariadb
+    version: 2.0.0-rc1
+  - name: mariadb
+    version: 1.10.0
+    appVersion: 10.1.34
+    description: Fast, reliable, scalable, and easy to use open-source relational database system.
+  - name: mariadb
+    version: 1.9.2
+`), 0600)
+
+	return home
+}
+
+func Test_CLIRepositories(t *testing.T) {
+	home := writeHelmHome(t)
+	defer os.RemoveAll(home)
+
+	cli := &CLI{home: home}
+
+	repos, err := cli.Repos(context.Background())
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	if repos["monostream"] != "http://helm-charts.monocloud.io" {
+		t.Error(red("repositories should be read from repositories.yaml"))
+	}
+
+	charts, err := cli.ListCharts(context.Background())
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	chart, ok := charts["monostream/mariadb"]
+	if !ok || chart.ChartVersion != "1.10.0" || chart.AppVersion != "10.1.34" {
+		t.Error(red(fmt.Sprintf("latest stable chart version expected, got %v", chart)))
+	}
+
+	empty := &CLI{home: filepath.Join(home, "missing")}
+	if repos, err := empty.Repos(context.Background()); err != nil || len(repos) > 0 {
+		t.Error(red("helm home without repositories should have none"))
+	}
+}
+
+// Writes a helm binary which logs its commands, lists the release in namespace ns1 and fails rollbacks to revision 0
+func writeHelm3Binary(t *testing.T, dir string) string {
+	binary := filepath.Join(dir, "helm")
+
+	ioutil.WriteFile(binary, []byte(`#!/bin/sh
+echo "$*" >> "`+filepath.Join(dir, "commands")+`"
+case "$1" in
+list) echo '[{"name": "helmirelease", "namespace": "ns1", "revision": "2", "status": "deployed"}]' ;;
+rollback) [ "$3" != "0" ] || { echo "Error: invalid revision" >&2; exit 1; } ;;
+esac
+`), 0700)
+
+	return binary
+}
+
+func Test_Helm3NamespaceCache(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "helm3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cli := NewHelm3CLI(writeHelm3Binary(t, dir))
+
+	lookups := func() int {
+		commands, _ := ioutil.ReadFile(filepath.Join(dir, "commands"))
+		return strings.Count(string(commands), "list --all")
+	}
+
+	cli.Rollback(ctx, "helmirelease", 1)
+	cli.Rollback(ctx, "helmirelease", 1)
+	if lookups() != 1 {
+		t.Error(red(fmt.Sprintf("namespace should be looked up once, got %d lookups", lookups())))
+	}
+
+	if err := cli.Rollback(ctx, "helmirelease", 0); err == nil {
+		t.Error(red("failed rollback should return an error"))
+	}
+	cli.Rollback(ctx, "helmirelease", 1)
+	if lookups() != 2 {
+		t.Error(red("namespace should be looked up again after a failed command"))
+	}
+
+	cli.Delete(ctx, "helmirelease")
+	cli.Rollback(ctx, "helmirelease", 1)
+	if lookups() != 3 {
+		t.Error(red("namespace should be looked up again after the release has been deleted"))
+	}
+
+	cli.Install(ctx, "helmiother", "chart", "", nil, "ns2", true)
+	cli.Rollback(ctx, "helmiother", 1)
+	if lookups() != 3 {
+		t.Error(red("namespace of an installed release should not be looked up"))
+	}
+
+	commands, _ := ioutil.ReadFile(filepath.Join(dir, "commands"))
+	if !strings.Contains(string(commands), "rollback helmiother 1 --namespace ns2") {
+		t.Error(red("commands should run in the namespace of the release"))
+	}
+
+	if exists, _ := cli.Exists(ctx, "helmiother"); exists || lookups() != 4 {
+		t.Error(red("existence of a release should always be looked up"))
+	}
+}
+
+func Test_Fake(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFake()
+
+	err := fake.Install(ctx, "release", "monostream/mariadb", "1.10.0", map[string]interface{}{"size": "small"}, "default", true)
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	if fake.Install(ctx, "release", "monostream/mariadb", "", nil, "default", true) == nil {
+		t.Error(red("installing an existing release should fail"))
+	}
+
+	fake.Upgrade(ctx, "release", "monostream/mariadb", "1.10.0", map[string]interface{}{"size": "large"}, true)
+	fake.Rollback(ctx, "release", 1)
+
+	values, _ := fake.GetValues(ctx, "release")
+	if values["size"] != "small" {
+		t.Error(red("rollback should restore the values of the revision"))
+	}
+
+	history, _ := fake.History(ctx, "release", 2)
+	if len(history) != 2 || history[1].Revision != 3 || history[0].Status != "SUPERSEDED" {
+		t.Error(red(fmt.Sprintf("unexpected history %v", history)))
+	}
+
+	status, _ := fake.GetStatus(ctx, "release")
+	if !status.IsDeployed || status.Namespace != "default" {
+		t.Error(red("release should be deployed to its namespace"))
+	}
+
+	fake.Delete(ctx, "release")
+	if exists, _ := fake.Exists(ctx, "release"); exists {
+		t.Error(red("deleted release should not exist"))
+	}
+}
+
+func Test_Helm2Status(t *testing.T) {
+	statuses := map[string]string{
+		"deployed":        "DEPLOYED",
+		"pending-upgrade": "PENDING_UPGRADE",
+		"uninstalled":     "DELETED",
+		"uninstalling":    "DELETING",
+	}
+
+	for status, expected := range statuses {
+		if helm2Status(status) != expected {
+			t.Error(red(fmt.Sprintf("status %s should be %s, got %s", status, expected, helm2Status(status))))
+		}
+	}
+}
+
+func Test_ManifestObjects(t *testing.T) {
+	manifest := `---
+# Source: mariadb/templates/svc.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: helmi-release-mariadb
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: helmi-release-mariadb
+  namespace: other
+---
+`
+
+	objects, err := manifestObjects(manifest, "default")
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	if len(objects) != 2 {
+		t.Fatal(red(fmt.Sprintf("expected 2 objects, got %v", objects)))
+	}
+
+	if objects[0].Kind != "Service" || objects[0].Namespace != "default" {
+		t.Error(red("objects without a namespace should be in the namespace of the release"))
+	}
+
+	if objects[1].Kind != "StatefulSet" || objects[1].Namespace != "other" {
+		t.Error(red("objects should keep their namespace"))
+	}
+}
+
+func Test_StatusResources(t *testing.T) {
+	status := Status{
+		Name:       "helmi-release",
+		IsDeployed: true,
+		Services:   make(map[string]kubectl.Service),
+	}
+
+	service := kubectl.Service{Type: "LoadBalancer"}
+
+	status.addResources([]kubectl.Resource{
+		{Object: kubectl.Object{Kind: "Deployment", Name: "helmi-release-web"}, Ready: true, Desired: 2, Available: 2},
+		{Object: kubectl.Object{Kind: "Service", Name: "helmi-release-web"}, Reason: "waiting for a load balancer", Service: &service},
+		{Object: kubectl.Object{Kind: "Job", Name: "helmi-release-init"}, Desired: 1},
+	})
+
+	if status.DesiredNodes != 2 || status.AvailableNodes != 2 {
+		t.Error(red("only replicas of workloads should be counted"))
+	}
+
+	if _, ok := status.Services["web"]; !ok {
+		t.Error(red("services should be kept by their name without the release prefix"))
+	}
+
+	if status.IsAvailable() {
+		t.Error(red("release with pending resources should not be available"))
+	}
+
+	var descriptions []string
+	for _, resource := range status.PendingResources() {
+		descriptions = append(descriptions, DescribeResource(resource))
+	}
+
+	expected := "Service/helmi-release-web: waiting for a load balancer, Job/helmi-release-init: 0/1 completed"
+	if strings.Join(descriptions, ", ") != expected {
+		t.Error(red(fmt.Sprintf("expected %s, got %v", expected, descriptions)))
+	}
+}
+
+func Test_StatusMissingResources(t *testing.T) {
+	status := Status{
+		Name:       "helmi-release",
+		IsDeployed: true,
+		Services:   make(map[string]kubectl.Service),
+	}
+
+	status.addResources([]kubectl.Resource{
+		{Object: kubectl.Object{Kind: "Job", Name: "helmi-release-init"}, Reason: "not found", Missing: true},
+	})
+
+	if status.IsFailed || !status.IsAvailable() {
+		t.Error(red("release whose finished job has been deleted should be available"))
+	}
+
+	status.addResources([]kubectl.Resource{
+		{Object: kubectl.Object{Kind: "Deployment", Name: "helmi-release-web"}, Reason: "not found", Missing: true},
+	})
+
+	if !status.IsFailed {
+		t.Error(red("deployed release with a missing deployment should be failed"))
+	}
+
+	pending := status.PendingResources()
+	if len(pending) != 1 || DescribeResource(pending[0]) != "Deployment/helmi-release-web: not found" {
+		t.Error(red(fmt.Sprintf("missing deployment should be pending, got %v", pending)))
+	}
+}
@@ -0,0 +1,73 @@
+package helm
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/monostream/helmi/pkg/kubectl"
+	"gopkg.in/yaml.v2"
+)
+
+// Object of a release manifest
+type manifestObject struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+}
+
+// Returns the objects of a release manifest, objects without a namespace are in the one of the release
+func manifestObjects(manifest string, namespace string) ([]kubectl.Object, error) {
+	decoder := yaml.NewDecoder(strings.NewReader(manifest))
+
+	var objects []kubectl.Object
+
+	for {
+		var object manifestObject
+
+		err := decoder.Decode(&object)
+		if err == io.EOF {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// empty documents between separators
+		if len(object.Kind) == 0 {
+			continue
+		}
+
+		if len(object.Metadata.Namespace) == 0 {
+			object.Metadata.Namespace = namespace
+		}
+
+		objects = append(objects, kubectl.Object{
+			Kind:      object.Kind,
+			Name:      object.Metadata.Name,
+			Namespace: object.Metadata.Namespace,
+		})
+	}
+}
+
+// Adds the readiness of the objects in a release manifest to its status
+func addManifestResources(ctx context.Context, status *Status, manifest string) error {
+	objects, err := manifestObjects(manifest, status.Namespace)
+	if err != nil {
+		return err
+	}
+
+	if len(objects) == 0 {
+		return nil
+	}
+
+	resources, err := kubectl.GetResources(ctx, objects)
+	if err != nil {
+		return err
+	}
+
+	status.addResources(resources)
+	return nil
+}
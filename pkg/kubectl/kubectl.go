@@ -1,19 +1,35 @@
 package kubectl
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
-
+	"sync"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/flowcontrol"
 )
 
 const HelmiSvcDomain = "monostream.com/helmi-svc-domain"
 
+var ErrNotFound = errors.New("kubernetes object not found")
+var ErrLeaseHeld = errors.New("lease is held by another holder")
+var ErrAlreadyExists = errors.New("kubernetes object exists already")
+
 type Node struct {
 	Name string
 
@@ -25,6 +41,30 @@ type Node struct {
 type Namespace struct {
 	Name          string
 	IngressDomain string
+	Labels        map[string]string
+	Annotations   map[string]string
+}
+
+// Namespace created with a quota and default limits for its containers
+type NamespaceSpec struct {
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+
+	// hard limits of the resource quota, e.g. `requests.cpu: 4`
+	ResourceQuota map[string]string
+	LimitRanges   []LimitRange
+	// creates a NetworkPolicy which only admits ingress from pods of the namespace itself
+	DefaultDenyNetworkPolicy bool
+}
+
+type LimitRange struct {
+	// Container, Pod or PersistentVolumeClaim
+	Type           string
+	Default        map[string]string
+	DefaultRequest map[string]string
+	Max            map[string]string
+	Min            map[string]string
 }
 
 type Service struct {
@@ -35,36 +75,114 @@ type Service struct {
 	ClusterIP    string
 }
 
-func createClient() (*kubernetes.Clientset, error) {
-	homePath := os.Getenv("HOME")
+type Secret struct {
+	Name        string
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+	Data        map[string]string
+}
 
-	if homePath == "" {
-		os.Getenv("USERPROFILE")
+type Job struct {
+	Image   string
+	Command []string
+	Args    []string
+
+	// keys of this secret are passed as environment variables
+	SecretName string
+}
+
+// Configuration, authenticated transport and rate limit of the Kubernetes API, set up once and shared by all clients
+var connection struct {
+	sync.Mutex
+
+	config      *rest.Config
+	transport   http.RoundTripper
+	rateLimiter flowcontrol.RateLimiter
+}
+
+// Connects to the API server of the configuration instead of the one of the kube config or the cluster, e.g. in tests
+func Configure(config *rest.Config) error {
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return err
 	}
 
-	configPath := filepath.Join(homePath, ".kube", "config")
+	qps, burst := config.QPS, config.Burst
+	if qps == 0 {
+		qps, burst = rest.DefaultQPS, rest.DefaultBurst
+	}
 
-	if _, err := os.Stat(configPath); err == nil {
-		config, err := clientcmd.BuildConfigFromFlags("", configPath)
+	connection.Lock()
+	defer connection.Unlock()
 
+	connection.config = config
+	connection.transport = transport
+	connection.rateLimiter = flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+
+	return nil
+}
+
+// Returns a client whose requests are cancelled when the context is done. The typed clients of this client-go version
+// do not take a context, so the client is a lightweight wrapper around the shared connection which binds the context.
+func createClient(ctx context.Context) (kubernetes.Interface, error) {
+	connection.Lock()
+	configured := connection.config != nil
+	connection.Unlock()
+
+	if !configured {
+		config, err := clientConfig()
 		if err != nil {
 			return nil, err
 		}
 
-		return kubernetes.NewForConfig(config)
+		err = Configure(config)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	config, err := rest.InClusterConfig()
+	connection.Lock()
+	defer connection.Unlock()
+
+	return kubernetes.NewForConfig(&rest.Config{
+		Host:        connection.config.Host,
+		APIPath:     connection.config.APIPath,
+		UserAgent:   connection.config.UserAgent,
+		Timeout:     connection.config.Timeout,
+		RateLimiter: connection.rateLimiter,
+		Transport:   &contextTransport{ctx: ctx, next: connection.transport},
+	})
+}
 
-	if err != nil {
-		return nil, err
+func clientConfig() (*rest.Config, error) {
+	homePath := os.Getenv("HOME")
+
+	if homePath == "" {
+		os.Getenv("USERPROFILE")
+	}
+
+	configPath := filepath.Join(homePath, ".kube", "config")
+
+	if _, err := os.Stat(configPath); err == nil {
+		return clientcmd.BuildConfigFromFlags("", configPath)
 	}
 
-	return kubernetes.NewForConfig(config)
+	return rest.InClusterConfig()
+}
+
+// Cancels requests to the Kubernetes API when the context is done
+type contextTransport struct {
+	ctx  context.Context
+	next http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.next.RoundTrip(r.WithContext(t.ctx))
 }
 
-func GetNodes() ([]Node, error) {
-	clientset, err := createClient()
+func GetNodes(ctx context.Context) ([]Node, error) {
+	clientset, err := createClient(ctx)
 
 	if err != nil {
 		return nil, err
@@ -103,57 +221,222 @@ func GetNodes() ([]Node, error) {
 	return nodes, nil
 }
 
-func GetNamespaceByName(name string) (Namespace, error) {
-	client, err := createClient()
+func GetNamespaceByName(ctx context.Context, name string) (Namespace, error) {
+	client, err := createClient(ctx)
 	if err != nil {
 		return Namespace{}, err
 	}
 
 	item, err := client.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
 	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return Namespace{}, ErrNotFound
+		}
 		return Namespace{}, err
 	}
 
-	namespace := Namespace{
+	return namespaceFromItem(item), nil
+}
+
+func GetNamespaces(ctx context.Context, selector map[string]string) ([]Namespace, error) {
+	namespaces := make([]Namespace, 0)
+
+	client, err := createClient(ctx)
+
+	if err != nil {
+		return namespaces, err
+	}
+
+	items, err := client.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: labelSelector(selector)})
+
+	if err != nil {
+		return namespaces, err
+	}
+
+	for _, item := range items.Items {
+		namespaces = append(namespaces, namespaceFromItem(&item))
+	}
+
+	return namespaces, nil
+}
+
+func namespaceFromItem(item *corev1.Namespace) Namespace {
+	return Namespace{
 		Name:          item.Name,
 		IngressDomain: item.Annotations[HelmiSvcDomain],
+		Labels:        item.Labels,
+		Annotations:   item.Annotations,
+	}
+}
+
+// Creates a namespace with its resource quota, limit range and network policy, returns ErrAlreadyExists if the namespace exists
+func CreateNamespace(ctx context.Context, spec NamespaceSpec) error {
+	client, err := createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	quota, err := resourceList(spec.ResourceQuota)
+	if err != nil {
+		return err
+	}
+
+	limits := make([]corev1.LimitRangeItem, 0, len(spec.LimitRanges))
+	for _, limitRange := range spec.LimitRanges {
+		item, err := limitRangeItem(limitRange)
+		if err != nil {
+			return err
+		}
+		limits = append(limits, item)
+	}
+
+	_, err = client.CoreV1().Namespaces().Create(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        spec.Name,
+			Labels:      spec.Labels,
+			Annotations: spec.Annotations,
+		},
+	})
+	if apierrors.IsAlreadyExists(err) {
+		return ErrAlreadyExists
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(quota) > 0 {
+		_, err = client.CoreV1().ResourceQuotas(spec.Name).Create(&corev1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: "helmi-quota"},
+			Spec:       corev1.ResourceQuotaSpec{Hard: quota},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(limits) > 0 {
+		_, err = client.CoreV1().LimitRanges(spec.Name).Create(&corev1.LimitRange{
+			ObjectMeta: metav1.ObjectMeta{Name: "helmi-limits"},
+			Spec:       corev1.LimitRangeSpec{Limits: limits},
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	return namespace, nil
+	if spec.DefaultDenyNetworkPolicy {
+		_, err = client.NetworkingV1().NetworkPolicies(spec.Name).Create(&networkingv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "helmi-default-deny"},
+			Spec: networkingv1.NetworkPolicySpec{
+				// all pods of the namespace, reachable only by pods of the namespace unless other policies admit more
+				PodSelector: metav1.LabelSelector{},
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+				Ingress: []networkingv1.NetworkPolicyIngressRule{{
+					From: []networkingv1.NetworkPolicyPeer{{
+						PodSelector: &metav1.LabelSelector{},
+					}},
+				}},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func GetNamespaces(selector map[string]string) ([]Namespace, error) {
-	namespaces := make([]Namespace, 0)
+func limitRangeItem(limitRange LimitRange) (corev1.LimitRangeItem, error) {
+	item := corev1.LimitRangeItem{
+		Type: corev1.LimitType(limitRange.Type),
+	}
 
-	client, err := createClient()
+	var err error
+	for _, field := range []struct {
+		values map[string]string
+		target *corev1.ResourceList
+	}{
+		{limitRange.Default, &item.Default},
+		{limitRange.DefaultRequest, &item.DefaultRequest},
+		{limitRange.Max, &item.Max},
+		{limitRange.Min, &item.Min},
+	} {
+		*field.target, err = resourceList(field.values)
+		if err != nil {
+			return item, err
+		}
+	}
+
+	return item, nil
+}
+
+func resourceList(values map[string]string) (corev1.ResourceList, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	list := make(corev1.ResourceList, len(values))
+	for name, value := range values {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantity %s of %s: %s", value, name, err)
+		}
+		list[corev1.ResourceName(name)] = quantity
+	}
 
+	return list, nil
+}
+
+// Sets annotations of an existing namespace, other annotations are kept
+func AnnotateNamespace(ctx context.Context, name string, annotations map[string]string) error {
+	client, err := createClient(ctx)
 	if err != nil {
-		return namespaces, err
+		return err
 	}
 
-	var labels []string
-	for k, v := range selector {
-		labels = append(labels, fmt.Sprintf("%s=%s", k, v))
+	item, err := client.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return ErrNotFound
+		}
+		return err
 	}
 
-	items, err := client.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: strings.Join(labels, ",")})
+	if item.Annotations == nil {
+		item.Annotations = make(map[string]string)
+	}
+	for key, value := range annotations {
+		item.Annotations[key] = value
+	}
 
+	_, err = client.CoreV1().Namespaces().Update(item)
+	return err
+}
+
+func DeleteNamespace(ctx context.Context, name string) error {
+	client, err := createClient(ctx)
 	if err != nil {
-		return namespaces, err
+		return err
 	}
 
-	for _, item := range items.Items {
-		namespaces = append(namespaces, Namespace{
-			Name:          item.Name,
-			IngressDomain: item.Annotations[HelmiSvcDomain],
-		})
+	err = client.CoreV1().Namespaces().Delete(name, &metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return ErrNotFound
 	}
 
-	return namespaces, nil
+	return err
 }
 
-func GetService(name string, ns string) (Service, error) {
-	client, err := createClient()
+func labelSelector(selector map[string]string) string {
+	var labels []string
+	for k, v := range selector {
+		labels = append(labels, fmt.Sprintf("%s=%s", k, v))
+	}
+	return strings.Join(labels, ",")
+}
+
+func GetService(ctx context.Context, name string, ns string) (Service, error) {
+	client, err := createClient(ctx)
 
 	if err != nil {
 		return Service{}, err
@@ -165,6 +448,10 @@ func GetService(name string, ns string) (Service, error) {
 		return Service{}, err
 	}
 
+	return toService(svc), nil
+}
+
+func toService(svc *corev1.Service) Service {
 	service := Service{
 		Type:         string(svc.Spec.Type),
 		ClusterIP:    svc.Spec.ClusterIP,
@@ -188,5 +475,514 @@ func GetService(name string, ns string) (Service, error) {
 		}
 	}
 
-	return service, nil
+	return service
+}
+
+// Kubernetes object of a release, as declared in its manifest
+type Object struct {
+	Kind      string
+	Name      string
+	Namespace string
+}
+
+// Readiness of a Kubernetes object
+type Resource struct {
+	Object
+
+	Ready bool
+	// replicas of workloads, completions of jobs
+	Desired   int
+	Available int
+	// why the object is not ready
+	Reason string
+	// the object does not exist
+	Missing bool
+
+	// set for services
+	Service *Service
+}
+
+// Kinds whose replicas are counted
+func (r *Resource) IsWorkload() bool {
+	return r.Kind == "Deployment" || r.Kind == "StatefulSet" || r.Kind == "DaemonSet"
+}
+
+// Returns the readiness of the objects, objects of other kinds are ready if they exist.
+// Missing objects are not ready, every object is read with the same client.
+func GetResources(ctx context.Context, objects []Object) ([]Resource, error) {
+	client, err := createClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := make([]Resource, 0, len(objects))
+
+	for _, object := range objects {
+		resource, err := getResource(client, object)
+		if apierrors.IsNotFound(err) {
+			resource = Resource{Object: object, Reason: "not found", Missing: true}
+		} else if err != nil {
+			return nil, err
+		}
+
+		resources = append(resources, resource)
+	}
+
+	return resources, nil
+}
+
+func getResource(client kubernetes.Interface, object Object) (Resource, error) {
+	resource := Resource{Object: object}
+
+	switch object.Kind {
+	case "Deployment":
+		deployment, err := client.AppsV1().Deployments(object.Namespace).Get(object.Name, metav1.GetOptions{})
+		if err != nil {
+			return resource, err
+		}
+
+		resource.Desired = replicas(deployment.Spec.Replicas)
+		resource.Available = int(deployment.Status.AvailableReplicas)
+		resource.Ready = deployment.Status.ObservedGeneration >= deployment.Generation &&
+			int(deployment.Status.UpdatedReplicas) >= resource.Desired &&
+			resource.Available >= resource.Desired
+	case "StatefulSet":
+		statefulSet, err := client.AppsV1().StatefulSets(object.Namespace).Get(object.Name, metav1.GetOptions{})
+		if err != nil {
+			return resource, err
+		}
+
+		resource.Desired = replicas(statefulSet.Spec.Replicas)
+		resource.Available = int(statefulSet.Status.ReadyReplicas)
+		resource.Ready = statefulSet.Status.ObservedGeneration >= statefulSet.Generation &&
+			resource.Available >= resource.Desired
+	case "DaemonSet":
+		daemonSet, err := client.AppsV1().DaemonSets(object.Namespace).Get(object.Name, metav1.GetOptions{})
+		if err != nil {
+			return resource, err
+		}
+
+		resource.Desired = int(daemonSet.Status.DesiredNumberScheduled)
+		resource.Available = int(daemonSet.Status.NumberAvailable)
+		resource.Ready = daemonSet.Status.ObservedGeneration >= daemonSet.Generation &&
+			int(daemonSet.Status.UpdatedNumberScheduled) >= resource.Desired &&
+			resource.Available >= resource.Desired
+	case "Job":
+		job, err := client.BatchV1().Jobs(object.Namespace).Get(object.Name, metav1.GetOptions{})
+		if err != nil {
+			return resource, err
+		}
+
+		resource.Desired = replicas(job.Spec.Completions)
+		resource.Available = int(job.Status.Succeeded)
+		resource.Ready = resource.Available >= resource.Desired
+
+		for _, condition := range job.Status.Conditions {
+			if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+				resource.Reason = "failed: " + condition.Reason
+			}
+		}
+	case "PersistentVolumeClaim":
+		claim, err := client.CoreV1().PersistentVolumeClaims(object.Namespace).Get(object.Name, metav1.GetOptions{})
+		if err != nil {
+			return resource, err
+		}
+
+		resource.Ready = claim.Status.Phase == corev1.ClaimBound
+		if !resource.Ready {
+			resource.Reason = strings.ToLower(string(claim.Status.Phase))
+		}
+	case "Service":
+		svc, err := client.CoreV1().Services(object.Namespace).Get(object.Name, metav1.GetOptions{})
+		if err != nil {
+			return resource, err
+		}
+
+		service := toService(svc)
+
+		resource.Service = &service
+		resource.Ready = service.Type != string(corev1.ServiceTypeLoadBalancer) || len(service.ExternalIP) > 0
+		if !resource.Ready {
+			resource.Reason = "waiting for a load balancer"
+		}
+	default:
+		resource.Ready = true
+	}
+
+	return resource, nil
+}
+
+// Kubernetes defaults to one replica and one completion
+func replicas(desired *int32) int {
+	if desired == nil {
+		return 1
+	}
+	return int(*desired)
+}
+
+// Returns the labels of the config maps matching the selector
+func GetConfigMapLabels(ctx context.Context, ns string, selector map[string]string) ([]map[string]string, error) {
+	client, err := createClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := client.CoreV1().ConfigMaps(ns).List(metav1.ListOptions{LabelSelector: labelSelector(selector)})
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make([]map[string]string, 0, len(items.Items))
+	for _, item := range items.Items {
+		labels = append(labels, item.Labels)
+	}
+
+	return labels, nil
+}
+
+func CreateSecret(ctx context.Context, secret Secret) error {
+	client, err := createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	item := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secret.Name,
+			Namespace:   secret.Namespace,
+			Labels:      secret.Labels,
+			Annotations: secret.Annotations,
+		},
+		StringData: secret.Data,
+	}
+
+	_, err = client.CoreV1().Secrets(secret.Namespace).Create(item)
+
+	return err
+}
+
+// Replaces labels, annotations and data of an existing secret
+func UpdateSecret(ctx context.Context, secret Secret) error {
+	client, err := createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	item, err := client.CoreV1().Secrets(secret.Namespace).Get(secret.Name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	item.Labels = secret.Labels
+	item.Annotations = secret.Annotations
+	item.Data = nil
+	item.StringData = secret.Data
+
+	_, err = client.CoreV1().Secrets(secret.Namespace).Update(item)
+
+	return err
+}
+
+func GetSecret(ctx context.Context, name string, ns string) (Secret, error) {
+	client, err := createClient(ctx)
+	if err != nil {
+		return Secret{}, err
+	}
+
+	item, err := client.CoreV1().Secrets(ns).Get(name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return Secret{}, ErrNotFound
+		}
+		return Secret{}, err
+	}
+
+	return secretFromItem(item), nil
+}
+
+func DeleteSecret(ctx context.Context, name string, ns string) error {
+	client, err := createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = client.CoreV1().Secrets(ns).Delete(name, &metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// Deletes the secrets matching the label selector in all namespaces
+func DeleteSecrets(ctx context.Context, selector map[string]string) error {
+	client, err := createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	items, err := client.CoreV1().Secrets(metav1.NamespaceAll).List(metav1.ListOptions{LabelSelector: labelSelector(selector)})
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items.Items {
+		err = client.CoreV1().Secrets(item.Namespace).Delete(item.Name, &metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func secretFromItem(item *corev1.Secret) Secret {
+	secret := Secret{
+		Name:        item.Name,
+		Namespace:   item.Namespace,
+		Labels:      item.Labels,
+		Annotations: item.Annotations,
+		Data:        make(map[string]string),
+	}
+
+	for k, v := range item.Data {
+		secret.Data[k] = string(v)
+	}
+
+	return secret
+}
+
+// Runs a job to completion and removes it afterwards.
+// The job is given up if it does not complete within the timeout or the context is cancelled.
+func RunJob(ctx context.Context, name string, ns string, job Job, timeout time.Duration) error {
+	client, err := createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	backoffLimit := int32(2)
+
+	container := corev1.Container{
+		Name:    "job",
+		Image:   job.Image,
+		Command: job.Command,
+		Args:    job.Args,
+	}
+
+	if len(job.SecretName) > 0 {
+		container.EnvFrom = []corev1.EnvFromSource{
+			{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: job.SecretName}}},
+		}
+	}
+
+	item := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ns,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers:    []corev1.Container{container},
+				},
+			},
+		},
+	}
+
+	jobs := client.BatchV1().Jobs(ns)
+
+	_, err = jobs.Create(item)
+	if err != nil {
+		return err
+	}
+
+	// remove the job and its pods once it is done, even if the context has been cancelled
+	defer deleteJob(name, ns)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(time.Second * 2)
+	defer ticker.Stop()
+
+	for {
+		current, err := jobs.Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if current.Status.Succeeded > 0 {
+			return nil
+		}
+
+		for _, condition := range current.Status.Conditions {
+			if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+				return fmt.Errorf("job %s failed: %s", name, condition.Message)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("job %s did not complete within %s", name, timeout)
+			}
+			return fmt.Errorf("job %s was cancelled: %s", name, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func deleteJob(name string, ns string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	propagation := metav1.DeletePropagationBackground
+	return client.BatchV1().Jobs(ns).Delete(name, &metav1.DeleteOptions{PropagationPolicy: &propagation})
+}
+
+// Acquires the lease for the holder, leases of other holders are only taken over
+// if they have not been renewed within their duration
+func AcquireLease(ctx context.Context, name string, ns string, holder string, duration time.Duration) error {
+	client, err := createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	leases := client.CoordinationV1beta1().Leases(ns)
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(duration.Seconds())
+
+	item, err := leases.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = leases.Create(&coordinationv1beta1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: ns,
+			},
+			Spec: coordinationv1beta1.LeaseSpec{
+				HolderIdentity:       &holder,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		})
+
+		if apierrors.IsAlreadyExists(err) {
+			return ErrLeaseHeld
+		}
+		return err
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if isLeaseHeld(item, holder) {
+		return ErrLeaseHeld
+	}
+
+	item.Spec.HolderIdentity = &holder
+	item.Spec.LeaseDurationSeconds = &seconds
+	item.Spec.AcquireTime = &now
+	item.Spec.RenewTime = &now
+
+	// the resource version of the item makes sure no other holder took over in between
+	_, err = leases.Update(item)
+	if apierrors.IsConflict(err) {
+		return ErrLeaseHeld
+	}
+
+	return err
+}
+
+// Extends the lease of the holder by its duration
+func RenewLease(ctx context.Context, name string, ns string, holder string) error {
+	client, err := createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	leases := client.CoordinationV1beta1().Leases(ns)
+
+	item, err := leases.Get(name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	if !isLeaseHolder(item, holder) {
+		return ErrLeaseHeld
+	}
+
+	now := metav1.NewMicroTime(time.Now())
+	item.Spec.RenewTime = &now
+
+	_, err = leases.Update(item)
+	if apierrors.IsConflict(err) {
+		return ErrLeaseHeld
+	}
+
+	return err
+}
+
+// Deletes the lease if it is held by the holder
+func ReleaseLease(ctx context.Context, name string, ns string, holder string) error {
+	client, err := createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	leases := client.CoordinationV1beta1().Leases(ns)
+
+	item, err := leases.Get(name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if !isLeaseHolder(item, holder) {
+		return nil
+	}
+
+	// only delete the version of the lease which has been checked
+	err = leases.Delete(name, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &item.UID},
+	})
+	if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+		return nil
+	}
+
+	return err
+}
+
+func isLeaseHolder(item *coordinationv1beta1.Lease, holder string) bool {
+	return item.Spec.HolderIdentity != nil && *item.Spec.HolderIdentity == holder
+}
+
+// Returns true if another holder renewed the lease within its duration
+func isLeaseHeld(item *coordinationv1beta1.Lease, holder string) bool {
+	if item.Spec.HolderIdentity == nil || len(*item.Spec.HolderIdentity) == 0 || isLeaseHolder(item, holder) {
+		return false
+	}
+
+	if item.Spec.RenewTime == nil || item.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+
+	expires := item.Spec.RenewTime.Add(time.Duration(*item.Spec.LeaseDurationSeconds) * time.Second)
+	return time.Now().Before(expires)
 }
@@ -0,0 +1,121 @@
+package release
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/monostream/helmi/pkg/catalog"
+	"github.com/monostream/helmi/pkg/kubectl"
+)
+
+const (
+	bindingReleaseLabel         = "monostream.com/helmi-release"
+	bindingIdAnnotation         = "monostream.com/helmi-binding-id"
+	bindingAppGuidAnnotation    = "monostream.com/helmi-app-guid"
+	bindingParametersAnnotation = "monostream.com/helmi-binding-parameters"
+
+	// set while the create job of a binding runs
+	bindingPendingAnnotation = "monostream.com/helmi-binding-pending"
+)
+
+// Returns how long binding jobs may run, this must stay well below the request timeout of
+// the platform (60s in Cloud Foundry) as the credentials are removed again if a job fails
+func BindingJobTimeout() time.Duration {
+	timeout, exists := os.LookupEnv("BINDING_JOB_TIMEOUT")
+	if !exists {
+		timeout = "40s"
+	}
+	duration, err := time.ParseDuration(timeout)
+	if err != nil {
+		return time.Second * 40
+	}
+
+	return duration
+}
+
+// Returns the name of the kubernetes objects of a binding
+func getBindingName(releaseName string, bindingId string) string {
+	return fmt.Sprintf("%s-%x", releaseName, sha1.Sum([]byte(bindingId)))[:len(releaseName)+13]
+}
+
+func bindingSecret(bindingName string, namespace string, releaseName string, binding catalog.Binding) (kubectl.Secret, error) {
+	parameters, err := json.Marshal(binding.Parameters)
+	if err != nil {
+		return kubectl.Secret{}, err
+	}
+
+	data := make(map[string]string)
+	for k, v := range binding.Credentials {
+		if str, ok := v.(string); ok {
+			data[k] = str
+			continue
+		}
+
+		value, err := json.Marshal(v)
+		if err != nil {
+			return kubectl.Secret{}, err
+		}
+		data[k] = string(value)
+	}
+
+	secret := kubectl.Secret{
+		Name:      bindingName,
+		Namespace: namespace,
+		Labels: map[string]string{
+			bindingReleaseLabel: releaseName,
+		},
+		Annotations: map[string]string{
+			bindingIdAnnotation:         binding.Id,
+			bindingAppGuidAnnotation:    binding.AppGuid,
+			bindingParametersAnnotation: string(parameters),
+		},
+		Data: data,
+	}
+
+	return secret, nil
+}
+
+func isPending(secret kubectl.Secret) bool {
+	_, pending := secret.Annotations[bindingPendingAnnotation]
+	return pending
+}
+
+func credentialsFromSecret(secret kubectl.Secret) map[string]interface{} {
+	credentials := make(map[string]interface{})
+	for k, v := range secret.Data {
+		credentials[k] = v
+	}
+	return credentials
+}
+
+func bindingFromSecret(secret kubectl.Secret) catalog.Binding {
+	var parameters map[string]interface{}
+	json.Unmarshal([]byte(secret.Annotations[bindingParametersAnnotation]), &parameters)
+
+	return catalog.Binding{
+		Id:          secret.Annotations[bindingIdAnnotation],
+		AppGuid:     secret.Annotations[bindingAppGuidAnnotation],
+		Parameters:  parameters,
+		Credentials: credentialsFromSecret(secret),
+	}
+}
+
+func runBindingJob(ctx context.Context, jobName string, namespace string, secretName string, job *catalog.BindingJob) error {
+	return kubectl.RunJob(ctx, jobName, namespace, kubectl.Job{
+		Image:      job.Image,
+		Command:    job.Command,
+		Args:       job.Args,
+		SecretName: secretName,
+	}, BindingJobTimeout())
+}
+
+// Removes the credentials of all bindings of a release
+func deleteBindings(ctx context.Context, releaseName string) error {
+	return kubectl.DeleteSecrets(ctx, map[string]string{
+		bindingReleaseLabel: releaseName,
+	})
+}
@@ -0,0 +1,276 @@
+package release
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/monostream/helmi/pkg/catalog"
+	"github.com/monostream/helmi/pkg/helm"
+	"go.uber.org/zap"
+)
+
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// Returned if a rollback would move an instance to another plan without the request allowing it
+var ErrRollbackPlanChange = errors.New("revision has another plan than the instance, the rollback must allow the plan change")
+
+const (
+	// revisions kept by helm by default
+	maxHistory = 256
+	// revisions listed unless a request asks for more
+	DefaultHistory = 10
+)
+
+// Revision of the release of an instance
+type InstanceRevision struct {
+	Revision    int    `json:"revision"`
+	Updated     string `json:"updated"`
+	Status      string `json:"status"`
+	Chart       string `json:"chart"`
+	Description string `json:"description"`
+
+	// taken from the metadata of the revision, empty if it has none
+	ServiceId    string `json:"service_id,omitempty"`
+	PlanId       string `json:"plan_id,omitempty"`
+	ChartVersion string `json:"chart_version,omitempty"`
+}
+
+// Result of the rollback of an instance
+type RollbackResult struct {
+	// revision rolled back to as listed before the rollback
+	Target InstanceRevision
+	// plan of the instance before the rollback
+	PreviousPlanId string
+	// revision created by the rollback
+	Revision int
+}
+
+// Returns the latest revisions of the release of an instance, at most max of them, the newest revision comes last
+func History(ctx context.Context, id string, max int) ([]InstanceRevision, error) {
+	name := getName(id)
+
+	if max <= 0 || max > maxHistory {
+		max = maxHistory
+	}
+
+	history, err := releaseHistory(ctx, id, max)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]InstanceRevision, 0, len(history))
+
+	for _, revision := range history {
+		instanceRevision, err := getInstanceRevision(ctx, id, name, revision)
+		if err != nil {
+			return nil, err
+		}
+
+		revisions = append(revisions, instanceRevision)
+	}
+
+	return revisions, nil
+}
+
+func releaseHistory(ctx context.Context, id string, max int) ([]helm.Revision, error) {
+	name := getName(id)
+
+	history, err := helmClient.History(ctx, name, max)
+	if err != nil {
+		exists, existsErr := helmClient.Exists(ctx, name)
+		if existsErr == nil && !exists {
+			return nil, ErrReleaseNotFound
+		}
+
+		getLogger().Error("failed to get release history",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// Returns a revision with the service, plan and chart version of its metadata, revisions of other tools have none
+func getInstanceRevision(ctx context.Context, id string, name string, revision helm.Revision) (InstanceRevision, error) {
+	instanceRevision := InstanceRevision{
+		Revision:    revision.Revision,
+		Updated:     revision.Updated,
+		Status:      revision.Status,
+		Chart:       revision.Chart,
+		Description: revision.Description,
+	}
+
+	metadata, ok, err := revisionMetadata(ctx, name, revision.Revision)
+	if err != nil {
+		getLogger().Error("failed to get helm values of revision",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Int("revision", revision.Revision),
+			zap.Error(err))
+
+		return instanceRevision, err
+	}
+
+	if ok {
+		instanceRevision.ServiceId = metadata.ServiceId
+		instanceRevision.PlanId = metadata.PlanId
+		instanceRevision.ChartVersion = metadata.ChartVersion
+	}
+
+	return instanceRevision, nil
+}
+
+// Rolls the release of an instance back to one of its revisions, the rollback creates a new revision.
+// The service and plan of the revision must still be in the catalog, its values replace the current ones.
+// A revision of another plan than the current one is only rolled back to if the plan change is allowed.
+func Rollback(ctx context.Context, c *catalog.Catalog, id string, revision int, allowPlanChange bool) (RollbackResult, error) {
+	name := getName(id)
+	logger := getLogger()
+
+	history, err := releaseHistory(ctx, id, maxHistory)
+	if err != nil {
+		return RollbackResult{}, err
+	}
+
+	var result RollbackResult
+	found := false
+
+	for _, r := range history {
+		if r.Revision == revision {
+			result.Target, err = getInstanceRevision(ctx, id, name, r)
+			if err != nil {
+				return result, err
+			}
+			found = true
+		}
+	}
+
+	if !found {
+		return result, ErrRevisionNotFound
+	}
+
+	current, err := getInstanceRevision(ctx, id, name, history[len(history)-1])
+	if err != nil {
+		return result, err
+	}
+	result.PreviousPlanId = current.PlanId
+
+	target := result.Target
+
+	if len(target.PlanId) == 0 {
+		return result, fmt.Errorf("revision %d was not installed by helmi", revision)
+	}
+
+	service := c.Service(target.ServiceId)
+	if service == nil {
+		return result, fmt.Errorf("service %s of revision %d is not in the catalog", target.ServiceId, revision)
+	}
+
+	if _, err := service.Plan(target.PlanId); err != nil {
+		return result, fmt.Errorf("plan %s of revision %d is not in the catalog", target.PlanId, revision)
+	}
+
+	if target.PlanId != current.PlanId && !allowPlanChange {
+		return result, ErrRollbackPlanChange
+	}
+
+	err = helmClient.Rollback(ctx, name, revision)
+	if err != nil {
+		logger.Error("failed to roll back release",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Int("revision", revision),
+			zap.Error(err))
+
+		return result, err
+	}
+
+	latest, err := getRevision(ctx, name)
+	if err != nil {
+		return result, err
+	}
+	result.Revision = latest.Revision
+
+	logger.Info("rolled back release",
+		zap.String("id", id),
+		zap.String("name", name),
+		zap.Int("revision", revision),
+		zap.Int("newRevision", latest.Revision),
+		zap.String("planId", target.PlanId),
+		zap.String("previousPlanId", current.PlanId))
+
+	return result, nil
+}
+
+// Rolls the release of an instance back to the revision before the one created by an update, if the plan of the
+// update declares auto-rollback and no other revision has been created since.
+// Returns the revision rolled back to, zero if the release has not been rolled back.
+func RollbackUpdate(ctx context.Context, c *catalog.Catalog, id string, revision int) (int, error) {
+	name := getName(id)
+	logger := getLogger()
+
+	if revision < 2 {
+		return 0, nil
+	}
+
+	latest, err := getRevision(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	if latest.Revision != revision {
+		return 0, nil
+	}
+
+	values, err := helmClient.GetRevisionValues(ctx, name, revision)
+	if err != nil {
+		return 0, err
+	}
+
+	metadata, err := catalog.ExtractMetadata(values)
+	if err != nil {
+		return 0, err
+	}
+
+	service := c.Service(metadata.ServiceId)
+	if service == nil {
+		return 0, nil
+	}
+
+	plan, err := service.Plan(metadata.PlanId)
+	if err != nil || !service.HasAutoRollback(plan) {
+		return 0, nil
+	}
+
+	err = helmClient.Rollback(ctx, name, revision-1)
+	if err != nil {
+		logger.Error("failed to roll back failed update",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Int("revision", revision-1),
+			zap.Error(err))
+
+		return 0, err
+	}
+
+	logger.Info("rolled back failed update",
+		zap.String("id", id),
+		zap.String("name", name),
+		zap.Int("failedRevision", revision),
+		zap.Int("revision", revision-1))
+
+	return revision - 1, nil
+}
+
+// Returns the revision a revision has been rolled back to by helm, zero if it is not a rollback
+func RolledBackTo(revision helm.Revision) int {
+	var target int
+	if _, err := fmt.Sscanf(revision.Description, "Rollback to %d", &target); err != nil {
+		return 0
+	}
+	return target
+}
@@ -0,0 +1,81 @@
+package release
+
+import (
+	"context"
+	"sync"
+
+	"github.com/monostream/helmi/pkg/catalog"
+)
+
+// Metadata of release revisions by release name and revision. The values of a revision never change, listing all
+// instances does not have to get the values of every release again.
+var metadataCache = struct {
+	sync.Mutex
+	releases map[string]map[int]cachedMetadata
+}{
+	releases: make(map[string]map[int]cachedMetadata),
+}
+
+type cachedMetadata struct {
+	metadata catalog.Metadata
+	// false if the values of the revision have no helmi metadata
+	ok bool
+}
+
+// Returns the helmi metadata stored in the values of a revision of a release, false if the revision has none
+func revisionMetadata(ctx context.Context, name string, revision int) (catalog.Metadata, bool, error) {
+	metadataCache.Lock()
+	cached, found := metadataCache.releases[name][revision]
+	metadataCache.Unlock()
+
+	if found {
+		return cached.metadata, cached.ok, nil
+	}
+
+	values, err := helmClient.GetRevisionValues(ctx, name, revision)
+	if err != nil {
+		// failed requests are not cached
+		return catalog.Metadata{}, false, err
+	}
+
+	metadata, err := catalog.ExtractMetadata(values)
+	cached = cachedMetadata{metadata: metadata, ok: err == nil}
+
+	metadataCache.Lock()
+	defer metadataCache.Unlock()
+
+	if metadataCache.releases[name] == nil {
+		metadataCache.releases[name] = make(map[int]cachedMetadata)
+	}
+	metadataCache.releases[name][revision] = cached
+
+	return cached.metadata, cached.ok, nil
+}
+
+// Drops the metadata of releases which no longer exist, a new release of the same name starts with revision 1 again
+func pruneMetadata(names map[string]bool) {
+	metadataCache.Lock()
+	defer metadataCache.Unlock()
+
+	for name := range metadataCache.releases {
+		if !names[name] {
+			delete(metadataCache.releases, name)
+		}
+	}
+}
+
+// Drops the metadata of a deleted release
+func forgetMetadata(name string) {
+	metadataCache.Lock()
+	defer metadataCache.Unlock()
+
+	delete(metadataCache.releases, name)
+}
+
+// Drops the metadata of all releases, e.g. after the Helm client has been replaced
+func resetMetadata() {
+	metadataCache.Lock()
+	defer metadataCache.Unlock()
+
+	metadataCache.releases = make(map[string]map[int]cachedMetadata)
+}
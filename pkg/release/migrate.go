@@ -0,0 +1,163 @@
+package release
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/monostream/helmi/pkg/catalog"
+	"github.com/monostream/helmi/pkg/helm"
+	"github.com/monostream/helmi/pkg/kubectl"
+	"go.uber.org/zap"
+)
+
+const (
+	// lease of the broker instance which migrates the helm 2 releases, the others wait until it is done
+	migrationLease              = "helmi-helm2-migration"
+	migrationLeaseDuration      = time.Second * 30
+	migrationLeaseRenewInterval = time.Second * 10
+	migrationRetryInterval      = time.Second * 5
+	// renewing and releasing the lease must not hang the migration
+	migrationLeaseRequestTimeout = time.Second * 10
+)
+
+// Converts the helmi releases still stored by tiller in its namespace into Helm 3 releases.
+// Only one broker instance migrates at a time, it holds a lease in the lease namespace while doing so.
+// Releases which exist in Helm 3 already are skipped, a release which fails to convert is logged and left to Helm 2,
+// so the migration can be repeated on the next start.
+// Returns the names of the converted releases.
+func MigrateHelm2Releases(ctx context.Context, client *helm.Helm3CLI, tillerNamespace string, leaseNamespace string) ([]string, error) {
+	logger := getLogger()
+
+	unlock, err := acquireMigrationLease(ctx, leaseNamespace)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	names, err := helm2Releases(ctx, tillerNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrated []string
+
+	for _, name := range names {
+		exists, err := client.Exists(ctx, name)
+		if err != nil {
+			return migrated, err
+		}
+		if exists {
+			continue
+		}
+
+		err = client.ConvertHelm2(ctx, name, tillerNamespace)
+		if err != nil {
+			logger.Error("failed to migrate helm 2 release",
+				zap.String("release", name),
+				zap.Error(err))
+			continue
+		}
+
+		// the metadata of the instance must survive the conversion
+		values, err := client.GetValues(ctx, name)
+		if err == nil {
+			_, err = catalog.ExtractMetadata(values)
+		}
+		if err != nil {
+			logger.Error("migrated helm 2 release has no metadata",
+				zap.String("release", name),
+				zap.Error(err))
+			continue
+		}
+
+		logger.Info("migrated helm 2 release",
+			zap.String("release", name))
+
+		migrated = append(migrated, name)
+	}
+
+	return migrated, nil
+}
+
+// Waits until no other broker instance migrates, keeps renewing the lease until the returned function is called
+func acquireMigrationLease(ctx context.Context, namespace string) (func(), error) {
+	if len(namespace) == 0 {
+		namespace = "default"
+	}
+
+	hostname, _ := os.Hostname()
+	holder := hostname + "/" + uuid.Must(uuid.NewV4()).String()
+
+	for {
+		err := kubectl.AcquireLease(ctx, migrationLease, namespace, holder, migrationLeaseDuration)
+		if err == nil {
+			break
+		}
+
+		if err != kubectl.ErrLeaseHeld {
+			return nil, err
+		}
+
+		getLogger().Info("waiting for another broker instance to migrate helm 2 releases")
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(migrationRetryInterval):
+		}
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(migrationLeaseRenewInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), migrationLeaseRequestTimeout)
+				kubectl.RenewLease(ctx, migrationLease, namespace, holder)
+				cancel()
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+
+		ctx, cancel := context.WithTimeout(context.Background(), migrationLeaseRequestTimeout)
+		defer cancel()
+
+		kubectl.ReleaseLease(ctx, migrationLease, namespace, holder)
+	}, nil
+}
+
+// Returns the names of the helmi releases stored by tiller, tiller keeps a ConfigMap per revision
+func helm2Releases(ctx context.Context, tillerNamespace string) ([]string, error) {
+	labels, err := kubectl.GetConfigMapLabels(ctx, tillerNamespace, map[string]string{"OWNER": "TILLER"})
+	if err != nil {
+		return nil, err
+	}
+
+	unique := make(map[string]bool)
+	for _, l := range labels {
+		if name := l["NAME"]; strings.HasPrefix(name, releasePrefix) {
+			unique[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(unique))
+	for name := range unique {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
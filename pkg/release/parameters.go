@@ -0,0 +1,105 @@
+package release
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/monostream/helmi/pkg/catalog"
+	"github.com/monostream/helmi/pkg/kubectl"
+)
+
+// Returns the name of the secret which keeps the parameters of an instance
+func getParametersName(releaseName string) string {
+	return releaseName + "-parameters"
+}
+
+// Secret with the parameters of an instance by their hash. Every set of parameters the instance has been installed,
+// updated or rolled back with is kept, the hash in the metadata of a revision selects its parameters.
+// The secret is labelled like binding credentials and deleted with them.
+func parametersSecret(releaseName string, namespace string, data map[string]string) kubectl.Secret {
+	return kubectl.Secret{
+		Name:      getParametersName(releaseName),
+		Namespace: namespace,
+		Labels: map[string]string{
+			bindingReleaseLabel: releaseName,
+		},
+		Data: data,
+	}
+}
+
+// Keeps the parameters of an instance out of its release values, returns their hash
+func storeParameters(ctx context.Context, releaseName string, namespace string, parameters map[string]interface{}) (string, error) {
+	hash := catalog.ParametersHash(parameters)
+	if len(hash) == 0 {
+		return "", nil
+	}
+
+	value, err := json.Marshal(parameters)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := kubectl.GetSecret(ctx, getParametersName(releaseName), namespace)
+	if err == kubectl.ErrNotFound {
+		return hash, kubectl.CreateSecret(ctx, parametersSecret(releaseName, namespace, map[string]string{hash: string(value)}))
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if _, exists := secret.Data[hash]; exists {
+		return hash, nil
+	}
+
+	secret.Data[hash] = string(value)
+	return hash, kubectl.UpdateSecret(ctx, parametersSecret(releaseName, namespace, secret.Data))
+}
+
+// Returns the parameters of a revision from its metadata, releases of older helmi versions keep them in their values
+func loadParameters(ctx context.Context, releaseName string, namespace string, metadata catalog.Metadata) (map[string]interface{}, error) {
+	if len(metadata.ParametersHash) == 0 {
+		return metadata.Parameters, nil
+	}
+
+	secret, err := kubectl.GetSecret(ctx, getParametersName(releaseName), namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	value, exists := secret.Data[metadata.ParametersHash]
+	if !exists {
+		return nil, fmt.Errorf("parameters of release %s not found", releaseName)
+	}
+
+	var parameters map[string]interface{}
+	err = json.Unmarshal([]byte(value), &parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return parameters, nil
+}
+
+// Returns the parameters of a revision of a release whose namespace is not known yet
+func releaseParameters(ctx context.Context, releaseName string, metadata catalog.Metadata) (map[string]interface{}, error) {
+	if len(metadata.ParametersHash) == 0 {
+		return metadata.Parameters, nil
+	}
+
+	status, err := helmClient.GetStatus(ctx, releaseName)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadParameters(ctx, releaseName, status.Namespace, metadata)
+}
+
+// Returns the hash of the parameters of a revision, which is computed for releases of older helmi versions
+func parametersHash(metadata catalog.Metadata) string {
+	if len(metadata.ParametersHash) > 0 {
+		return metadata.ParametersHash
+	}
+	return catalog.ParametersHash(metadata.Parameters)
+}
@@ -0,0 +1,183 @@
+package release
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/monostream/helmi/pkg/catalog"
+)
+
+// Returned if a provision would exceed the maximum number of instances of the broker, a service or a plan
+type QuotaError struct {
+	message string
+}
+
+func (e *QuotaError) Error() string {
+	return e.message
+}
+
+// maximum number of instances across all services, zero means unlimited
+var maxInstances int
+
+// Limits the number of instances across all services, zero means unlimited
+func SetMaxInstances(max int) {
+	maxInstances = max
+}
+
+// Returns the name of the lock which serializes provisions of the plan counted against the same quotas, empty if no
+// quota applies. The broker wide limit counts the instances of all services.
+func QuotaLock(c *catalog.Catalog, serviceId string, planId string) string {
+	if maxInstances > 0 {
+		return "quota"
+	}
+
+	service := c.Service(serviceId)
+	if service == nil {
+		return ""
+	}
+
+	plan, err := service.Plan(planId)
+	if err != nil || (service.Quotas == nil && plan.Quotas == nil) {
+		return ""
+	}
+
+	return "quota/" + service.Id
+}
+
+// Existing instance as counted against quotas
+type quotaInstance struct {
+	namespace string
+	serviceId string
+	planId    string
+	org       string
+}
+
+// Rejects a new instance of the plan in the namespace and org if any quota has been reached already.
+// Instances are counted from the releases in the cluster and their stored metadata, provisions counted against the
+// same quotas have to hold the lock named by QuotaLock.
+func checkQuotas(ctx context.Context, service *catalog.Service, plan *catalog.Plan, namespace string, org string) error {
+	if maxInstances <= 0 && service.Quotas == nil && plan.Quotas == nil {
+		return nil
+	}
+
+	// the broker wide limit does not need the metadata of every release
+	instances, err := listInstances(ctx, service.Quotas != nil || plan.Quotas != nil)
+	if err != nil {
+		return err
+	}
+
+	if maxInstances > 0 && len(instances) >= maxInstances {
+		return &QuotaError{fmt.Sprintf("the broker allows at most %d instances", maxInstances)}
+	}
+
+	scopes := []struct {
+		name     string
+		quotas   *catalog.Quotas
+		contains func(instance quotaInstance) bool
+	}{
+		{"service " + service.Name, service.Quotas, func(instance quotaInstance) bool {
+			return instance.serviceId == service.Id
+		}},
+		{"plan " + plan.Name, plan.Quotas, func(instance quotaInstance) bool {
+			return instance.serviceId == service.Id && instance.planId == plan.Id
+		}},
+	}
+
+	for _, scope := range scopes {
+		if scope.quotas == nil {
+			continue
+		}
+
+		total, inNamespace, inOrg := 0, 0, 0
+		for _, instance := range instances {
+			if !scope.contains(instance) {
+				continue
+			}
+
+			total++
+			if instance.namespace == namespace {
+				inNamespace++
+			}
+			if len(org) > 0 && instance.org == org {
+				inOrg++
+			}
+		}
+
+		limit := scope.quotas.Instances
+		if limit > 0 && total >= limit {
+			return &QuotaError{fmt.Sprintf("%s allows at most %d instances", scope.name, limit)}
+		}
+
+		limit = scope.quotas.InstancesPerNamespace
+		if limit > 0 && inNamespace >= limit {
+			return &QuotaError{fmt.Sprintf("%s allows at most %d instances in namespace %s", scope.name, limit, namespace)}
+		}
+
+		// instances of platforms without orgs are not limited per org
+		limit = scope.quotas.InstancesPerOrg
+		if limit > 0 && len(org) > 0 && inOrg >= limit {
+			return &QuotaError{fmt.Sprintf("%s allows at most %d instances per org", scope.name, limit)}
+		}
+	}
+
+	return nil
+}
+
+// Returns the instances of all helmi releases, their service, plan, org and requested namespace are only read if
+// withMetadata is set
+func listInstances(ctx context.Context, withMetadata bool) ([]quotaInstance, error) {
+	releases, err := helmClient.ListAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []quotaInstance
+	listed := make(map[string]bool)
+
+	for _, release := range releases {
+		listed[release.Name] = true
+
+		if !strings.HasPrefix(release.Name, releasePrefix) || release.Status == "DELETED" {
+			continue
+		}
+
+		instance := quotaInstance{
+			namespace: release.Namespace,
+		}
+
+		if withMetadata {
+			metadata, ok, err := revisionMetadata(ctx, release.Name, release.Revision)
+			if err != nil {
+				exists, existsErr := helmClient.Exists(ctx, release.Name)
+				if existsErr == nil && !exists {
+					// deleted since it was listed
+					continue
+				}
+				return nil, err
+			}
+
+			if !ok {
+				// not installed by helmi
+				continue
+			}
+
+			instance.serviceId = metadata.ServiceId
+			instance.planId = metadata.PlanId
+			instance.org = metadata.Org
+
+			// instances of a dedicated namespace count against the namespace they were requested for
+			if len(metadata.Namespace) > 0 {
+				instance.namespace = metadata.Namespace
+			}
+		}
+
+		instances = append(instances, instance)
+	}
+
+	if withMetadata {
+		pruneMetadata(listed)
+	}
+
+	return instances, nil
+}
@@ -1,6 +1,7 @@
 package release
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -18,24 +19,63 @@ import (
 )
 
 var ErrReleaseNotFound = errors.New("release not found")
+var ErrPlanChangeNotAllowed = errors.New("plan change not allowed")
+var ErrBindingNotFound = errors.New("binding not found")
+var ErrNotAvailable = errors.New("service not yet available")
+var ErrNotBindable = errors.New("plan is not bindable")
+var ErrReleaseExists = errors.New("release exists with the same service, plan and parameters")
+var ErrReleaseConflict = errors.New("release exists with a different service, plan or parameters")
+var ErrBindingConflict = errors.New("binding exists with a different app or parameters")
+
+// maximum duration of purging or rolling back a release after its operation has been cancelled
+const cleanupTimeout = time.Minute * 5
+
+// Client of all Helm operations on releases
+var helmClient helm.Client = helm.NewCLI("")
+
+// Replaces the Helm client, e.g. with a fake in tests
+func SetHelmClient(client helm.Client) {
+	helmClient = client
+	resetMetadata()
+}
+
+// names of the releases of instances start with this prefix
+const releasePrefix = "helmi"
+
+// label of the namespaces created for a single release, holds the name of the release
+const dedicatedNamespaceLabel = "monostream.com/helmi-release"
 
 type Health struct {
 	IsFailed       bool
 	IsReady        bool
 	deploymentTime time.Time
+
+	// describes the objects of the release which are not ready yet
+	PendingResources []string
 }
 
 func (h *Health) IsTimedOut() bool {
+	if time.Now().After(h.deploymentTime.Add(Timeout())) && !h.IsReady {
+		return true
+	}
+
+	return false
+}
+
+// Returns the time after which a pending operation is considered failed
+func Timeout() time.Duration {
 	timeout, exists := os.LookupEnv("TIMEOUT")
 	if !exists {
 		timeout = "30m"
 	}
 	duration, _ := time.ParseDuration(timeout)
-	if time.Now().After(h.deploymentTime.Add(duration)) && !h.IsReady {
-		return true
-	}
 
-	return false
+	return duration
+}
+
+// Cleanup of partial state must not be cancelled together with the operation which left it behind
+func cleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cleanupTimeout)
 }
 
 func getLogger() *zap.Logger {
@@ -49,11 +89,12 @@ func getLogger() *zap.Logger {
 	return logger
 }
 
-func Install(catalog *catalog.Catalog, serviceId string, planId string, id string, namespace kubectl.Namespace, acceptsIncomplete bool, parameters map[string]interface{}, contextValues map[string]interface{}) (string, error) {
+// Installs the release of an instance, the creator is kept in the metadata of the release
+func Install(ctx context.Context, c *catalog.Catalog, serviceId string, planId string, id string, namespace kubectl.Namespace, acceptsIncomplete bool, parameters map[string]interface{}, contextValues map[string]interface{}, creator map[string]interface{}) (string, error) {
 	name := getName(id)
 	logger := getLogger()
 
-	service := catalog.Service(serviceId)
+	service := c.Service(serviceId)
 	plan, err := service.Plan(planId)
 
 	if err != nil {
@@ -67,9 +108,66 @@ func Install(catalog *catalog.Catalog, serviceId string, planId string, id strin
 		return "", err
 	}
 
+	// defaults of the schema are rendered like parameters given by the platform
+	parameters = plan.CreateSchema().ApplyDefaults(parameters)
+
+	err = plan.CreateSchema().Validate(parameters)
+	if err != nil {
+		logger.Info("invalid provision parameters",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("serviceId", serviceId),
+			zap.String("planId", planId),
+			zap.Error(err))
+
+		return "", err
+	}
+
+	existing, err := GetInstance(ctx, c, id)
+	if err == nil {
+		// an identical release is the result of an earlier request for this instance
+		if strings.EqualFold(existing.ServiceId, serviceId) && strings.EqualFold(existing.PlanId, planId) && existing.ParametersHash == catalog.ParametersHash(parameters) {
+			return existing.DashboardURL, ErrReleaseExists
+		}
+
+		logger.Info("release exists with different attributes",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("serviceId", serviceId),
+			zap.String("planId", planId),
+			zap.String("existingServiceId", existing.ServiceId),
+			zap.String("existingPlanId", existing.PlanId))
+
+		return "", ErrReleaseConflict
+	} else if err != ErrReleaseNotFound {
+		return "", err
+	}
+
+	org, _ := contextValues["organization_guid"].(string)
+
+	err = checkQuotas(ctx, service, plan, namespace.Name, org)
+	if err != nil {
+		logger.Info("quota exceeded",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("serviceId", serviceId),
+			zap.String("planId", planId),
+			zap.String("namespace", namespace.Name),
+			zap.Error(err))
+
+		return "", err
+	}
+
+	requestedNamespace := namespace.Name
+
+	if service.HasDedicatedNamespace(plan) {
+		// the ingress domain of the namespace resolved for the platform context still applies
+		namespace.Name = name
+	}
+
 	chart, chartErr := getChart(service, plan)
 	chartVersion, chartVersionErr := getChartVersion(service, plan)
-	chartValues, valuesErr := service.ChartValues(plan, id, name, namespace, parameters, contextValues)
+	chartValues, valuesErr := service.ChartValues(ctx, plan, id, name, namespace, parameters, contextValues)
 
 	if chartErr != nil {
 		logger.Error("failed to read chart from catalog definition",
@@ -97,7 +195,7 @@ func Install(catalog *catalog.Catalog, serviceId string, planId string, id strin
 		return "", valuesErr
 	}
 
-	dashboardUrl, urlErr := service.DashboardURL(plan, id, name, namespace, parameters, contextValues)
+	dashboardUrl, urlErr := service.DashboardURL(ctx, plan, id, name, namespace, parameters, contextValues)
 
 	if urlErr != nil {
 		logger.Error("failed to parse dashboard URL in chart-values section",
@@ -110,7 +208,42 @@ func Install(catalog *catalog.Catalog, serviceId string, planId string, id strin
 		return "", urlErr
 	}
 
-	err = helm.Install(name, chart, chartVersion, chartValues, namespace.Name, acceptsIncomplete)
+	catalog.SetCreator(chartValues, creator)
+	catalog.SetNamespace(chartValues, requestedNamespace)
+
+	if service.HasDedicatedNamespace(plan) {
+		err = createDedicatedNamespace(ctx, name, service.DedicatedNamespaceConfig(plan))
+		if err != nil {
+			logger.Error("failed to create dedicated namespace",
+				zap.String("id", id),
+				zap.String("name", name),
+				zap.String("serviceId", serviceId),
+				zap.String("planId", planId),
+				zap.Error(err))
+
+			return "", err
+		}
+	}
+
+	// parameters are kept in a secret next to the release, which is purged with it if the installation fails
+	_, err = storeParameters(ctx, name, namespace.Name, parameters)
+	if err != nil {
+		logger.Error("failed to store parameters",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("serviceId", serviceId),
+			zap.String("planId", planId),
+			zap.Error(err))
+
+		cleanupCtx, cancel := cleanupContext()
+		defer cancel()
+
+		purge(cleanupCtx, name)
+
+		return "", err
+	}
+
+	err = helmClient.Install(ctx, name, chart, chartVersion, chartValues, namespace.Name, acceptsIncomplete)
 
 	if err != nil {
 		logger.Error("failed to install release",
@@ -123,6 +256,18 @@ func Install(catalog *catalog.Catalog, serviceId string, planId string, id strin
 			zap.String("namespace", namespace.Name),
 			zap.Error(err))
 
+		// the platform considers the instance not to exist, do not leave a partial release behind
+		cleanupCtx, cancel := cleanupContext()
+		defer cancel()
+
+		purgeErr := purge(cleanupCtx, name)
+		if purgeErr != nil {
+			logger.Error("failed to purge release of failed installation",
+				zap.String("id", id),
+				zap.String("name", name),
+				zap.Error(purgeErr))
+		}
+
 		return "", err
 	}
 
@@ -138,238 +283,1122 @@ func Install(catalog *catalog.Catalog, serviceId string, planId string, id strin
 	return dashboardUrl, nil
 }
 
-func Exists(id string) (bool, error) {
+// Upgrades the release of an instance and returns the release revision the instance is expected to reach
+func Update(ctx context.Context, c *catalog.Catalog, serviceId string, planId string, id string, acceptsIncomplete bool, parameters map[string]interface{}, contextValues map[string]interface{}) (int, error) {
 	name := getName(id)
 	logger := getLogger()
 
-	exists, err := helm.Exists(name)
-
+	status, err := helmClient.GetStatus(ctx, name)
 	if err != nil {
-		logger.Error("failed to check if release exists",
+		exists, existsErr := helmClient.Exists(ctx, name)
+		if existsErr == nil && !exists {
+			logger.Info("asked update for deleted release",
+				zap.String("id", id),
+				zap.String("name", name))
+
+			return 0, ErrReleaseNotFound
+		}
+
+		logger.Error("failed to get release status",
 			zap.String("id", id),
 			zap.String("name", name),
 			zap.Error(err))
-	}
-
-	return exists, err
-}
-
-func Delete(id string) error {
-	name := getName(id)
-	logger := getLogger()
 
-	err := helm.Delete(name)
+		return 0, err
+	}
 
+	values, err := helmClient.GetValues(ctx, name)
 	if err != nil {
-		exists, existsErr := helm.Exists(name)
-
-		if existsErr == nil && !exists {
-			logger.Info("release deleted (not existed)",
-				zap.String("id", id),
-				zap.String("name", name))
+		logger.Error("failed to get helm values",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
 
-			return ErrReleaseNotFound
-		}
+		return 0, err
+	}
 
-		logger.Error("failed to delete release",
+	metadata, err := catalog.ExtractMetadata(values)
+	if err != nil {
+		logger.Error("failed to fetch helmi metadata",
 			zap.String("id", id),
 			zap.String("name", name),
 			zap.Error(err))
 
-		return err
+		return 0, err
 	}
 
-	logger.Info("release deleted",
-		zap.String("id", id),
-		zap.String("name", name))
+	if metadata.ServiceId != serviceId {
+		return 0, ErrPlanChangeNotAllowed
+	}
 
-	return nil
-}
+	// keep the current plan if the request does not name one
+	if len(planId) == 0 {
+		planId = metadata.PlanId
+	}
 
-func GetHealth(c *catalog.Catalog, id string) (Health, error) {
-	name := getName(id)
-	logger := getLogger()
+	service := c.Service(serviceId)
+	plan, err := service.Plan(planId)
 
-	status, err := helm.GetStatus(name)
 	if err != nil {
-		exists, existsErr := helm.Exists(name)
-		if existsErr == nil && !exists {
-			logger.Info("asked status for deleted release",
-				zap.String("id", id),
-				zap.String("name", name))
+		logger.Error("failed find plan with plan id",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("serviceId", serviceId),
+			zap.String("planId", planId),
+			zap.Error(err))
 
-			return Health{}, ErrReleaseNotFound
-		}
+		return 0, err
+	}
 
-		logger.Error("failed to get release status",
+	revision, err := getRevision(ctx, name)
+	if err != nil {
+		logger.Error("failed to get release revision",
 			zap.String("id", id),
 			zap.String("name", name),
 			zap.Error(err))
 
-		return Health{}, err
+		return 0, err
 	}
 
-	health := Health{
-		IsFailed:       status.IsFailed,
-		IsReady:        false,
-		deploymentTime: status.DeploymentTime,
+	isPlanChange := !strings.EqualFold(metadata.PlanId, plan.Id)
+
+	if !isPlanChange && len(parameters) == 0 {
+		// nothing to change
+		return revision.Revision, nil
 	}
 
-	if !status.IsAvailable() {
-		return health, nil
+	if isPlanChange {
+		currentPlan, err := service.Plan(metadata.PlanId)
+		if err != nil || !currentPlan.IsUpdatableTo(plan) {
+			logger.Info("plan change not allowed",
+				zap.String("id", id),
+				zap.String("name", name),
+				zap.String("serviceId", serviceId),
+				zap.String("fromPlanId", metadata.PlanId),
+				zap.String("toPlanId", planId))
+
+			return 0, ErrPlanChangeNotAllowed
+		}
+	}
+
+	// parameters are nil if the request did not contain any, e.g. on plan changes
+	if parameters != nil {
+		err = plan.UpdateSchema().Validate(parameters)
+		if err != nil {
+			logger.Info("invalid update parameters",
+				zap.String("id", id),
+				zap.String("name", name),
+				zap.String("serviceId", serviceId),
+				zap.String("planId", planId),
+				zap.Error(err))
+
+			return 0, err
+		}
 	}
 
-	values, err := helm.GetValues(name)
+	currentParameters, err := loadParameters(ctx, name, status.Namespace, metadata)
 	if err != nil {
-		logger.Error("failed to get helm values",
+		logger.Error("failed to load parameters",
 			zap.String("id", id),
 			zap.String("name", name),
 			zap.Error(err))
 
-		return Health{}, err
+		return 0, err
 	}
 
-	metadata, err := catalog.ExtractMetadata(values)
+	// parameters of the update are applied on top of the ones used so far
+	parameters = catalog.MergeParameters(currentParameters, parameters)
+	parameters = plan.UpdateSchema().ApplyDefaults(parameters)
+
+	_, err = storeParameters(ctx, name, status.Namespace, parameters)
 	if err != nil {
-		logger.Error("failed to fetch helmi metadata",
+		logger.Error("failed to store parameters",
 			zap.String("id", id),
 			zap.String("name", name),
 			zap.Error(err))
 
-		return Health{}, err
+		return 0, err
 	}
 
-	service := c.Service(metadata.ServiceId)
-	plan, err := service.Plan(metadata.PlanId)
-
+	chart, err := getChart(service, plan)
 	if err != nil {
-		logger.Error("failed find plan with plan id",
+		logger.Error("failed to read chart from catalog definition",
 			zap.String("id", id),
 			zap.String("name", name),
-			zap.String("serviceId", metadata.ServiceId),
-			zap.String("planId", metadata.PlanId),
+			zap.String("serviceId", serviceId),
+			zap.String("planId", planId),
 			zap.Error(err))
 
-		return Health{}, err
+		return 0, err
 	}
 
-	nodes, err := kubectl.GetNodes()
+	chartVersion, err := getChartVersion(service, plan)
 	if err != nil {
-		logger.Error("failed to get kubernetes nodes",
+		chartVersion = ""
+	}
+
+	namespace := kubectl.Namespace{
+		Name:          status.Namespace,
+		IngressDomain: metadata.IngressDomain,
+	}
+
+	chartValues, err := service.UpdatedChartValues(ctx, plan, id, name, namespace, parameters, contextValues, values)
+	if err != nil {
+		logger.Error("failed to parse chart-values section",
 			zap.String("id", id),
 			zap.String("name", name),
+			zap.String("serviceId", serviceId),
+			zap.String("planId", planId),
 			zap.Error(err))
 
-		return Health{}, err
+		return 0, err
 	}
 
-	release, err := service.ReleaseSection(plan, nodes, status, values)
+	err = helmClient.Upgrade(ctx, name, chart, chartVersion, chartValues, acceptsIncomplete)
 	if err != nil {
-		logger.Error("failed to parse user credentials",
+		logger.Error("failed to upgrade release",
 			zap.String("id", id),
 			zap.String("name", name),
+			zap.String("chart", chart),
+			zap.String("chart-version", chartVersion),
+			zap.String("serviceId", serviceId),
+			zap.String("fromPlanId", metadata.PlanId),
+			zap.String("toPlanId", planId),
+			zap.String("namespace", namespace.Name),
 			zap.Error(err))
 
-		return Health{}, err
-	}
-
-	checkFailed := false
-	for _, healthCheckURL := range release.HealthCheckURLs {
-		err = checkHealth(healthCheckURL)
-		if err != nil {
-			logger.Info("health check failed",
-				zap.String("id", id),
-				zap.String("name", name),
-				zap.String("url", healthCheckURL),
-				zap.Error(err),
-			)
-			checkFailed = true
-			break
+		if ctx.Err() != nil {
+			// tiller continues an upgrade the helm client gave up on, go back to the revision before
+			cleanupCtx, cancel := cleanupContext()
+			defer cancel()
+
+			rollbackErr := helmClient.Rollback(cleanupCtx, name, revision.Revision)
+			if rollbackErr != nil {
+				logger.Error("failed to roll back cancelled upgrade",
+					zap.String("id", id),
+					zap.String("name", name),
+					zap.Int("revision", revision.Revision),
+					zap.Error(rollbackErr))
+			}
+		} else {
+			// helm records the failed upgrade as a revision, which is rolled back if the plan asks for it
+			rolledBackTo, rollbackErr := RollbackUpdate(ctx, c, id, revision.Revision+1)
+			if rollbackErr != nil {
+				return 0, fmt.Errorf("%s, rolling back to revision %d failed: %s", err, revision.Revision, rollbackErr)
+			}
+			if rolledBackTo > 0 {
+				return 0, fmt.Errorf("%s, rolled back to revision %d", err, rolledBackTo)
+			}
 		}
+
+		return 0, err
 	}
 
-	health.IsReady = !checkFailed
-	return health, nil
+	logger.Info("release upgraded",
+		zap.String("id", id),
+		zap.String("name", name),
+		zap.String("chart", chart),
+		zap.String("chart-version", chartVersion),
+		zap.String("serviceId", serviceId),
+		zap.String("fromPlanId", metadata.PlanId),
+		zap.String("toPlanId", planId),
+		zap.String("namespace", namespace.Name))
+
+	return revision.Revision + 1, nil
 }
 
-func GetCredentials(catalog *catalog.Catalog, serviceId string, planId string, id string) (map[string]interface{}, error) {
+func Exists(ctx context.Context, id string) (bool, error) {
 	name := getName(id)
 	logger := getLogger()
 
-	service := catalog.Service(serviceId)
-	plan, err := service.Plan(planId)
+	exists, err := helmClient.Exists(ctx, name)
 
 	if err != nil {
-		logger.Error("failed find plan with plan Id",
+		logger.Error("failed to check if release exists",
 			zap.String("id", id),
 			zap.String("name", name),
-			zap.String("serviceId", serviceId),
-			zap.String("planId", planId),
 			zap.Error(err))
-
-		return nil, err
 	}
 
-	status, err := helm.GetStatus(name)
+	return exists, err
+}
+
+func Delete(ctx context.Context, id string) error {
+	name := getName(id)
+	logger := getLogger()
+
+	err := helmClient.Delete(ctx, name)
+
 	if err != nil {
-		exists, existsErr := helm.Exists(name)
+		exists, existsErr := helmClient.Exists(ctx, name)
 
 		if existsErr == nil && !exists {
-			logger.Info("asked credentials for deleted release",
+			logger.Info("release deleted (not existed)",
 				zap.String("id", id),
 				zap.String("name", name))
 
-			return nil, ErrReleaseNotFound
-		}
-
-		logger.Error("failed to get release status",
-			zap.String("id", id),
-			zap.String("name", name),
-			zap.Error(err))
-
-		return nil, err
-	}
+			// remove binding credentials and the namespace left behind by an earlier deletion
+			deleteBindings(ctx, name)
+			deleteDedicatedNamespace(ctx, name)
 
-	if !status.IsAvailable() {
-		return nil, errors.New("service not yet available")
-	}
+			return ErrReleaseNotFound
+		}
 
-	nodes, err := kubectl.GetNodes()
-	if err != nil {
-		logger.Error("failed to get kubernetes nodes",
+		logger.Error("failed to delete release",
 			zap.String("id", id),
 			zap.String("name", name),
 			zap.Error(err))
 
-		return nil, err
+		return err
 	}
 
-	values, err := helm.GetValues(name)
+	forgetMetadata(name)
 
+	// binding credentials are not part of the release
+	err = deleteBindings(ctx, name)
 	if err != nil {
-		logger.Error("failed to get helm values",
+		logger.Error("failed to delete binding credentials",
 			zap.String("id", id),
 			zap.String("name", name),
 			zap.Error(err))
 
-		return nil, err
+		return err
 	}
 
-	release, err := service.ReleaseSection(plan, nodes, status, values)
+	err = deleteDedicatedNamespace(ctx, name)
 	if err != nil {
-		logger.Error("failed to parse user credentials",
+		logger.Error("failed to delete dedicated namespace",
 			zap.String("id", id),
 			zap.String("name", name),
 			zap.Error(err))
 
-		return nil, err
+		return err
 	}
 
-	logger.Debug("sending release credentials",
+	logger.Info("release deleted",
 		zap.String("id", id),
 		zap.String("name", name))
 
-	return release.UserCredentials, nil
+	return nil
+}
+
+// Purges the release of a failed asynchronous provision unless its plan keeps failed releases,
+// returns true if the release has been purged
+func PurgeFailed(ctx context.Context, c *catalog.Catalog, id string) (bool, error) {
+	name := getName(id)
+	logger := getLogger()
+
+	instance, err := GetInstance(ctx, c, id)
+	if err == ErrReleaseNotFound {
+		return false, nil
+	}
+
+	if err == nil {
+		service := c.Service(instance.ServiceId)
+		plan, planErr := service.Plan(instance.PlanId)
+
+		if planErr == nil && service.KeepsFailedReleases(plan) {
+			logger.Info("keeping release of failed provision",
+				zap.String("id", id),
+				zap.String("name", name))
+
+			return false, nil
+		}
+	}
+
+	err = Delete(ctx, id)
+	if err == ErrReleaseNotFound {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	logger.Info("purged release of failed provision",
+		zap.String("id", id),
+		zap.String("name", name))
+
+	return true, nil
+}
+
+// Deletes a release and its dedicated namespace if they exist
+func purge(ctx context.Context, name string) error {
+	exists, err := helmClient.Exists(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		err = helmClient.Delete(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		forgetMetadata(name)
+	}
+
+	// the parameters are stored before the release is installed
+	err = deleteBindings(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	return deleteDedicatedNamespace(ctx, name)
+}
+
+// Creates the namespace of a release whose plan has a dedicated namespace with the quota, limits and network policy
+// of the plan, a namespace left behind by an earlier attempt of the same instance is reused
+func createDedicatedNamespace(ctx context.Context, name string, config catalog.NamespaceConfig) error {
+	limitRanges := make([]kubectl.LimitRange, 0, len(config.LimitRanges))
+	for _, limitRange := range config.LimitRanges {
+		limitRanges = append(limitRanges, kubectl.LimitRange(limitRange))
+	}
+
+	err := kubectl.CreateNamespace(ctx, kubectl.NamespaceSpec{
+		Name: name,
+		Labels: map[string]string{
+			dedicatedNamespaceLabel: name,
+		},
+		ResourceQuota:            config.ResourceQuota,
+		LimitRanges:              limitRanges,
+		DefaultDenyNetworkPolicy: config.DefaultDenyNetworkPolicy,
+	})
+	if err != kubectl.ErrAlreadyExists {
+		return err
+	}
+
+	namespace, err := kubectl.GetNamespaceByName(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if namespace.Labels[dedicatedNamespaceLabel] != name {
+		return fmt.Errorf("namespace %s exists but was not created for release %s", name, name)
+	}
+
+	return nil
+}
+
+// Deletes the dedicated namespace of a release, namespaces not created for the release are kept
+func deleteDedicatedNamespace(ctx context.Context, name string) error {
+	namespace, err := kubectl.GetNamespaceByName(ctx, name)
+	if err == kubectl.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if namespace.Labels[dedicatedNamespaceLabel] != name {
+		return nil
+	}
+
+	err = kubectl.DeleteNamespace(ctx, name)
+	if err == kubectl.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+type Instance struct {
+	ServiceId    string
+	PlanId       string
+	DashboardURL string
+	// identifies the parameters, which are not returned since they may contain secrets
+	ParametersHash string
+	Creator        map[string]interface{}
+	Context        map[string]interface{}
+}
+
+// Rebuilds an instance from the values stored in its release
+func GetInstance(ctx context.Context, c *catalog.Catalog, id string) (Instance, error) {
+	name := getName(id)
+	logger := getLogger()
+
+	values, err := helmClient.GetValues(ctx, name)
+	if err != nil {
+		exists, existsErr := helmClient.Exists(ctx, name)
+		if existsErr == nil && !exists {
+			return Instance{}, ErrReleaseNotFound
+		}
+
+		logger.Error("failed to get helm values",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return Instance{}, err
+	}
+
+	metadata, err := catalog.ExtractMetadata(values)
+	if err != nil {
+		logger.Error("failed to fetch helmi metadata",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return Instance{}, err
+	}
+
+	instance := Instance{
+		ServiceId:      metadata.ServiceId,
+		PlanId:         metadata.PlanId,
+		DashboardURL:   metadata.DashboardURL,
+		ParametersHash: parametersHash(metadata),
+		Creator:        metadata.Creator,
+		Context:        metadata.Context,
+	}
+
+	if len(instance.DashboardURL) > 0 {
+		return instance, nil
+	}
+
+	// releases of older helmi versions have no dashboard URL in their metadata, it is rendered again
+	service := c.Service(metadata.ServiceId)
+	plan, err := service.Plan(metadata.PlanId)
+	if err != nil {
+		// the plan may have been removed from the catalog, the ids are still valid
+		logger.Info("instance of unknown plan",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("serviceId", metadata.ServiceId),
+			zap.String("planId", metadata.PlanId))
+
+		return instance, nil
+	}
+
+	namespace := kubectl.Namespace{
+		IngressDomain: metadata.IngressDomain,
+	}
+
+	parameters, err := releaseParameters(ctx, name, metadata)
+	if err != nil {
+		logger.Error("failed to load parameters",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return Instance{}, err
+	}
+
+	instance.DashboardURL, err = service.DashboardURL(ctx, plan, id, name, namespace, parameters, metadata.Context)
+	if err != nil {
+		logger.Error("failed to parse dashboard URL in chart-values section",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("serviceId", metadata.ServiceId),
+			zap.String("planId", metadata.PlanId),
+			zap.Error(err))
+
+		return Instance{}, err
+	}
+
+	return instance, nil
+}
+
+// Returns the context of the platform an instance was provisioned or last updated with, nil for releases of older
+// helmi versions
+func GetContext(ctx context.Context, id string) (map[string]interface{}, error) {
+	name := getName(id)
+
+	values, err := helmClient.GetValues(ctx, name)
+	if err != nil {
+		exists, existsErr := helmClient.Exists(ctx, name)
+		if existsErr == nil && !exists {
+			return nil, ErrReleaseNotFound
+		}
+		return nil, err
+	}
+
+	metadata, err := catalog.ExtractMetadata(values)
+	if err != nil {
+		return nil, err
+	}
+
+	return metadata.Context, nil
+}
+
+// Returns the latest revision of the release of an instance
+func GetLastRevision(ctx context.Context, id string) (helm.Revision, error) {
+	name := getName(id)
+	logger := getLogger()
+
+	revision, err := getRevision(ctx, name)
+	if err != nil {
+		exists, existsErr := helmClient.Exists(ctx, name)
+		if existsErr == nil && !exists {
+			return helm.Revision{}, ErrReleaseNotFound
+		}
+
+		logger.Error("failed to get release revision",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return helm.Revision{}, err
+	}
+
+	return revision, nil
+}
+
+// Returns the namespace the release of an instance is deployed to
+func GetNamespace(ctx context.Context, id string) (string, error) {
+	name := getName(id)
+
+	status, err := helmClient.GetStatus(ctx, name)
+	if err != nil {
+		exists, existsErr := helmClient.Exists(ctx, name)
+		if existsErr == nil && !exists {
+			return "", ErrReleaseNotFound
+		}
+		return "", err
+	}
+
+	return status.Namespace, nil
+}
+
+func getRevision(ctx context.Context, name string) (helm.Revision, error) {
+	revisions, err := helmClient.History(ctx, name, 1)
+	if err != nil {
+		return helm.Revision{}, err
+	}
+
+	if len(revisions) == 0 {
+		return helm.Revision{}, fmt.Errorf("no revisions found for release %s", name)
+	}
+
+	return revisions[len(revisions)-1], nil
+}
+
+func GetHealth(ctx context.Context, c *catalog.Catalog, id string) (Health, error) {
+	name := getName(id)
+	logger := getLogger()
+
+	status, err := helmClient.GetStatus(ctx, name)
+	if err != nil {
+		exists, existsErr := helmClient.Exists(ctx, name)
+		if existsErr == nil && !exists {
+			logger.Info("asked status for deleted release",
+				zap.String("id", id),
+				zap.String("name", name))
+
+			return Health{}, ErrReleaseNotFound
+		}
+
+		logger.Error("failed to get release status",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return Health{}, err
+	}
+
+	health := Health{
+		IsFailed:       status.IsFailed,
+		IsReady:        false,
+		deploymentTime: status.DeploymentTime,
+	}
+
+	for _, resource := range status.PendingResources() {
+		health.PendingResources = append(health.PendingResources, helm.DescribeResource(resource))
+	}
+
+	if !status.IsAvailable() {
+		return health, nil
+	}
+
+	values, err := helmClient.GetValues(ctx, name)
+	if err != nil {
+		logger.Error("failed to get helm values",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return Health{}, err
+	}
+
+	metadata, err := catalog.ExtractMetadata(values)
+	if err != nil {
+		logger.Error("failed to fetch helmi metadata",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return Health{}, err
+	}
+
+	service := c.Service(metadata.ServiceId)
+	plan, err := service.Plan(metadata.PlanId)
+
+	if err != nil {
+		logger.Error("failed find plan with plan id",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("serviceId", metadata.ServiceId),
+			zap.String("planId", metadata.PlanId),
+			zap.Error(err))
+
+		return Health{}, err
+	}
+
+	nodes, err := kubectl.GetNodes(ctx)
+	if err != nil {
+		logger.Error("failed to get kubernetes nodes",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return Health{}, err
+	}
+
+	release, err := service.ReleaseSection(plan, nodes, status, values)
+	if err != nil {
+		logger.Error("failed to parse user credentials",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return Health{}, err
+	}
+
+	checkFailed := false
+	for _, healthCheckURL := range release.HealthCheckURLs {
+		err = checkHealth(healthCheckURL)
+		if err != nil {
+			logger.Info("health check failed",
+				zap.String("id", id),
+				zap.String("name", name),
+				zap.String("url", healthCheckURL),
+				zap.Error(err),
+			)
+			checkFailed = true
+			break
+		}
+	}
+
+	health.IsReady = !checkFailed
+	return health, nil
+}
+
+type releaseState struct {
+	status helm.Status
+	values map[string]interface{}
+	nodes  []kubectl.Node
+}
+
+func getReleaseState(ctx context.Context, id string, name string, logger *zap.Logger) (releaseState, error) {
+	status, err := helmClient.GetStatus(ctx, name)
+	if err != nil {
+		exists, existsErr := helmClient.Exists(ctx, name)
+
+		if existsErr == nil && !exists {
+			logger.Info("asked credentials for deleted release",
+				zap.String("id", id),
+				zap.String("name", name))
+
+			return releaseState{}, ErrReleaseNotFound
+		}
+
+		logger.Error("failed to get release status",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return releaseState{}, err
+	}
+
+	nodes, err := kubectl.GetNodes(ctx)
+	if err != nil {
+		logger.Error("failed to get kubernetes nodes",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return releaseState{}, err
+	}
+
+	values, err := helmClient.GetValues(ctx, name)
+
+	if err != nil {
+		logger.Error("failed to get helm values",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return releaseState{}, err
+	}
+
+	return releaseState{status: status, values: values, nodes: nodes}, nil
+}
+
+// Fills in the defaults of the binding schema and validates the parameters of a binding
+func BindParameters(c *catalog.Catalog, serviceId string, planId string, parameters map[string]interface{}) (map[string]interface{}, error) {
+	service := c.Service(serviceId)
+	plan, err := service.Plan(planId)
+	if err != nil {
+		return nil, err
+	}
+
+	return bindingParameters(service, plan, parameters)
+}
+
+// Refuses bindings of plans which are not bindable, fills in the defaults of the binding schema and validates the
+// parameters
+func bindingParameters(service *catalog.Service, plan *catalog.Plan, parameters map[string]interface{}) (map[string]interface{}, error) {
+	if !service.IsPlanBindable(plan) {
+		return nil, ErrNotBindable
+	}
+
+	parameters = plan.BindSchema().ApplyDefaults(parameters)
+
+	err := plan.BindSchema().Validate(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return parameters, nil
+}
+
+// Creates the credentials of a new binding and returns the user credentials of the binding
+func Bind(ctx context.Context, c *catalog.Catalog, serviceId string, planId string, id string, binding catalog.Binding) (map[string]interface{}, error) {
+	name := getName(id)
+	logger := getLogger()
+
+	service := c.Service(serviceId)
+	plan, err := service.Plan(planId)
+
+	if err != nil {
+		logger.Error("failed find plan with plan Id",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("serviceId", serviceId),
+			zap.String("planId", planId),
+			zap.Error(err))
+
+		return nil, err
+	}
+
+	binding.Parameters, err = bindingParameters(service, plan, binding.Parameters)
+	if err == ErrNotBindable {
+		return nil, err
+	}
+
+	if err != nil {
+		logger.Info("invalid binding parameters",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("serviceId", serviceId),
+			zap.String("planId", planId),
+			zap.String("bindingId", binding.Id),
+			zap.Error(err))
+
+		return nil, err
+	}
+
+	state, err := getReleaseState(ctx, id, name, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if !state.status.IsAvailable() {
+		return nil, ErrNotAvailable
+	}
+
+	namespace := state.status.Namespace
+	bindingName := getBindingName(name, binding.Id)
+
+	secret, err := kubectl.GetSecret(ctx, bindingName, namespace)
+	if err == nil && isPending(secret) {
+		// another request is still creating the binding
+		return nil, ErrNotAvailable
+	} else if err == nil {
+		// the binding exists already, answer with the same credentials again
+		release, err := service.BindingReleaseSection(plan, state.nodes, state.status, state.values, bindingFromSecret(secret))
+		if err != nil {
+			return nil, err
+		}
+
+		return release.UserCredentials, nil
+	} else if err != kubectl.ErrNotFound {
+		logger.Error("failed to get binding",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("bindingId", binding.Id),
+			zap.Error(err))
+
+		return nil, err
+	}
+
+	// the first pass renders the generated binding credentials
+	release, err := service.BindingReleaseSection(plan, state.nodes, state.status, state.values, binding)
+	if err != nil {
+		logger.Error("failed to parse user credentials",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return nil, err
+	}
+
+	if release.Binding != nil {
+		binding.Credentials = release.Binding.Credentials
+	}
+
+	secret, err = bindingSecret(bindingName, namespace, name, binding)
+	if err != nil {
+		return nil, err
+	}
+
+	hasCreateJob := release.Binding != nil && release.Binding.Create != nil
+	if hasCreateJob {
+		secret.Annotations[bindingPendingAnnotation] = "true"
+	}
+
+	err = kubectl.CreateSecret(ctx, secret)
+	if err != nil {
+		logger.Error("failed to store binding credentials",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("bindingId", binding.Id),
+			zap.Error(err))
+
+		return nil, err
+	}
+
+	// the second pass makes the stored binding credentials available to the template
+	release, err = service.BindingReleaseSection(plan, state.nodes, state.status, state.values, binding)
+	if err == nil && hasCreateJob {
+		if release.Binding != nil && release.Binding.Create != nil {
+			err = runBindingJob(ctx, bindingName+"-create", namespace, bindingName, release.Binding.Create)
+		}
+
+		if err == nil {
+			delete(secret.Annotations, bindingPendingAnnotation)
+			err = kubectl.UpdateSecret(ctx, secret)
+		}
+	}
+
+	if err != nil {
+		logger.Error("failed to create binding",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("bindingId", binding.Id),
+			zap.Error(err))
+
+		cleanupCtx, cancel := cleanupContext()
+		defer cancel()
+
+		kubectl.DeleteSecret(cleanupCtx, bindingName, namespace)
+		return nil, err
+	}
+
+	logger.Info("binding created",
+		zap.String("id", id),
+		zap.String("name", name),
+		zap.String("bindingId", binding.Id))
+
+	return release.UserCredentials, nil
+}
+
+// Returns the user credentials of an existing binding. Bindings created by older helmi versions have no secret, their
+// credentials are rendered again unless the service creates credentials per binding.
+func GetBinding(ctx context.Context, c *catalog.Catalog, id string, bindingId string) (map[string]interface{}, error) {
+	_, credentials, err := getBinding(ctx, c, id, bindingId, true)
+	return credentials, err
+}
+
+// Returns ErrBindingNotFound unless the binding has been created by this helmi version, ErrReleaseNotFound if the
+// instance does not exist
+func CheckBinding(ctx context.Context, c *catalog.Catalog, id string, bindingId string) error {
+	_, _, err := getBinding(ctx, c, id, bindingId, false)
+	return err
+}
+
+// Returns the user credentials of a binding which exists already for a replayed bind request.
+// Returns ErrBindingConflict if it has been created for another app or with other parameters, ErrBindingNotFound if
+// it does not exist yet.
+func ReplayBinding(ctx context.Context, c *catalog.Catalog, id string, binding catalog.Binding) (map[string]interface{}, error) {
+	existing, credentials, err := getBinding(ctx, c, id, binding.Id, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing.AppGuid != binding.AppGuid || catalog.ParametersHash(existing.Parameters) != catalog.ParametersHash(binding.Parameters) {
+		return nil, ErrBindingConflict
+	}
+
+	return credentials, nil
+}
+
+// Returns an existing binding and its user credentials. Bindings without secret are rendered without credentials of
+// their own if withoutSecret is set.
+func getBinding(ctx context.Context, c *catalog.Catalog, id string, bindingId string, withoutSecret bool) (catalog.Binding, map[string]interface{}, error) {
+	name := getName(id)
+	logger := getLogger()
+
+	state, err := getReleaseState(ctx, id, name, logger)
+	if err != nil {
+		return catalog.Binding{}, nil, err
+	}
+
+	metadata, err := catalog.ExtractMetadata(state.values)
+	if err != nil {
+		logger.Error("failed to fetch helmi metadata",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return catalog.Binding{}, nil, err
+	}
+
+	service := c.Service(metadata.ServiceId)
+	plan, err := service.Plan(metadata.PlanId)
+	if err != nil {
+		logger.Error("failed find plan with plan id",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("serviceId", metadata.ServiceId),
+			zap.String("planId", metadata.PlanId),
+			zap.Error(err))
+
+		return catalog.Binding{}, nil, err
+	}
+
+	// every binding created by this helmi version has a secret, even if the service has no binding section
+	secret, err := kubectl.GetSecret(ctx, getBindingName(name, bindingId), state.status.Namespace)
+	if err == kubectl.ErrNotFound && withoutSecret {
+		return legacyBinding(service, plan, state, bindingId)
+	} else if err == kubectl.ErrNotFound || (err == nil && isPending(secret)) {
+		return catalog.Binding{}, nil, ErrBindingNotFound
+	} else if err != nil {
+		logger.Error("failed to get binding",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("bindingId", bindingId),
+			zap.Error(err))
+
+		return catalog.Binding{}, nil, err
+	}
+
+	binding := bindingFromSecret(secret)
+
+	release, err := service.BindingReleaseSection(plan, state.nodes, state.status, state.values, binding)
+	if err != nil {
+		logger.Error("failed to parse user credentials",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("bindingId", bindingId),
+			zap.Error(err))
+
+		return catalog.Binding{}, nil, err
+	}
+
+	return binding, release.UserCredentials, nil
+}
+
+// Renders the credentials of a binding created before helmi kept a secret per binding, which all bindings of an
+// instance shared. Services with credentials per binding can not have created it.
+func legacyBinding(service *catalog.Service, plan *catalog.Plan, state releaseState, bindingId string) (catalog.Binding, map[string]interface{}, error) {
+	binding := catalog.Binding{Id: bindingId}
+
+	release, err := service.BindingReleaseSection(plan, state.nodes, state.status, state.values, binding)
+	if err != nil {
+		return catalog.Binding{}, nil, err
+	}
+
+	if release.Binding != nil {
+		return catalog.Binding{}, nil, ErrBindingNotFound
+	}
+
+	return binding, release.UserCredentials, nil
+}
+
+// Deletes the credentials of a binding
+func Unbind(ctx context.Context, c *catalog.Catalog, id string, bindingId string) error {
+	name := getName(id)
+	logger := getLogger()
+
+	state, err := getReleaseState(ctx, id, name, logger)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := catalog.ExtractMetadata(state.values)
+	if err != nil {
+		logger.Error("failed to fetch helmi metadata",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.Error(err))
+
+		return err
+	}
+
+	service := c.Service(metadata.ServiceId)
+	plan, err := service.Plan(metadata.PlanId)
+	if err != nil {
+		logger.Error("failed find plan with plan id",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("serviceId", metadata.ServiceId),
+			zap.String("planId", metadata.PlanId),
+			zap.Error(err))
+
+		return err
+	}
+
+	namespace := state.status.Namespace
+	bindingName := getBindingName(name, bindingId)
+
+	secret, err := kubectl.GetSecret(ctx, bindingName, namespace)
+	if err == kubectl.ErrNotFound {
+		release, err := service.BindingReleaseSection(plan, state.nodes, state.status, state.values, catalog.Binding{Id: bindingId})
+		if err != nil {
+			return err
+		}
+
+		if release.Binding == nil {
+			// services without a binding section have no credentials to delete
+			return nil
+		}
+
+		return ErrBindingNotFound
+	} else if err != nil {
+		logger.Error("failed to get binding",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("bindingId", bindingId),
+			zap.Error(err))
+
+		return err
+	}
+
+	release, err := service.BindingReleaseSection(plan, state.nodes, state.status, state.values, bindingFromSecret(secret))
+	if err == nil && release.Binding != nil && release.Binding.Delete != nil {
+		err = runBindingJob(ctx, bindingName+"-delete", namespace, bindingName, release.Binding.Delete)
+	}
+
+	if err != nil {
+		logger.Error("failed to delete binding",
+			zap.String("id", id),
+			zap.String("name", name),
+			zap.String("bindingId", bindingId),
+			zap.Error(err))
+
+		return err
+	}
+
+	err = kubectl.DeleteSecret(ctx, bindingName, namespace)
+	if err != nil && err != kubectl.ErrNotFound {
+		return err
+	}
+
+	logger.Info("binding deleted",
+		zap.String("id", id),
+		zap.String("name", name),
+		zap.String("bindingId", bindingId))
+
+	return nil
 }
 
 func min(x int, y int) int {
@@ -380,10 +1409,9 @@ func min(x int, y int) int {
 }
 
 func getName(value string) string {
-	const prefix = "helmi"
 	const maxLengthNoPrefix = 14
 
-	if strings.HasPrefix(value, prefix) {
+	if strings.HasPrefix(value, releasePrefix) {
 		return value
 	}
 
@@ -391,7 +1419,7 @@ func getName(value string) string {
 	name = strings.Replace(name, "-", "", -1)
 	name = strings.Replace(name, "_", "", -1)
 
-	return prefix + name[:min(maxLengthNoPrefix, len(name))]
+	return releasePrefix + name[:min(maxLengthNoPrefix, len(name))]
 }
 
 func getChart(service *catalog.Service, plan *catalog.Plan) (string, error) {
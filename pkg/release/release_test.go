@@ -1,9 +1,14 @@
 package release
 
 import (
+	"context"
+	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/monostream/helmi/pkg/catalog"
+	"github.com/monostream/helmi/pkg/helm"
+	"github.com/monostream/helmi/pkg/kubectl"
 )
 
 var csp = catalog.Plan{
@@ -31,6 +36,62 @@ func red(msg string) string {
 	return "\033[31m" + msg + "\033[39m\n\n"
 }
 
+// Replaces the helm client with a fake, the returned function restores the previous client
+func useFakeHelm() (*helm.Fake, func()) {
+	previous := helmClient
+	fake := helm.NewFake()
+	SetHelmClient(fake)
+
+	return fake, func() { SetHelmClient(previous) }
+}
+
+// Catalog with the service of cs and plans to update to, one of them with auto-rollback
+func getTestCatalog(t *testing.T) *catalog.Catalog {
+	c, err := catalog.NewFromSerialized([]byte(`---
+service:
+  _id: 12345
+  _name: test_service
+  description: service_description
+  chart: service_chart
+  chart-version: 1.2.3
+  plans:
+  - _id: 67890
+    _name: test_plan
+    description: plan_description
+  - _id: small
+    _name: small
+    description: plan_description
+    quotas:
+      instances: 10
+  - _id: large
+    _name: large
+    description: plan_description
+    auto-rollback: true
+---
+chart-values: {}
+---
+user-credentials: {}
+`))
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	return c
+}
+
+// Returns release values with the metadata of an instance of a plan of the test service
+func instanceValues(planId string, metadata map[string]interface{}) map[string]interface{} {
+	fields := map[string]interface{}{
+		"helmiServiceId": "12345",
+		"helmiPlanId":    planId,
+	}
+	for key, value := range metadata {
+		fields[key] = value
+	}
+
+	return map[string]interface{}{"__metadata": fields}
+}
+
 func Test_GetName(t *testing.T) {
 	const input string = "this_is-a_test_name_which-is_pretty-long"
 	const expected string = "helmithisisatestnam"
@@ -81,6 +142,147 @@ func Test_GetChartVersion(t *testing.T) {
 	}
 }
 
+func Test_GetBindingName(t *testing.T) {
+	name := getBindingName("helmitest1", "binding-id")
+
+	if name != getBindingName("helmitest1", "binding-id") {
+		t.Error(red("binding name is not stable"))
+	}
+
+	if name == getBindingName("helmitest1", "other-binding-id") {
+		t.Error(red("binding names of different bindings should differ"))
+	}
+
+	if len(name) != len("helmitest1")+13 {
+		t.Error(red(fmt.Sprintf("binding name %s has unexpected length", name)))
+	}
+}
+
+func Test_BindingSecret(t *testing.T) {
+	binding := catalog.Binding{
+		Id:         "binding-id",
+		AppGuid:    "app-guid",
+		Parameters: map[string]interface{}{"database": "db"},
+		Credentials: map[string]interface{}{
+			"username": "user",
+			"port":     5432,
+		},
+	}
+
+	secret, err := bindingSecret("helmitest1-binding", "namespace", "helmitest1", binding)
+	if err != nil {
+		t.Error(red(err.Error()))
+		return
+	}
+
+	if secret.Data["port"] != "5432" {
+		t.Error(red(fmt.Sprintf("unexpected secret data %v", secret.Data)))
+	}
+
+	restored := bindingFromSecret(secret)
+
+	expected := catalog.Binding{
+		Id:         "binding-id",
+		AppGuid:    "app-guid",
+		Parameters: map[string]interface{}{"database": "db"},
+		Credentials: map[string]interface{}{
+			"username": "user",
+			"port":     "5432",
+		},
+	}
+
+	if !reflect.DeepEqual(expected, restored) {
+		t.Error(red(fmt.Sprintf("expected %#v, got %#v", expected, restored)))
+	}
+}
+
+func Test_ParametersSecret(t *testing.T) {
+	secret := parametersSecret("helmiinstance", "default", map[string]string{"hash": "{}"})
+
+	if secret.Name != "helmiinstance-parameters" || secret.Namespace != "default" {
+		t.Error(red(fmt.Sprintf("unexpected secret %s/%s", secret.Namespace, secret.Name)))
+	}
+
+	// deleted together with the credentials of the bindings
+	if secret.Labels[bindingReleaseLabel] != "helmiinstance" {
+		t.Error(red("parameters secret should be labelled with the release"))
+	}
+}
+
+func Test_ParametersHash_LegacyRelease(t *testing.T) {
+	parameters := map[string]interface{}{"replicas": 3}
+
+	legacy := catalog.Metadata{Parameters: parameters}
+	if parametersHash(legacy) != catalog.ParametersHash(parameters) {
+		t.Error(red("hash of parameters stored in the values of older releases should be computed"))
+	}
+
+	current := catalog.Metadata{ParametersHash: "stored"}
+	if parametersHash(current) != "stored" {
+		t.Error(red("hash of the metadata should be used"))
+	}
+
+	// legacy parameters are returned without reading a secret
+	loaded, err := loadParameters(context.Background(), "helmiinstance", "default", legacy)
+	if err != nil || !reflect.DeepEqual(loaded, parameters) {
+		t.Error(red("parameters of older releases should be read from their values"))
+	}
+}
+
+func Test_LegacyBinding(t *testing.T) {
+	serialized := func(credentials string) []byte {
+		return []byte(`---
+service:
+  _id: 12345
+  _name: test_service
+  description: service_description
+  chart: service_chart
+  plans:
+  - _id: 67890
+    _name: test_plan
+    description: plan_description
+---
+chart-values: {}
+---
+user-credentials:
+  host: "{{ .Release.Name }}.{{ .Release.Namespace }}"
+` + credentials)
+	}
+
+	state := releaseState{
+		status: helm.Status{Name: "helmiinstance", Namespace: "default"},
+		values: instanceValues("67890", nil),
+	}
+
+	c, err := catalog.NewFromSerialized(serialized(""))
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	service := c.Service("12345")
+	plan, _ := service.Plan("67890")
+
+	_, credentials, err := legacyBinding(service, plan, state, "binding")
+	if err != nil || credentials["host"] != "helmiinstance.default" {
+		t.Error(red(fmt.Sprintf("credentials of bindings without secret should be rendered again, got %v %v", credentials, err)))
+	}
+
+	c, err = catalog.NewFromSerialized(serialized(`binding:
+  credentials:
+    username: "{{ .Binding.Id }}-user"
+`))
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	service = c.Service("12345")
+	plan, _ = service.Plan("67890")
+
+	if _, _, err := legacyBinding(service, plan, state, "binding"); err != ErrBindingNotFound {
+		t.Error(red(fmt.Sprintf("bindings of services with credentials per binding always have a secret, got %v", err)))
+	}
+}
+
 func Test_Healthchecks(t *testing.T) {
 	// url -> shouldSucceed
 	healthChecks := map[string]bool{
@@ -123,4 +325,232 @@ func Test_Healthchecks(t *testing.T) {
 			}
 		}
 	}
-}
\ No newline at end of file
+}
+
+func Test_CheckQuotas(t *testing.T) {
+	ctx := context.Background()
+
+	fake, restore := useFakeHelm()
+	defer restore()
+
+	install := func(name string, planId string, namespace string, org string) {
+		values := instanceValues(planId, map[string]interface{}{"helmiOrg": org})
+		fake.Install(ctx, name, "plan_chart", "1.2.3", values, namespace, true)
+	}
+
+	install("helmiinstance1", "67890", "space-a", "org-a")
+	install("helmiinstance2", "67890", "space-b", "org-a")
+	install("helmiinstance3", "other", "space-a", "org-b")
+	// instance of a dedicated namespace requested for space-d
+	dedicated := instanceValues("67890", map[string]interface{}{"helmiOrg": "org-d", "helmiNamespace": "space-d"})
+	fake.Install(ctx, "helmiinstance4", "plan_chart", "1.2.3", dedicated, "helmiinstance4", true)
+	// not an instance of helmi
+	fake.Install(ctx, "ingress", "nginx", "", nil, "space-a", true)
+
+	service := cs
+	plan := csp
+
+	if err := checkQuotas(ctx, &service, &plan, "space-a", "org-a"); err != nil {
+		t.Error(red("provision without quotas should be allowed: " + err.Error()))
+	}
+
+	plan.Quotas = &catalog.Quotas{InstancesPerNamespace: 2}
+	if err := checkQuotas(ctx, &service, &plan, "space-a", "org-a"); err != nil {
+		t.Error(red("instances of other plans should not count against quotas of the plan"))
+	}
+
+	plan.Quotas = &catalog.Quotas{InstancesPerOrg: 2}
+	if _, exceeded := checkQuotas(ctx, &service, &plan, "space-c", "org-a").(*QuotaError); !exceeded {
+		t.Error(red("quota per org should be exceeded"))
+	}
+
+	plan.Quotas = &catalog.Quotas{InstancesPerNamespace: 1}
+	if _, exceeded := checkQuotas(ctx, &service, &plan, "space-d", "org-d").(*QuotaError); !exceeded {
+		t.Error(red("instances of dedicated namespaces should count against the requested namespace"))
+	}
+
+	plan.Quotas = nil
+	service.Quotas = &catalog.Quotas{InstancesPerNamespace: 2}
+	if _, exceeded := checkQuotas(ctx, &service, &plan, "space-a", "org-c").(*QuotaError); !exceeded {
+		t.Error(red("quota of the service should count the instances of all plans"))
+	}
+
+	service.Quotas = &catalog.Quotas{Instances: 5}
+	if err := checkQuotas(ctx, &service, &plan, "space-a", "org-a"); err != nil {
+		t.Error(red("releases not installed by helmi should not count"))
+	}
+
+	SetMaxInstances(4)
+	defer SetMaxInstances(0)
+
+	if _, exceeded := checkQuotas(ctx, &service, &plan, "space-a", "org-a").(*QuotaError); !exceeded {
+		t.Error(red("the broker wide limit should be exceeded"))
+	}
+}
+
+func Test_QuotaLock(t *testing.T) {
+	c := getTestCatalog(t)
+
+	if name := QuotaLock(c, "12345", "67890"); len(name) > 0 {
+		t.Error(red("provisions without quotas should not be serialized, got lock " + name))
+	}
+
+	if name := QuotaLock(c, "12345", "small"); name != "quota/12345" {
+		t.Error(red("provisions of a service with quotas should share the lock of the service, got " + name))
+	}
+
+	SetMaxInstances(10)
+	defer SetMaxInstances(0)
+
+	if name := QuotaLock(c, "12345", "67890"); name != "quota" {
+		t.Error(red("the broker wide limit should serialize all provisions, got " + name))
+	}
+}
+
+func Test_RevisionMetadataCache(t *testing.T) {
+	ctx := context.Background()
+
+	fake, restore := useFakeHelm()
+	defer restore()
+
+	fake.Install(ctx, "helmiinstance", "plan_chart", "1.2.3", instanceValues("67890", nil), "default", true)
+
+	metadata, ok, err := revisionMetadata(ctx, "helmiinstance", 1)
+	if err != nil || !ok || metadata.PlanId != "67890" {
+		t.Error(red("metadata of the revision should be read from its values"))
+	}
+
+	// the cached metadata is returned while the release is listed
+	fake.Delete(ctx, "helmiinstance")
+
+	if _, ok, err := revisionMetadata(ctx, "helmiinstance", 1); err != nil || !ok {
+		t.Error(red("metadata of the revision should be cached"))
+	}
+
+	pruneMetadata(map[string]bool{})
+
+	if _, _, err := revisionMetadata(ctx, "helmiinstance", 1); err == nil {
+		t.Error(red("metadata of releases which are no longer listed should be dropped"))
+	}
+}
+
+func Test_GetHealth_PendingResources(t *testing.T) {
+	ctx := context.Background()
+
+	fake, restore := useFakeHelm()
+	defer restore()
+
+	name := getName("instance")
+	fake.Install(ctx, name, "plan_chart", "1.2.3", nil, "default", true)
+	fake.Resources[name] = []kubectl.Resource{
+		{Object: kubectl.Object{Kind: "StatefulSet", Name: name + "-mariadb"}, Desired: 1, Available: 0},
+		{Object: kubectl.Object{Kind: "PersistentVolumeClaim", Name: "data-" + name + "-mariadb-0"}, Reason: "pending"},
+		{Object: kubectl.Object{Kind: "ConfigMap", Name: name + "-mariadb"}, Ready: true},
+	}
+
+	health, err := GetHealth(ctx, nil, "instance")
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	expected := []string{
+		"StatefulSet/" + name + "-mariadb: 0/1 ready",
+		"PersistentVolumeClaim/data-" + name + "-mariadb-0: pending",
+	}
+
+	if health.IsReady || !reflect.DeepEqual(health.PendingResources, expected) {
+		t.Error(red(fmt.Sprintf("expected pending resources %v, got %v", expected, health.PendingResources)))
+	}
+}
+
+func Test_HistoryAndRollback(t *testing.T) {
+	ctx := context.Background()
+
+	fake, restore := useFakeHelm()
+	defer restore()
+
+	c := getTestCatalog(t)
+
+	metadata := func(planId string, chartVersion string) map[string]interface{} {
+		return instanceValues(planId, map[string]interface{}{"helmiChartVersion": chartVersion})
+	}
+
+	name := getName("instance")
+	fake.Install(ctx, name, "service_chart", "1.2.3", metadata("67890", "1.2.3"), "default", true)
+	fake.Upgrade(ctx, name, "service_chart", "1.3.0", metadata("removed", "1.3.0"), true)
+
+	revisions, err := History(ctx, "instance", DefaultHistory)
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	if len(revisions) != 2 || revisions[0].PlanId != "67890" || revisions[1].ChartVersion != "1.3.0" {
+		t.Error(red(fmt.Sprintf("unexpected revisions %v", revisions)))
+	}
+
+	if revisions, _ := History(ctx, "instance", 1); len(revisions) != 1 || revisions[0].Revision != 2 {
+		t.Error(red(fmt.Sprintf("history should list the latest revisions, got %v", revisions)))
+	}
+
+	if _, err := Rollback(ctx, c, "instance", 3, false); err != ErrRevisionNotFound {
+		t.Error(red("rollback to an unknown revision should fail"))
+	}
+
+	if _, err := Rollback(ctx, c, "instance", 1, false); err != ErrRollbackPlanChange {
+		t.Error(red("rollback to another plan should require the plan change to be allowed"))
+	}
+
+	result, err := Rollback(ctx, c, "instance", 1, true)
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	if result.Target.ChartVersion != "1.2.3" || result.Revision != 3 || result.PreviousPlanId != "removed" {
+		t.Error(red(fmt.Sprintf("unexpected rollback %v", result)))
+	}
+
+	if result, err := Rollback(ctx, c, "instance", 1, false); err != nil || result.Revision != 4 {
+		t.Error(red("rollback to a revision of the same plan should not require the plan change to be allowed"))
+	}
+
+	if _, err := Rollback(ctx, c, "instance", 2, true); err == nil {
+		t.Error(red("rollback to a plan which is not in the catalog should fail"))
+	}
+
+	if _, err := History(ctx, "missing", DefaultHistory); err != ErrReleaseNotFound {
+		t.Error(red("history of a missing release should not be found"))
+	}
+}
+
+func Test_RollbackUpdate(t *testing.T) {
+	ctx := context.Background()
+
+	fake, restore := useFakeHelm()
+	defer restore()
+
+	c := getTestCatalog(t)
+
+	name := getName("instance")
+	fake.Install(ctx, name, "service_chart", "1.2.3", instanceValues("small", nil), "default", true)
+	fake.Upgrade(ctx, name, "service_chart", "1.2.3", instanceValues("small", nil), true)
+
+	if rolledBackTo, _ := RollbackUpdate(ctx, c, "instance", 2); rolledBackTo != 0 {
+		t.Error(red("updates of plans without auto-rollback should not be rolled back"))
+	}
+
+	fake.Upgrade(ctx, name, "service_chart", "1.2.3", instanceValues("large", nil), true)
+
+	if rolledBackTo, _ := RollbackUpdate(ctx, c, "instance", 2); rolledBackTo != 0 {
+		t.Error(red("updates followed by another revision should not be rolled back"))
+	}
+
+	rolledBackTo, err := RollbackUpdate(ctx, c, "instance", 3)
+	if err != nil {
+		t.Fatal(red(err.Error()))
+	}
+
+	latest, _ := getRevision(ctx, name)
+	if rolledBackTo != 2 || latest.Revision != 4 || RolledBackTo(latest) != 2 {
+		t.Error(red(fmt.Sprintf("update should be rolled back to revision 2, got %d as %v", rolledBackTo, latest)))
+	}
+}